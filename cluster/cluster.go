@@ -0,0 +1,72 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package cluster is the yar cluster package and module, kept apart from the
+// raft node so tools can load it without dragonboat.
+package cluster
+
+import "github.com/anticrm/rack/yar"
+
+func initFunc(vm *yar.VM) yar.Value {
+	// nodes := vm.Dictionary.Find(vm, vm.GetSymbolID("cluster"))
+	// nodes.Add(vm, vm.AllocString("localhost:63001").Value())
+	// vm.Dictionary.Put(vm, vm.GetSymbolID("nodes"), nodes.Value())
+	return 0
+}
+
+func pkg() *yar.Pkg {
+	result := yar.NewPackage("cluster")
+	result.AddFunc("init", initFunc)
+	return result
+}
+
+const clusterY = `
+module [name: 'cluster exports: [cluster]] [
+	cluster: make-object [
+		nodes: make-object []
+		services: []
+		init: fn [] [
+			put nodes "node-1" make-object [addr: "localhost:63001" cpus: 2 docker-procs: []]
+			put nodes "node-2" make-object [addr: "localhost:63002" cpus: 2 docker-procs: []]
+		]
+		docker-service: fn [_image _port] [
+			print _image
+			foreach node nodes [
+				repeat cpu node/cpus [
+					append node/docker-procs make-object [image: _image port: _port]
+				]
+			]
+		]
+		node-info: fn [nodeID nodeName cores cpuModelName /local node] [
+			node: get in nodes nodeName
+			if unset? node [node: put nodes nodeName make-object [id: nodeID cores: none cpuModelName: none]]
+			node/cores: cores
+			node/cpuModelName: cpuModelName
+		]
+	]
+]
+`
+
+func module(vm *yar.VM) yar.Value {
+	code := vm.MustParse(clusterY)
+	return vm.BindAndExec(code)
+}
+
+// Load adds the cluster package and the cluster object to a VM booted with
+// yar.BootVM.
+func Load(vm *yar.VM) yar.Value {
+	vm.Library.Add(pkg())
+	return module(vm)
+}
@@ -0,0 +1,406 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anticrm/rack/cluster"
+	"github.com/anticrm/rack/yar"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	memSize   = 65536
+	stackSize = 1000
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: yar [flags] [script.y ...]\n\n")
+	fmt.Fprintf(os.Stderr, "Runs the scripts in order, or starts a REPL when there are none.\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	loadCluster := flag.Bool("cluster", false, "Load the cluster package")
+	compile := flag.Bool("compile", false, "Run blocks through compiled code")
+	trace := flag.Bool("trace", false, "Trace evaluation to stderr")
+	profile := flag.String("profile", "", "Write a pprof profile of the evaluation to the file")
+	path := flag.String("path", ".", "Directories import reads modules from, separated by "+string(os.PathListSeparator))
+	flag.Usage = usage
+	flag.Parse()
+	if *trace && *profile != "" {
+		fmt.Fprintf(os.Stderr, "-trace and -profile can't be used together\n")
+		os.Exit(2)
+	}
+
+	vm := yar.NewVM(memSize, stackSize)
+	yar.BootVM(vm)
+	if *loadCluster {
+		cluster.Load(vm)
+	}
+	vm.Compile = *compile
+	vm.ModulePath = filepath.SplitList(*path)
+	if *trace {
+		vm.Hook = yar.NewTracer(os.Stderr)
+	}
+	if *profile != "" {
+		vm.Hook = yar.NewProfiler()
+	}
+	os.Exit(run(vm, flag.Args(), *profile))
+}
+
+// run runs the files, or stdin or the REPL when there are none, and returns
+// the exit status.
+func run(vm *yar.VM, files []string, profile string) int {
+	status := 0
+	if len(files) > 0 {
+		for _, file := range files {
+			if err := runFile(vm, file); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+				status = 1
+				break
+			}
+		}
+	} else if fd := int(os.Stdin.Fd()); !terminal.IsTerminal(fd) {
+		if err := runScript(vm, os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 1
+		}
+	} else {
+		repl(vm, fd)
+	}
+	if p, ok := vm.Hook.(*yar.Profiler); ok && profile != "" {
+		if err := writeProfile(p, profile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func writeProfile(p *yar.Profiler, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := p.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// eval evaluates source, the profiler is stopped when it is set. The result
+// is kept through the collection that may follow.
+func eval(vm *yar.VM, source string) (yar.Value, error) {
+	result, err := vm.Eval(source)
+	if p, ok := vm.Hook.(*yar.Profiler); ok {
+		p.Stop()
+	}
+	vm.MaybeGC(&result)
+	return result, err
+}
+
+// runFile runs a script, the modules it imports are looked up next to it
+// first.
+func runFile(vm *yar.VM, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	path := vm.ModulePath
+	vm.ModulePath = append([]string{filepath.Dir(file)}, path...)
+	defer func() { vm.ModulePath = path }()
+	return runScript(vm, f)
+}
+
+func runScript(vm *yar.VM, r io.Reader) error {
+	source, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = eval(vm, string(source))
+	return err
+}
+
+// R E P L
+
+type console struct {
+	io.Reader
+	io.Writer
+}
+
+type session struct {
+	vm       *yar.VM
+	fd       int
+	term     *terminal.Terminal
+	debugger *yar.Debugger
+	hook     yar.Hook // the tracer or profiler, set while not debugging
+	debug    bool     // there are breakpoints or a step
+}
+
+// readLine reads a line with the terminal in raw mode for line editing, the
+// terminal is restored while code runs.
+func (s *session) readLine(prompt string) (string, error) {
+	s.term.SetPrompt(prompt)
+	state, err := terminal.MakeRaw(s.fd)
+	if err != nil {
+		return "", err
+	}
+	defer terminal.Restore(s.fd, state)
+	return s.term.ReadLine()
+}
+
+func repl(vm *yar.VM, fd int) {
+	fmt.Print("yar, :help for help\n")
+	s := &session{vm: vm, fd: fd, term: terminal.NewTerminal(console{os.Stdin, os.Stdout}, "")}
+	s.debugger = yar.NewDebugger(s.stopped)
+	s.hook = vm.Hook
+	var input strings.Builder
+	prompt := ">> "
+	for {
+		line, err := s.readLine(prompt)
+		if err == io.EOF {
+			fmt.Println()
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		if input.Len() == 0 && strings.HasPrefix(line, ":") {
+			if !s.meta(strings.Fields(line)) {
+				return
+			}
+			continue
+		}
+		input.WriteString(line)
+		input.WriteByte('\n')
+		if incomplete(input.String()) {
+			prompt = ".. "
+			continue
+		}
+		prompt = ">> "
+		source := input.String()
+		input.Reset()
+		if strings.TrimSpace(source) == "" {
+			continue
+		}
+
+		result, err := eval(vm, source)
+		if err != nil {
+			fmt.Println(err)
+		} else if result != 0 {
+			fmt.Printf("== %s\n", vm.ToString(result))
+		}
+		s.debugger.Continue()
+	}
+}
+
+// meta runs a REPL command, it returns false to quit.
+func (s *session) meta(command []string) bool {
+	vm := s.vm
+	arg := ""
+	if len(command) > 1 {
+		arg = command[1]
+	}
+	switch command[0] {
+	case ":quit", ":q":
+		return false
+	case ":trace":
+		s.hook = nil
+		if arg != "off" {
+			s.hook = yar.NewTracer(os.Stdout)
+		}
+		s.setHook(s.debug)
+	case ":profile":
+		p, ok := s.hook.(*yar.Profiler)
+		switch {
+		case arg == "on":
+			s.hook = yar.NewProfiler()
+			s.setHook(s.debug)
+		case arg == "off":
+			s.hook = nil
+			s.setHook(s.debug)
+		case !ok:
+			fmt.Println("profiling is off, :profile on starts it")
+		case arg != "":
+			if err := writeProfile(p, arg); err != nil {
+				fmt.Println(err)
+			}
+		default:
+			fmt.Printf("%12s %12s %10s %10s  %s\n", "flat", "cum", "flat time", "cum time", "name")
+			for _, e := range p.Top() {
+				fmt.Printf("%12d %12d %10v %10v  %s\n", e.Instructions, e.CumInstructions,
+					e.Wall.Round(time.Microsecond), e.CumWall.Round(time.Microsecond), e.Name)
+			}
+		}
+	case ":break":
+		if line, err := strconv.Atoi(arg); err == nil {
+			s.debugger.BreakOnLine(line)
+		} else if arg != "" {
+			s.debugger.BreakOnWord(arg)
+		} else {
+			fmt.Println(":break needs a word or a line")
+			break
+		}
+		s.setHook(true)
+	case ":clear":
+		s.debugger.ClearBreakpoints()
+		s.setHook(false)
+	case ":step":
+		s.debugger.Step()
+		s.setHook(true)
+	case ":dump":
+		vm.Dump()
+	case ":symbols":
+		ids := make([]uint, 0, len(vm.InverseSymbols))
+		for id := range vm.InverseSymbols {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		w := bufio.NewWriter(os.Stdout)
+		for _, id := range ids {
+			fmt.Fprintf(w, "%5d %s\n", id, vm.InverseSymbols[id])
+		}
+		w.Flush()
+	case ":mem":
+		stats := vm.HeapStats()
+		fmt.Printf("cells %d, pages %d, live %d, threshold %d, collections %d, collected %d\n",
+			stats.Cells, stats.Pages, stats.Live, stats.Threshold, stats.Collections, stats.Collected)
+	case ":help":
+		fmt.Print(":dump            print the heap cells\n" +
+			":symbols         list the symbol table\n" +
+			":mem             print heap statistics\n" +
+			":trace [off]     trace evaluation\n" +
+			":profile on|off  profile evaluation\n" +
+			":profile [file]  print the profile or write it in the pprof format\n" +
+			":break word|line stop at a word or a line\n" +
+			":clear           remove breakpoints\n" +
+			":step            stop at the first value of the next input\n" +
+			":quit            leave\n")
+	default:
+		fmt.Printf("unknown command %s, :help for help\n", command[0])
+	}
+	return true
+}
+
+// setHook sets the tracer or profiler, or the debugger which takes over while
+// it has breakpoints or a step to make.
+func (s *session) setHook(debug bool) {
+	s.debug = debug
+	s.vm.Hook = s.hook
+	if debug {
+		s.vm.Hook = s.debugger
+	}
+}
+
+// stopped runs debugger commands until one resumes evaluation.
+func (s *session) stopped(d *yar.Debugger, pos yar.Position) yar.Resume {
+	vm := d.VM()
+	fmt.Printf("stopped at %d:%d %s\n", pos.Line, pos.Column, vm.Mold(pos.Value))
+	for {
+		line, err := s.readLine("dbg> ")
+		if err != nil {
+			return yar.Continue
+		}
+		command := strings.Fields(line)
+		if len(command) == 0 {
+			return yar.StepIn
+		}
+		switch command[0] {
+		case "s", "step":
+			return yar.StepIn
+		case "n", "next":
+			return yar.StepOver
+		case "o", "out":
+			return yar.StepOut
+		case "c", "continue":
+			return yar.Continue
+		case "bt", "stack":
+			stack := d.Stack()
+			for i := len(stack) - 1; i >= 0; i-- {
+				fmt.Printf("#%d %s at %d:%d\n", len(stack)-1-i, stack[i].Name, stack[i].Line, stack[i].Column)
+			}
+		case "l", "locals":
+			for _, local := range d.Locals() {
+				fmt.Printf("%s: %s\n", local.Name, vm.Mold(local.Value))
+			}
+		case "p", "print":
+			for _, name := range command[1:] {
+				if value, ok := d.Get(name); ok {
+					fmt.Printf("%s: %s\n", name, vm.Mold(value))
+				} else {
+					fmt.Printf("%s has no value\n", name)
+				}
+			}
+		default:
+			fmt.Print("s step, n next, o out, c continue, bt stack, l locals, p word...\n")
+		}
+	}
+}
+
+// incomplete tells if the source has unclosed blocks or {} strings, so the
+// REPL reads more lines before evaluating it. Unbalanced ] and "" strings are
+// left to the parser to report.
+func incomplete(source string) bool {
+	depth, braces := 0, 0
+	quoted := false
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case (quoted || braces > 0) && c == '^':
+			i++
+		case quoted:
+			if c == '"' || c == '\n' {
+				quoted = false
+			}
+		case braces > 0:
+			switch c {
+			case '{':
+				braces++
+			case '}':
+				braces--
+			}
+		case c == ';':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			quoted = true
+		case c == '{':
+			braces++
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth > 0 || braces > 0
+}
@@ -0,0 +1,118 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/anticrm/rack/yar"
+)
+
+func TestIncomplete(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"", false},
+		{"add 1 2", false},
+		{"f: fn [x] [", true},
+		{"f: fn [x] [\n  x\n]", false},
+		{"[[1] [2]", true},
+		{"[1]]", false},
+		{"{braced", true},
+		{"{outer {inner} still", true},
+		{"{outer {inner}}", false},
+		{"{^}", true},
+		{"{[}", false},
+		{`"[" 1`, false},
+		{`"^"[" 1`, false},
+		{"\"unclosed\n[", true},
+		{"; [ in a comment\n1", false},
+		{"[ ; ] in a comment\n", true},
+	}
+	for _, test := range tests {
+		if got := incomplete(test.source); got != test.want {
+			t.Errorf("incomplete(%q) = %v, want %v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, source string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	ok := write("ok.y", "a: 1")
+	fails := write("fails.y", "b: 1 cause-error 'user 'boom []")
+	syntax := write("syntax.y", "c: [1")
+	after := write("after.y", "d: 1")
+
+	tests := []struct {
+		name    string
+		files   []string
+		profile string
+		want    int
+		set     []string // words set by the files that ran
+		unset   []string // words of the files that must not run
+	}{
+		{"ok", []string{ok}, "", 0, []string{"a"}, nil},
+		{"error", []string{fails, after}, "", 1, []string{"b"}, []string{"d"}},
+		{"syntax", []string{ok, syntax, after}, "", 1, []string{"a"}, []string{"c", "d"}},
+		{"missing", []string{filepath.Join(dir, "missing.y"), ok}, "", 1, nil, []string{"a"}},
+		{"profile", []string{ok}, filepath.Join(dir, "missing", "prof"), 1, []string{"a"}, nil},
+	}
+	for _, test := range tests {
+		vm := yar.NewVM(memSize, stackSize)
+		yar.BootVM(vm)
+		if test.profile != "" {
+			vm.Hook = yar.NewProfiler()
+		}
+		if got := run(vm, test.files, test.profile); got != test.want {
+			t.Errorf("%s: run = %d, want %d", test.name, got, test.want)
+		}
+		for _, word := range test.set {
+			if _, err := vm.Eval(word); err != nil {
+				t.Errorf("%s: %s is not set: %v", test.name, word, err)
+			}
+		}
+		for _, word := range test.unset {
+			if _, err := vm.Eval(word); err == nil {
+				t.Errorf("%s: %s is set", test.name, word)
+			}
+		}
+	}
+}
+
+func TestEvalKeepsResult(t *testing.T) {
+	vm := yar.NewVM(1000, stackSize)
+	yar.BootVM(vm)
+	result, err := eval(vm, `loop 200 [copy [1 2 3]] make-object [a: [1 2]]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.HeapStats().Collections == 0 {
+		t.Fatal("no collection after eval")
+	}
+	if got := vm.Mold(result); got != "make-object [a: [1 2]]" {
+		t.Errorf("got %s after a collection", got)
+	}
+}
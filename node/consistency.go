@@ -0,0 +1,147 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lni/dragonboat/v3"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+// Replicas compare state hashes through the raft log itself. A check entry
+// makes every replica record its hash at the same log position, a verify entry
+// that follows carries the proposer's hash for everybody else to compare with.
+// Neither entry touches the VM. Control entries start with controlMagic, the
+// 0xff byte in it never appears in UTF-8 text, so no script is taken for one.
+const (
+	controlMagic     = "\x00\xffrack-control\x00"
+	hashCheckPrefix  = controlMagic + "hash-check "
+	hashVerifyPrefix = controlMagic + "hash-verify "
+	maxHashChecks    = 16
+)
+
+func isHashCommand(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(controlMagic))
+}
+
+func hashCheckCommand(token string) []byte {
+	return []byte(hashCheckPrefix + token)
+}
+
+func hashVerifyCommand(token string, hash uint64, nodeID uint64) []byte {
+	return []byte(fmt.Sprintf("%s%s %016x %d", hashVerifyPrefix, token, hash, nodeID))
+}
+
+func (s *StateMachine) applyHashCommand(data []byte) sm.Result {
+	switch {
+	case bytes.HasPrefix(data, []byte(hashCheckPrefix)):
+		token := string(data[len(hashCheckPrefix):])
+		hash := s.VM.Hash()
+		s.recordHash(token, hash)
+		return sm.Result{Value: hash}
+	case bytes.HasPrefix(data, []byte(hashVerifyPrefix)):
+		var token string
+		var hash, nodeID uint64
+		if _, err := fmt.Sscanf(string(data[len(hashVerifyPrefix):]), "%s %x %d", &token, &hash, &nodeID); err != nil {
+			log.Printf("node %d: malformed hash verification: %v", s.NodeID, err)
+			return sm.Result{}
+		}
+		local, ok := s.checks[token]
+		if ok && local != hash {
+			log.Printf("node %d: state diverged from node %d at check %s: local %016x, remote %016x",
+				s.NodeID, nodeID, token, local, hash)
+			return sm.Result{Value: 1}
+		}
+		return sm.Result{}
+	}
+	log.Printf("node %d: unknown control entry %q", s.NodeID, data)
+	return sm.Result{}
+}
+
+// recordHash keeps the hashes of the last few checks only, a replica that
+// restored from a snapshot simply has nothing to compare for older ones.
+func (s *StateMachine) recordHash(token string, hash uint64) {
+	s.checks[token] = hash
+	s.checkOrder = append(s.checkOrder, token)
+	if len(s.checkOrder) > maxHashChecks {
+		delete(s.checks, s.checkOrder[0])
+		s.checkOrder = s.checkOrder[1:]
+	}
+}
+
+// defaultCheckInterval is the interval of consistency checks when the cluster
+// config sets none.
+const defaultCheckInterval = time.Minute
+
+// consistencyChecker proposes checks from the leader only, and only when
+// commands were applied since its last check, so an idle cluster doesn't grow
+// its log.
+type consistencyChecker struct {
+	nh      *dragonboat.NodeHost
+	nodeID  uint64
+	seq     int
+	applied uint64
+	checked bool
+}
+
+func (c *consistencyChecker) check() error {
+	leader, ok, err := c.nh.GetLeaderID(clusterID)
+	if err != nil || !ok {
+		return err
+	}
+	result, err := c.nh.StaleRead(clusterID, appliedQuery{})
+	if err != nil {
+		return err
+	}
+	applied := result.(uint64)
+	if !c.due(leader == c.nodeID, applied) {
+		return nil
+	}
+	c.seq++
+	if err := checkConsistency(c.nh, c.nodeID, c.seq); err != nil {
+		return err
+	}
+	c.applied, c.checked = applied, true
+	return nil
+}
+
+// due reports whether a check is to be proposed with the count of commands
+// applied by this node.
+func (c *consistencyChecker) due(leader bool, applied uint64) bool {
+	return leader && (!c.checked || applied != c.applied)
+}
+
+func checkConsistency(nh *dragonboat.NodeHost, nodeID uint64, seq int) error {
+	cs := nh.GetNoOPSession(clusterID)
+	token := fmt.Sprintf("%d-%d", nodeID, seq)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	result, err := nh.SyncPropose(ctx, cs, hashCheckCommand(token))
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	_, err = nh.SyncPropose(ctx, cs, hashVerifyCommand(token, result.Value, nodeID))
+	cancel()
+	return err
+}
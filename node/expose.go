@@ -22,8 +22,41 @@ import (
 	"github.com/anticrm/rack/yar"
 )
 
+// HttpService serves the functions scripts expose on its mux.
+type HttpService struct {
+	mux *http.ServeMux
+	// owner keeps the exposed functions of a VM which changes while they are
+	// served, nil serves them from a clone of the VM taken by expose.
+	owner exposer
+}
+
+// exposer keeps the functions exposed in a VM.
+type exposer interface {
+	// expose keeps a function and returns its index.
+	expose(fn yar.Value) int
+	// exposedView returns a read-only view of the VM and the function of the
+	// index in it, false when the function is no longer exposed.
+	exposedView(i int) (*yar.VM, yar.Value, bool)
+}
+
+// frozenVM serves functions from a VM which doesn't change once they are
+// exposed.
+type frozenVM struct {
+	vm  *yar.VM
+	fns []yar.Value
+}
+
+func (f *frozenVM) expose(fn yar.Value) int {
+	f.fns = append(f.fns, fn)
+	return len(f.fns) - 1
+}
+
+func (f *frozenVM) exposedView(i int) (*yar.VM, yar.Value, bool) {
+	return f.vm, f.fns[i], true
+}
+
 func expose(vm *yar.VM) yar.Value {
-	fn := yar.Proc(vm.Next())
+	fn := vm.Next()
 	params := yar.Block(vm.Next())
 
 	var extractors []func(r *http.Request) yar.Value
@@ -44,21 +77,31 @@ func expose(vm *yar.VM) yar.Value {
 		}
 	}
 
-	stackSize := len(extractors)
-	if stackSize != fn.StackSize() {
-		panic("stack mismatch")
+	service := vm.Services["http"].(*HttpService)
+	owner := service.owner
+	if owner == nil {
+		owner = &frozenVM{vm: vm.Clone()}
 	}
-	clone := vm.Clone()
+	id := owner.expose(fn)
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		stack := make([]yar.Value, 100)
+		view, fn, ok := owner.exposedView(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		args := make([]yar.Value, len(extractors))
 		for i, e := range extractors {
-			stack[i] = e(r)
+			args[i] = e(r)
+		}
+		fork := view.Fork(make([]yar.Value, stackSize), 0)
+		fork.Limits = queryLimits
+		value, err := fork.Call(yar.Proc(fn), args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		fork := clone.Fork(stack, uint(stackSize))
-		value := fork.Exec(fn.First())
 		fmt.Fprintf(w, "Hello, %016x", value)
 	}
-	service := vm.Services["http"].(*HttpService)
 	service.mux.HandleFunc("/test", handler)
 	return 0
 }
@@ -20,10 +20,12 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/anticrm/rack/yar"
+	"github.com/lni/dragonboat/v3"
 	"github.com/shirou/gopsutil/cpu"
 )
 
-func startHostMonitor(nodeID uint64, nodeName string, cmd chan string) chan bool {
+func startHostMonitor(nh *dragonboat.NodeHost, nodeID uint64, nodeName string, cmd chan string) chan bool {
 
 	ticker := time.NewTicker(10 * time.Second)
 	done := make(chan bool)
@@ -39,11 +41,21 @@ func startHostMonitor(nodeID uint64, nodeName string, cmd chan string) chan bool
 				if err != nil {
 					fmt.Printf("%v\n", err)
 				}
-				sendCommand(cmd, []string{"cluster/node-info",
-					strconv.Itoa(int(nodeID)), quote(nodeName), strconv.Itoa(int(cpuInfo[0].Cores)), quote(cpuInfo[0].ModelName)})
+				sendCommand(cmd, nodeInfoArgs(nodeID, nodeName, cpuInfo[0]))
+				if stats, err := nh.StaleRead(clusterID, heapStatsQuery{}); err == nil {
+					heap := stats.(yar.HeapStats)
+					fmt.Printf("Heap: %d cells (%d pages), %d live after %d collections, next at %d\n",
+						heap.Cells, heap.Pages, heap.Live, heap.Collections, heap.Threshold)
+				}
 			}
 		}
 	}()
 
 	return done
 }
+
+// nodeInfoArgs returns the cluster/node-info command reporting the host.
+func nodeInfoArgs(nodeID uint64, nodeName string, info cpu.InfoStat) []string {
+	return []string{"cluster/node-info",
+		strconv.Itoa(int(nodeID)), yar.MoldString(nodeName), strconv.Itoa(int(info.Cores)), yar.MoldString(info.ModelName)}
+}
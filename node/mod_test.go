@@ -16,18 +16,33 @@
 package node
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
-	"github.com/anticrm/rack/yar"
+	"github.com/shirou/gopsutil/cpu"
 )
 
-func TestClusterInit(t *testing.T) {
-	vm := yar.NewVM(1000, 100)
-	yar.BootVM(vm)
-	vm.Library.Add(clusterPackage())
-	clusterModule(vm)
-	code := vm.Parse("cluster/init cluster/docker-service \"redis\" \"redis\" print cluster/nodes")
-	result := vm.BindAndExec(code)
-	t.Logf("result: %016x", result)
-	// vm.Dump()
+func TestNodeInfo(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	info := cpu.InfoStat{Cores: 4, ModelName: `Intel(R) "Xeon" CPU`}
+	command := func(cores int32) []byte {
+		info.Cores = cores
+		return []byte(strings.Join(nodeInfoArgs(1, "node-1", info), " "))
+	}
+
+	// the first report adds the node, the next ones update it
+	for _, cores := range []int32{4, 8} {
+		if result, _ := s.Update(command(cores)); result.Value == 0 {
+			t.Fatalf("node-info failed: %s", result.Data)
+		}
+		result, err := s.Lookup("reduce [cluster/nodes/node-1 cluster/nodes/node-1/cores]")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf(`[make-object [id: 1 cores: %d cpuModelName: "Intel(R) ^"Xeon^" CPU"] %d]`, cores, cores)
+		if string(result.([]byte)) != want {
+			t.Errorf("got %s, want %s", result, want)
+		}
+	}
 }
@@ -17,8 +17,8 @@ package node
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -39,6 +39,12 @@ type NodeConfig struct {
 
 type ClusterConfig struct {
 	Nodes []NodeConfig `yaml:"nodes"`
+	// Profile is a file the profile of commands is written to, see
+	// yar.Profiler. Commands aren't profiled when it is empty.
+	Profile string `yaml:"profile"`
+	// ConsistencyCheck is the interval replicas compare their state hashes
+	// at, a minute when it is 0. Checks are off when it is negative.
+	ConsistencyCheck time.Duration `yaml:"consistency-check"`
 }
 
 type Cluster struct {
@@ -162,7 +168,11 @@ func (c *Cluster) Start(nodeAddr string) {
 	if err != nil {
 		panic(err)
 	}
-	if err := nh.StartCluster(initialMembers, false, NewStateMachine, rc); err != nil {
+	factory := NewStateMachine
+	if c.config.Profile != "" {
+		factory = newProfiledStateMachine
+	}
+	if err := nh.StartCluster(initialMembers, false, factory, rc); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to add cluster, %v\n", err)
 		os.Exit(1)
 	}
@@ -175,14 +185,19 @@ func (c *Cluster) Start(nodeAddr string) {
 		for {
 			select {
 			case <-ticker.C:
+				if c.config.Profile != "" {
+					if err := writeProfile(nh, c.config.Profile); err != nil {
+						fmt.Fprintf(os.Stderr, "can't write profile: %v\n", err)
+					}
+				}
 				fmt.Fprintf(os.Stdout, "synchronizing views...\n")
 				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-				result, err := nh.SyncRead(ctx, clusterID, []byte{})
+				result, err := nh.SyncRead(ctx, clusterID, "cluster/nodes")
 				cancel()
 				if err == nil {
-					var count uint64
-					count = binary.LittleEndian.Uint64(result.([]byte))
-					fmt.Fprintf(os.Stdout, "count: %d\n", count)
+					fmt.Fprintf(os.Stdout, "nodes: %s\n", result.([]byte))
+				} else {
+					fmt.Fprintf(os.Stderr, "SyncRead returned error %v\n", err)
 				}
 			case <-raftStopper.ShouldStop():
 				return
@@ -190,6 +205,26 @@ func (c *Cluster) Start(nodeAddr string) {
 		}
 	})
 
+	if interval := c.config.ConsistencyCheck; interval >= 0 {
+		if interval == 0 {
+			interval = defaultCheckInterval
+		}
+		raftStopper.RunWorker(func() {
+			checker := &consistencyChecker{nh: nh, nodeID: nodeID}
+			ticker := time.NewTicker(interval)
+			for {
+				select {
+				case <-ticker.C:
+					if err := checker.check(); err != nil {
+						fmt.Fprintf(os.Stderr, "consistency check failed: %v\n", err)
+					}
+				case <-raftStopper.ShouldStop():
+					return
+				}
+			}
+		})
+	}
+
 	raftStopper.RunWorker(func() {
 		cs := nh.GetNoOPSession(clusterID)
 		for {
@@ -207,8 +242,17 @@ func (c *Cluster) Start(nodeAddr string) {
 		}
 	})
 
-	startHostMonitor(nodeID, nodeName, cmdChannel)
+	startHostMonitor(nh, nodeID, nodeName, cmdChannel)
 	startCtl(cmdChannel)
 
 	raftStopper.Wait()
 }
+
+// writeProfile writes the profile of the commands applied by this node.
+func writeProfile(nh *dragonboat.NodeHost, file string) error {
+	profile, err := nh.StaleRead(clusterID, profileQuery{})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, profile.([]byte), 0644)
+}
@@ -29,10 +29,6 @@ type Node1 struct {
 	vm *yar.VM
 }
 
-type HttpService struct {
-	mux *http.ServeMux
-}
-
 func NewNode1() *Node1 {
 
 	vm := yar.NewVM(1000, 100)
@@ -42,7 +38,7 @@ func NewNode1() *Node1 {
 	service := &HttpService{mux: http.NewServeMux()}
 	vm.Services["http"] = service
 
-	code := vm.Parse("calc: fn [x y] [add x y] expose :calc [x y]")
+	code := vm.MustParse("calc: fn [x y] [add x y] expose :calc [x y]")
 	vm.BindAndExec(code)
 
 	// mux.Handle("/", &exposedFn{})
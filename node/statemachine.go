@@ -16,77 +16,255 @@
 package node
 
 import (
-	"encoding/binary"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/anticrm/rack/cluster"
 	"github.com/anticrm/rack/yar"
 	sm "github.com/lni/dragonboat/v3/statemachine"
 )
 
+const (
+	memSize   = 65536
+	stackSize = 100
+)
+
+// commandLimits bound a replicated command. They must not depend on the
+// machine, so there is no time limit: every replica stops at the same step.
+var commandLimits = yar.Limits{Steps: 10000000, Cells: 1 << 20, Depth: 1000}
+
+// queryLimits bound a lookup, which runs on one node only.
+var queryLimits = yar.Limits{Steps: 10000000, Cells: 1 << 20, Depth: 1000, Time: 5 * time.Second}
+
 // StateMachine is the IStateMachine implementation used
 type StateMachine struct {
 	ClusterID uint64
 	NodeID    uint64
 	VM        *yar.VM
+
+	checks     map[string]uint64
+	checkOrder []string
+	// applied counts the commands committed to the VM, see appliedQuery.
+	applied uint64
+
+	mu   sync.Mutex
+	view *yar.VM
+
+	// exposed are the functions scripts serve over HTTP, see expose.go, kept
+	// as roots of the collections of Update. HTTP handlers run outside the
+	// lock dragonboat holds around Update, applyMu stands in for it.
+	exposed []yar.Value
+	applyMu sync.RWMutex
+
+	// Profiler profiles commands when it is set, see profileQuery.
+	Profiler  *yar.Profiler
+	profileMu sync.Mutex
 }
 
 func NewStateMachine(clusterID uint64, nodeID uint64) sm.IStateMachine {
 	sm := &StateMachine{
 		ClusterID: clusterID,
 		NodeID:    nodeID,
-		VM:        yar.NewVM(65536, 100),
+		VM:        yar.NewVM(memSize, stackSize),
+		checks:    make(map[string]uint64),
 	}
 	yar.BootVM(sm.VM)
-	sm.VM.Library.Add(clusterPackage())
-	clusterModule(sm.VM)
+	cluster.Load(sm.VM)
+	sm.VM.Limits = commandLimits
 	return sm
 }
 
-// Lookup performs local lookup on the StateMachine instance. In this example,
-// we always return the Count value as a little endian binary encoded byte
-// slice.
+// Lookup evaluates a yar expression, given as a string or a byte slice,
+// against a read-only view of the VM, so any cluster state can be inspected
+// with SyncRead without proposing a write. The result is returned molded, as
+// source text load reads back.
+// A heapStatsQuery returns yar.HeapStats of the VM instead, a profileQuery the
+// profile of commands in the pprof format and an appliedQuery the number of
+// commands committed.
 func (s *StateMachine) Lookup(query interface{}) (interface{}, error) {
-	result := make([]byte, 8)
-	binary.LittleEndian.PutUint64(result, 0)
-	return result, nil
+	var expr string
+	switch q := query.(type) {
+	case string:
+		expr = q
+	case []byte:
+		expr = string(q)
+	case heapStatsQuery:
+		return s.VM.HeapStats(), nil
+	case profileQuery:
+		return s.profile()
+	case appliedQuery:
+		return atomic.LoadUint64(&s.applied), nil
+	default:
+		return nil, fmt.Errorf("unsupported query type %T", query)
+	}
+	view := s.readView().Fork(make([]yar.Value, stackSize), 0)
+	view.Limits = queryLimits
+	return evalQuery(view, expr)
+}
+
+// readView returns a read-only view of the VM shared by concurrent lookups,
+// it is taken again after the VM changes.
+func (s *StateMachine) readView() *yar.VM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.view == nil {
+		s.view = s.VM.Clone()
+	}
+	return s.view
 }
 
-// Update updates the object using the specified committed raft entry.
+func (s *StateMachine) dropView() {
+	s.mu.Lock()
+	s.view = nil
+	s.mu.Unlock()
+}
+
+type heapStatsQuery struct{}
+
+type profileQuery struct{}
+
+type appliedQuery struct{}
+
+func (s *StateMachine) profile() ([]byte, error) {
+	s.profileMu.Lock()
+	defer s.profileMu.Unlock()
+	if s.Profiler == nil {
+		return nil, fmt.Errorf("profiling is off")
+	}
+	var buf bytes.Buffer
+	if _, err := s.Profiler.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newProfiledStateMachine makes a state machine profiling commands.
+func newProfiledStateMachine(clusterID uint64, nodeID uint64) sm.IStateMachine {
+	s := NewStateMachine(clusterID, nodeID).(*StateMachine)
+	s.Profiler = yar.NewProfiler()
+	return s
+}
+
+func evalQuery(vm *yar.VM, expr string) ([]byte, error) {
+	value, err := vm.Eval(expr)
+	if err != nil {
+		return nil, fmt.Errorf("query %q failed: %v", expr, err)
+	}
+	return []byte(vm.Mold(value)), nil
+}
+
+// Update updates the object using the specified committed raft entry. A
+// command that raises an error doesn't stop the node, the failure is reported
+// with a zero Value and the error text in Data. The command runs in a
+// transaction, a failed one is rolled back so it leaves no trace in the VM.
 func (s *StateMachine) Update(data []byte) (sm.Result, error) {
+	if isHashCommand(data) {
+		return s.applyHashCommand(data), nil
+	}
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	s.dropView()
 	fmt.Printf("NodeID: %04x\n", s.NodeID)
 	fmt.Printf("> %s\n", string(data))
-	code := s.VM.Parse(string(data))
-	result := s.VM.BindAndExec(code)
-	fmt.Printf("%s\n", s.VM.ToString(result))
+	if s.Profiler != nil {
+		s.profileMu.Lock()
+		s.VM.Hook = s.Profiler
+		defer func() {
+			s.VM.Hook = nil
+			s.Profiler.Stop()
+			s.profileMu.Unlock()
+		}()
+	}
+	exposed := len(s.exposed)
+	s.VM.Begin()
+	result, err := s.VM.Eval(string(data))
+	if err != nil {
+		s.VM.Rollback()
+		s.unexpose(exposed)
+		fmt.Printf("%v\n", err)
+		return sm.Result{Data: []byte(err.Error())}, nil
+	}
+	fmt.Printf("%s\n", s.VM.Mold(result))
+	s.VM.Commit()
+	atomic.AddUint64(&s.applied, 1)
+	s.VM.MaybeGC(s.roots()...)
 	return sm.Result{Value: uint64(len(data))}, nil
 }
 
+// exposeOn serves the functions scripts expose on the mux, they run against
+// the read-only view of the VM lookups use.
+func (s *StateMachine) exposeOn(mux *http.ServeMux) {
+	s.VM.Services["http"] = &HttpService{mux: mux, owner: s}
+}
+
+// expose keeps a function exposed by the command Update runs.
+func (s *StateMachine) expose(fn yar.Value) int {
+	s.exposed = append(s.exposed, fn)
+	return len(s.exposed) - 1
+}
+
+func (s *StateMachine) exposedView(i int) (*yar.VM, yar.Value, bool) {
+	s.applyMu.RLock()
+	defer s.applyMu.RUnlock()
+	if s.exposed[i] == 0 {
+		return nil, 0, false
+	}
+	return s.readView(), s.exposed[i], true
+}
+
+// unexpose forgets the functions exposed from the index on, which are not in
+// the VM any more. Their handlers stay registered and answer not found.
+func (s *StateMachine) unexpose(from int) {
+	for i := from; i < len(s.exposed); i++ {
+		s.exposed[i] = 0
+	}
+}
+
+func (s *StateMachine) roots() []*yar.Value {
+	var roots []*yar.Value
+	for i := range s.exposed {
+		if s.exposed[i] != 0 {
+			roots = append(roots, &s.exposed[i])
+		}
+	}
+	return roots
+}
+
 // SaveSnapshot saves the current IStateMachine state into a snapshot using the
-// specified io.Writer object.
+// specified io.Writer object. The whole VM image (memory, dictionary, symbols,
+// strings and native names) is written, there are no external files.
 func (s *StateMachine) SaveSnapshot(w io.Writer,
 	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
-	// as shown above, the only state that can be saved is the Count variable
-	// there is no external file in this IStateMachine example, we thus leave
-	// the fc untouched
-	data := make([]byte, 8)
-	binary.LittleEndian.PutUint64(data, 0)
-	_, err := w.Write(data)
+	_, err := w.Write(s.VM.Save())
 	return err
 }
 
-// RecoverFromSnapshot recovers the state using the provided snapshot.
+// RecoverFromSnapshot recovers the state using the provided snapshot. Natives
+// are resolved by name against the library of the current VM.
 func (s *StateMachine) RecoverFromSnapshot(r io.Reader,
 	files []sm.SnapshotFile,
 	done <-chan struct{}) error {
-	// restore the Count variable, that is the only state we maintain in this
-	// example, the input files is expected to be empty
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	binary.LittleEndian.Uint64(data)
+	vm, err := yar.LoadVM(data, stackSize, s.VM.Library)
+	if err != nil {
+		return err
+	}
+	vm.Services = s.VM.Services
+	vm.Limits = commandLimits
+	s.applyMu.Lock()
+	s.VM = vm
+	s.unexpose(0)
+	s.applyMu.Unlock()
+	s.dropView()
 	return nil
 }
 
@@ -95,9 +273,8 @@ func (s *StateMachine) RecoverFromSnapshot(r io.Reader,
 // method is not guaranteed to be called as node can crash at any time.
 func (s *StateMachine) Close() error { return nil }
 
-// GetHash returns a uint64 representing the current object state.
+// GetHash returns a uint64 representing the current object state. It is a
+// content hash of the VM heap, equal on replicas that applied the same log.
 func (s *StateMachine) GetHash() (uint64, error) {
-	// the only state we have is that Count variable. that uint64 value pretty much
-	// represents the state of this IStateMachine
-	return 0, nil
+	return s.VM.Hash(), nil
 }
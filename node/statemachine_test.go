@@ -0,0 +1,597 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anticrm/rack/yar"
+	"github.com/lni/dragonboat/v3"
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/plugin/pebble"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+func blockStrings(vm *yar.VM, value yar.Value) []string {
+	var result []string
+	block := value.Block()
+	for i := block.First(vm); i != 0; i = i.Next(vm) {
+		result = append(result, i.Value(vm).String().String(vm))
+	}
+	return result
+}
+
+func services(vm *yar.VM) []string {
+	return blockStrings(vm, vm.BindAndExec(vm.MustParse("cluster/services")))
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	for _, cmd := range []string{
+		`append cluster/services "redis"`,
+		`append cluster/services "postgres"`,
+		`greeting: "hello"`,
+	} {
+		if _, err := s.Update([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.SaveSnapshot(&buf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewStateMachine(clusterID, 2).(*StateMachine)
+	if err := r.RecoverFromSnapshot(&buf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := services(r.VM)
+	if fmt.Sprint(got) != "[redis postgres]" {
+		t.Errorf("services = %v, want [redis postgres]", got)
+	}
+	greeting := r.VM.BindAndExec(r.VM.MustParse("greeting"))
+	if greeting.String().String(r.VM) != "hello" {
+		t.Errorf("greeting = %s, want \"hello\"", r.VM.ToString(greeting))
+	}
+	if _, err := r.Update([]byte(`append cluster/services "nginx"`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := services(r.VM); len(got) != 3 {
+		t.Errorf("services after update = %v, want 3 entries", got)
+	}
+}
+
+func TestRunawayCommand(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	if _, err := s.Update([]byte(`append cluster/services "redis"`)); err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := s.GetHash()
+	result, err := s.Update([]byte(`append cluster/services "leak" forever []`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Value != 0 || !strings.Contains(string(result.Data), "step limit exceeded") {
+		t.Errorf("result = %d %q, want step limit error", result.Value, result.Data)
+	}
+	if after, _ := s.GetHash(); after != hash {
+		t.Error("runaway command left changes")
+	}
+	if _, err := s.Lookup(`forever []`); err == nil || !strings.Contains(err.Error(), "limit exceeded") {
+		t.Errorf("lookup error = %v, want limit error", err)
+	}
+	if _, err := s.Update([]byte(`append cluster/services "nginx"`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := services(s.VM); fmt.Sprint(got) != "[redis nginx]" {
+		t.Errorf("services = %v, want [redis nginx]", got)
+	}
+}
+
+type recoveringStateMachine struct {
+	*StateMachine
+	recovered *int32
+}
+
+func (s *recoveringStateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	atomic.AddInt32(s.recovered, 1)
+	return s.StateMachine.RecoverFromSnapshot(r, files, done)
+}
+
+type testCluster struct {
+	t         *testing.T
+	dir       string
+	members   map[uint64]string
+	hosts     map[uint64]*dragonboat.NodeHost
+	mu        sync.Mutex
+	machines  map[uint64]*StateMachine
+	recovered int32
+}
+
+func newTestCluster(t *testing.T, size int, basePort int) *testCluster {
+	c := &testCluster{
+		t:        t,
+		dir:      t.TempDir(),
+		members:  make(map[uint64]string),
+		hosts:    make(map[uint64]*dragonboat.NodeHost),
+		machines: make(map[uint64]*StateMachine),
+	}
+	for i := 1; i <= size; i++ {
+		c.members[uint64(i)] = fmt.Sprintf("localhost:%d", basePort+i)
+	}
+	return c
+}
+
+func (c *testCluster) start(nodeID uint64, join bool) {
+	nhc := config.NodeHostConfig{
+		WALDir:         filepath.Join(c.dir, fmt.Sprintf("node%d", nodeID)),
+		NodeHostDir:    filepath.Join(c.dir, fmt.Sprintf("node%d", nodeID)),
+		RTTMillisecond: 10,
+		RaftAddress:    c.members[nodeID],
+		LogDBFactory:   pebble.NewLogDB,
+	}
+	rc := config.Config{
+		NodeID:             nodeID,
+		ClusterID:          clusterID,
+		ElectionRTT:        10,
+		HeartbeatRTT:       1,
+		CheckQuorum:        true,
+		SnapshotEntries:    5,
+		CompactionOverhead: 2,
+	}
+	nh, err := dragonboat.NewNodeHost(nhc)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	members := c.members
+	if join {
+		members = nil
+	}
+	factory := func(clusterID uint64, nodeID uint64) sm.IStateMachine {
+		s := NewStateMachine(clusterID, nodeID).(*StateMachine)
+		c.mu.Lock()
+		c.machines[nodeID] = s
+		c.mu.Unlock()
+		return &recoveringStateMachine{StateMachine: s, recovered: &c.recovered}
+	}
+	if err := nh.StartCluster(members, false, factory, rc); err != nil {
+		c.t.Fatal(err)
+	}
+	c.hosts[nodeID] = nh
+}
+
+func (c *testCluster) stop(nodeID uint64) {
+	c.hosts[nodeID].Stop()
+	delete(c.hosts, nodeID)
+}
+
+func (c *testCluster) stopAll() {
+	for id := range c.hosts {
+		c.stop(id)
+	}
+}
+
+func (c *testCluster) machine(nodeID uint64) *StateMachine {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.machines[nodeID]
+}
+
+func (c *testCluster) propose(nodeID uint64, cmd string) {
+	nh := c.hosts[nodeID]
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		_, err := nh.SyncPropose(ctx, nh.GetNoOPSession(clusterID), []byte(cmd))
+		cancel()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("propose %q: %v", cmd, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// sync waits until the node has applied everything committed so far.
+func (c *testCluster) sync(nodeID uint64) {
+	nh := c.hosts[nodeID]
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		_, err := nh.SyncRead(ctx, clusterID, []byte{})
+		cancel()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("sync node %d: %v", nodeID, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestClusterRestartFromSnapshot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts an in-process raft cluster")
+	}
+	logger.GetLogger("raft").SetLevel(logger.ERROR)
+	logger.GetLogger("rsm").SetLevel(logger.ERROR)
+	logger.GetLogger("transport").SetLevel(logger.ERROR)
+	logger.GetLogger("logdb").SetLevel(logger.ERROR)
+	logger.GetLogger("dragonboat").SetLevel(logger.ERROR)
+
+	c := newTestCluster(t, 3, 26100)
+	defer c.stopAll()
+	for id := range c.members {
+		c.start(id, false)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.propose(1, fmt.Sprintf(`append cluster/services "before-%d"`, i))
+	}
+	c.sync(3)
+
+	c.stop(3)
+	// enough entries for the remaining replicas to snapshot and compact the
+	// log past everything node 3 has seen
+	for i := 0; i < 20; i++ {
+		c.propose(1, fmt.Sprintf(`append cluster/services "after-%d"`, i))
+	}
+
+	c.start(3, true)
+	c.sync(3)
+
+	if atomic.LoadInt32(&c.recovered) == 0 {
+		t.Error("node 3 did not recover from a snapshot")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	result, err := c.hosts[3].SyncRead(ctx, clusterID, "cluster/services")
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(result.([]byte)), `"after-19"`) {
+		t.Errorf("SyncRead on restarted node = %s", result)
+	}
+
+	h1, _ := c.machine(1).GetHash()
+	h3, _ := c.machine(3).GetHash()
+	if h1 != h3 {
+		t.Errorf("restarted node hash %016x, want %016x", h3, h1)
+	}
+	want := services(c.machine(1).VM)
+	got := services(c.machine(3).VM)
+	if len(want) != 23 {
+		t.Errorf("leader services = %d entries, want 23", len(want))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("restarted node services = %v, want %v", got, want)
+	}
+}
+
+func TestStateHash(t *testing.T) {
+	a := NewStateMachine(clusterID, 1).(*StateMachine)
+	b := NewStateMachine(clusterID, 2).(*StateMachine)
+	// allocations that are not reachable must not affect the hash
+	b.VM.MustParse(`append cluster/services "scratch"`)
+
+	for _, cmd := range []string{`append cluster/services "redis"`, `port: 6379`} {
+		a.Update([]byte(cmd))
+		b.Update([]byte(cmd))
+	}
+	ha, _ := a.GetHash()
+	hb, _ := b.GetHash()
+	if ha != hb {
+		t.Fatalf("replica hashes differ: %016x != %016x", ha, hb)
+	}
+
+	b.Update([]byte(`port: 6380`))
+	hb, _ = b.GetHash()
+	if ha == hb {
+		t.Fatal("hash did not change after update")
+	}
+}
+
+func TestHashVerification(t *testing.T) {
+	a := NewStateMachine(clusterID, 1).(*StateMachine)
+	b := NewStateMachine(clusterID, 2).(*StateMachine)
+	b.Update([]byte(`diverged: 1`))
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	ra, _ := a.Update(hashCheckCommand("1-1"))
+	b.Update(hashCheckCommand("1-1"))
+
+	verify := hashVerifyCommand("1-1", ra.Value, 1)
+	if r, _ := a.Update(verify); r.Value != 0 {
+		t.Error("proposer reported divergence from itself")
+	}
+	if r, _ := b.Update(verify); r.Value != 1 {
+		t.Error("divergent replica not detected")
+	}
+	if !strings.Contains(logged.String(), "state diverged from node 1") {
+		t.Errorf("divergence not logged: %q", logged.String())
+	}
+}
+
+func TestNulCommand(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	cmd := []byte("\x00nul: 5")
+	if isHashCommand(cmd) || !isHashCommand(hashCheckCommand("1-1")) {
+		t.Fatal("commands starting with NUL are taken for control entries")
+	}
+	if r, _ := s.Update(cmd); r.Value != uint64(len(cmd)) || len(r.Data) != 0 {
+		t.Fatalf("command not evaluated: %+v", r)
+	}
+	result, err := s.Lookup([]byte("\x00nul"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.([]byte)) != "5" {
+		t.Errorf("got %s", result)
+	}
+}
+
+func TestConsistencyCheckDue(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	applied := func() uint64 {
+		n, err := s.Lookup(appliedQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n.(uint64)
+	}
+	c := &consistencyChecker{nodeID: 1}
+	if c.due(false, applied()) {
+		t.Error("check due on a follower")
+	}
+	if !c.due(true, applied()) {
+		t.Error("first check not due on the leader")
+	}
+	c.applied, c.checked = applied(), true
+
+	s.Update(hashCheckCommand("1-1"))
+	s.Update([]byte(`add 1 "x"`))
+	if c.due(true, applied()) {
+		t.Error("check due without new commands")
+	}
+	s.Update([]byte(`x: 1`))
+	if !c.due(true, applied()) {
+		t.Error("check not due after a command")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	s.Update([]byte(`append cluster/services "redis"`))
+	s.Update([]byte(`limits: make-object [cpus: 4]`))
+	before, _ := s.GetHash()
+
+	for query, want := range map[string]string{
+		"cluster/services":    `["redis"]`,
+		"[nodes redis 1]":     `[nodes redis 1]`,
+		"first [cluster]":     `cluster`,
+		"limits":              `make-object [cpus: 4]`,
+		`"say ^"hi^""`:        `"say ^"hi^""`,
+		"limits/cpus":         "4",
+		"get in limits 'cpus": "4",
+		"add limits/cpus 1":   "5",
+	} {
+		result, err := s.Lookup([]byte(query))
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		if string(result.([]byte)) != want {
+			t.Errorf("%s = %s, want %s", query, result, want)
+		}
+	}
+
+	for _, query := range []string{`x: 1`, `append cluster/services "nginx"`, `limits/cpus: 8`} {
+		if _, err := s.Lookup(query); err == nil {
+			t.Errorf("%s: expected read-only lookup to fail", query)
+		}
+	}
+	if _, err := s.Lookup(42); err == nil {
+		t.Error("expected unsupported query type to fail")
+	}
+
+	after, _ := s.GetHash()
+	if before != after {
+		t.Error("lookups changed the state")
+	}
+}
+
+func TestConcurrentLookup(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	s.Update([]byte(`counter: 0`))
+
+	var mu sync.RWMutex // stands in for the lock dragonboat holds around Update
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// only taking the view needs the lock, evaluation runs
+				// concurrently with Update
+				mu.RLock()
+				view := s.readView()
+				mu.RUnlock()
+				_, err := evalQuery(view.Fork(make([]yar.Value, stackSize), 0), "foreach s cluster/services [s] counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		mu.Lock()
+		s.Update([]byte(`counter: add counter 1 append cluster/services "svc"`))
+		mu.Unlock()
+	}
+	close(stop)
+	wg.Wait()
+
+	result, err := s.Lookup("counter")
+	if err != nil || string(result.([]byte)) != "50" {
+		t.Errorf("counter = %s, %v, want 50", result, err)
+	}
+}
+
+func TestExposedView(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	pkg := yar.NewPackage("http")
+	pkg.AddFunc("expose", expose)
+	s.VM.Library.Add(pkg)
+	mux := http.NewServeMux()
+	s.exposeOn(mux)
+	s.Update([]byte(pkg.Script()))
+	s.Update([]byte(`base: 1 calc: fn [x y] [add base add x y] expose :calc [x y]`))
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/test?x=ab&y=c", nil))
+		return w.Body.String()
+	}
+	want := func(n int) string { return fmt.Sprintf("Hello, %016x", yar.MakeInt(n).Value()) }
+	if got := get(); got != want(4) {
+		t.Fatalf("got %q, want %q", got, want(4))
+	}
+	// the handler sees later commands and follows the function when the VM
+	// is collected
+	s.Update([]byte(`base: 10 scratch: [1 2 3]`))
+	s.applyMu.Lock()
+	s.VM.GC(s.roots()...)
+	s.dropView()
+	s.applyMu.Unlock()
+	if got := get(); got != want(13) {
+		t.Errorf("got %q, want %q", got, want(13))
+	}
+}
+
+func TestUpdateCollectsGarbage(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	s.Update([]byte(`counter: 0`))
+	for i := 0; i < 2000; i++ {
+		s.Update([]byte(`counter: add counter 1 scratch: [1 2 3 4 5 6 7 8 9 10]`))
+	}
+	stats, err := s.Lookup(heapStatsQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	heap := stats.(yar.HeapStats)
+	if heap.Collections == 0 || heap.Cells > heap.Threshold {
+		t.Errorf("unexpected heap stats: %+v", heap)
+	}
+	if result, _ := s.Lookup("counter"); string(result.([]byte)) != "2000" {
+		t.Errorf("counter = %s, want 2000", result)
+	}
+}
+
+func TestUpdateFailure(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	s.Update([]byte(`counter: 1`))
+	for _, cmd := range []string{`unknown-word 1`, `counter: add counter "x"`, `cluster/missing`, `]]`} {
+		result, err := s.Update([]byte(cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Value != 0 || len(result.Data) == 0 {
+			t.Errorf("%s: expected failure result, got %+v", cmd, result)
+		}
+	}
+	if result, _ := s.Update([]byte(`counter: add counter 1`)); result.Value == 0 {
+		t.Errorf("update after failures failed: %s", result.Data)
+	}
+	if result, _ := s.Lookup("counter"); string(result.([]byte)) != "2" {
+		t.Errorf("counter = %s, want 2", result)
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	s := NewStateMachine(clusterID, 1).(*StateMachine)
+	s.Update([]byte(`counter: 1 append cluster/services "redis"`))
+	hash, _ := s.GetHash()
+	result, _ := s.Update([]byte(`counter: 5 append cluster/services "half" fresh: 1 add 1 "x"`))
+	if result.Value != 0 {
+		t.Fatalf("expected failure, got %+v", result)
+	}
+	if after, _ := s.GetHash(); after != hash {
+		t.Error("failed command left changes")
+	}
+	if result, _ := s.Lookup("reduce [counter cluster/services]"); string(result.([]byte)) != `[1 ["redis"]]` {
+		t.Errorf("state = %s after a failed command", result)
+	}
+	if _, err := s.Lookup("fresh"); err == nil {
+		t.Error("word set by a failed command has a value")
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	s := newProfiledStateMachine(clusterID, 1).(*StateMachine)
+	s.Update([]byte(`register: fn [name] [append cluster/services name]`))
+	for i := 0; i < 3; i++ {
+		s.Update([]byte(`register "svc"`))
+	}
+	found := false
+	for _, e := range s.Profiler.Top() {
+		if e.Name == "register" {
+			found = e.CumInstructions > 0
+		}
+	}
+	if !found {
+		t.Errorf("register not profiled: %+v", s.Profiler.Top())
+	}
+	profile, err := s.Lookup(profileQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := profile.([]byte); len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Errorf("profile is not gzipped")
+	}
+	if s.VM.Hook != nil {
+		t.Error("profiler left set")
+	}
+}
@@ -25,5 +25,3 @@ func sendCommand(cmd chan string, args []string) {
 	}
 	cmd <- builder.String()
 }
-
-func quote(s string) string { return "\"" + s + "\"" }
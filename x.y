@@ -8,7 +8,9 @@ deploy-image: fn [deploymentUrl image port numInstances] [
 ]
 
 deploy: fn [deploymentUrl buildId] [
-  cluster/each-node [kind: worker] [deploy-image deploymentUrl join "anticrm/scrn:" buildId 3000 os/cpus]
+  cluster/each-node [kind: worker] [
+    catch err [deploy-image deploymentUrl join "anticrm/scrn:" buildId 3000 os/cpus] [print err/message]
+  ]
 ]
 
 cluster/deploy [deploy join os/args/1 ".screenversaion.com" env/BUILD_ID]
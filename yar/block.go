@@ -21,8 +21,15 @@ import (
 
 // BLOCK
 //-------------------------
+//  INDEX | FIRSTLAST | KIND |
+//-------------------------
+//
+// FIRSTLAST
+//-------------------------
 //   FIRST  | LAST | KIND |
 //-------------------------
+//
+// A block value is a position in the series, First is the entry at the index.
 
 type Block Value
 type firstLast obj
@@ -30,13 +37,28 @@ type pFirstLast ptr
 type blockEntry item
 type pBlockEntry ptr
 
-func makeBlock(firstLast pFirstLast) Block { return Block(makeValue(int(firstLast), BlockType)) }
-func (b Block) firstLast() pFirstLast      { return pFirstLast(b.Value().Val()) }
+func makeBlock(firstLast pFirstLast) Block { return Block(makeObj(0, ptr(firstLast), BlockType)) }
+func (b Block) firstLast() pFirstLast      { return pFirstLast(obj(b).ptr()) }
+func (b Block) Index() int                 { return obj(b).val() }
 func (b Block) Value() Value               { return Value(b) }
-func (b Block) First(vm *VM) pBlockEntry   { return firstLast(vm.read(ptr(b.firstLast()))).first() }
 func (v Value) Block() Block               { return Block(v) }
 func (b Block) Add(vm *VM, value Value)    { b.firstLast().add(vm, value) }
 
+// at returns the block at another index of the same series.
+func (b Block) at(index int) Block { return Block(makeObj(index, ptr(b.firstLast()), BlockType)) }
+
+// head returns the first entry of the series.
+func (b Block) head(vm *VM) pBlockEntry { return firstLast(vm.read(ptr(b.firstLast()))).first() }
+
+// First returns the entry at the index of the block.
+func (b Block) First(vm *VM) pBlockEntry {
+	entry := b.head(vm)
+	for i := b.Index(); i > 0 && entry != 0; i-- {
+		entry = entry.Next(vm)
+	}
+	return entry
+}
+
 func (b firstLast) first() pBlockEntry { return pBlockEntry(obj(b).val()) }
 func (b firstLast) last() pBlockEntry  { return pBlockEntry(obj(b).ptr()) }
 
@@ -76,6 +98,7 @@ func (b pFirstLast) addEntry(vm *VM, newLast pBlockEntry) {
 	fl := firstLast(vm.read(ptr(b)))
 	last := fl.last()
 	if last != 0 {
+		vm.modified(last)
 		pItem(last).setPtr(vm, ptr(newLast))
 		vm.write(ptr(b), cell(makeFirstLast(fl.first(), newLast)))
 	} else {
@@ -0,0 +1,556 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+// C O M P I L E
+//
+// With vm.Compile set, blocks run by natives and functions are compiled once
+// into Go closures, one per expression, kept by the VM. Arities are taken at
+// compile time from the value a global word is bound to: functions by their
+// spec, natives from nativeArity or from the Go function AddGoFunc made them
+// of. A call compiles to a closure evaluating the closures of its arguments:
+// arguments of a function are evaluated straight into its frame, natives in
+// nativeOps and nativeForms are applied to their arguments, other natives take
+// their arguments through vm.Next as usual and are fed the compiled ones. Infix
+// operators compile to their operation. Other words compile as variables, the
+// value of a global is kept until a cell is written.
+//
+// Compiled code gives the same results as the tree walker, it counts the same
+// steps and errors point at the same values. A closure runs when vm.pc is at
+// the value it was compiled for, else evaluation goes on by walking. A word
+// found bound to another function than the one compiled is called like the
+// walker does. Writing an entry of compiled code drops the compiled code,
+// closures still running go on by walking.
+
+// unknownEntry ends an expression which consumes values unknown at compile
+// time, like a path calling a function.
+const unknownEntry = ^pBlockEntry(0)
+
+// code evaluates a compiled expression like Next.
+type code func(vm *VM) Value
+
+// expr is an expression compiled for the entry of its first value.
+type expr struct {
+	entry pBlockEntry
+	eval  code
+}
+
+// infixOp is an infix operator compiled with its right operand.
+type infixOp struct {
+	entry pBlockEntry // entry of the operator
+	next  pBlockEntry // entry of the operand
+	op    binaryOp
+	right code
+}
+
+// nativeArity lists natives evaluating all their arguments in order with the
+// number of arguments they take when called without refinements.
+var nativeArity = map[string]int{
+	"core/either": 3, "core/fn": 2, "core/make-object": 1, "core/print": 1, "core/append": 2,
+	"core/in": 2, "core/get": 1, "core/put": 3, "core/try": 1, "core/attempt": 1, "core/error?": 1,
+	"core/cause-error": 2, "core/mold": 1, "core/load": 1, "core/if": 2, "core/unless": 2,
+	"core/case": 1, "core/switch": 2, "core/while": 2, "core/until": 1, "core/loop": 2,
+	"core/forever": 1, "core/return": 1, "core/set": 2,
+	"core/module": 2, "core/import": 1,
+	"core/add": 2, "core/sub": 2, "core/mul": 2, "core/div": 2, "core/mod": 2,
+	"core/neg": 1, "core/abs": 1, "core/min": 2, "core/max": 2, "core/not": 1,
+	"core/eq": 2, "core/ne": 2, "core/lt": 2, "core/le": 2, "core/gt": 2, "core/ge": 2,
+	"core/and": 2, "core/or": 2, "core/xor": 2,
+	"core/length?": 1, "core/first": 1, "core/last": 1, "core/pick": 2, "core/at": 2,
+	"core/skip": 2, "core/head": 1, "core/tail": 1, "core/insert": 2, "core/remove": 1,
+	"core/clear": 1, "core/change": 2, "core/copy": 1, "core/find": 2, "core/select": 2,
+	"core/reverse": 1, "core/sort": 1, "core/collect": 1, "core/keep": 1, "core/reduce": 1,
+	"core/join": 2, "core/rejoin": 1, "core/form": 1, "core/split": 2, "core/trim": 1,
+	"core/uppercase": 1, "core/lowercase": 1, "core/replace": 3, "core/starts-with?": 2,
+	"core/to-integer": 1, "core/to-string": 1,
+}
+
+// nativeOps lists natives evaluating two arguments and applying an operation,
+// compiled calls apply it directly.
+var nativeOps = map[string]binaryOp{
+	"core/add": addOp, "core/sub": subOp, "core/mul": mulOp, "core/div": divOp, "core/mod": modOp,
+	"core/eq": eqOp, "core/ne": neOp, "core/lt": ltOp, "core/le": leOp, "core/gt": gtOp, "core/ge": geOp,
+	"core/and": andOp, "core/or": orOp, "core/xor": xorOp,
+}
+
+// maxFormArgs is the number of arguments a native form takes at most.
+const maxFormArgs = 3
+
+// nativeForm is a native applied to its arguments once they are checked to be
+// of the kinds it takes, like nextArg does.
+type nativeForm struct {
+	name  string
+	kinds []int
+	apply func(vm *VM, args [maxFormArgs]Value) Value
+}
+
+// nativeForms lists natives choosing a block to run, compiled calls evaluate
+// their arguments without feeding them.
+var nativeForms map[string]*nativeForm
+
+func init() {
+	nativeForms = map[string]*nativeForm{
+		"core/either": {"either", []int{BooleanType, BlockType, BlockType}, func(vm *VM, args [maxFormArgs]Value) Value {
+			if args[0].Bool().Val() {
+				return vm.call(args[1].Block())
+			}
+			return vm.call(args[2].Block())
+		}},
+		"core/if": {"if", []int{BooleanType, BlockType}, func(vm *VM, args [maxFormArgs]Value) Value {
+			if args[0].Bool().Val() {
+				return vm.call(args[1].Block())
+			}
+			return None
+		}},
+		"core/unless": {"unless", []int{BooleanType, BlockType}, func(vm *VM, args [maxFormArgs]Value) Value {
+			if !args[0].Bool().Val() {
+				return vm.call(args[1].Block())
+			}
+			return None
+		}},
+	}
+}
+
+// plain tells the kinds evaluating to themselves.
+var plain [LastType]bool
+
+func init() {
+	for kind := range plain {
+		switch kind {
+		case WordType, GetWordType, SetWordType, NativeType, ProcType, PathType, GetPathType, SetPathType:
+		default:
+			plain[kind] = true
+		}
+	}
+}
+
+// recentSize is the number of blocks whose code is looked up without hashing.
+const recentSize = 256
+
+type recent struct {
+	entry pBlockEntry
+	exprs []expr
+}
+
+// resetCode drops compiled code. Closures still running see the generation
+// change and go on by walking.
+func (vm *VM) resetCode() {
+	vm.gen++
+	vm.compiled = nil
+	vm.compiledEntries = nil
+	vm.recent = nil
+}
+
+// modified is called before an entry is rewritten or relinked.
+func (vm *VM) modified(entry pBlockEntry) {
+	if _, ok := vm.compiledEntries[entry]; ok {
+		vm.resetCode()
+	}
+}
+
+// compiledAt returns the expressions starting at the entry up to the end of
+// its block or to a value consuming what is unknown at compile time,
+// compiling them when needed.
+func (vm *VM) compiledAt(entry pBlockEntry) []expr {
+	if exprs, ok := vm.compiled[entry]; ok {
+		return exprs
+	}
+	if vm.compiled == nil {
+		vm.compiled = make(map[pBlockEntry][]expr)
+		vm.compiledEntries = make(map[pBlockEntry]struct{})
+	}
+	var exprs []expr
+	for entry != 0 && entry != unknownEntry {
+		if rest, ok := vm.compiled[entry]; ok {
+			exprs = append(exprs, rest...)
+			break
+		}
+		eval, end := vm.compileExpr(entry)
+		exprs = append(exprs, expr{entry: entry, eval: eval})
+		entry = end
+	}
+	for i := range exprs {
+		if _, ok := vm.compiled[exprs[i].entry]; ok {
+			break
+		}
+		vm.compiled[exprs[i].entry] = exprs[i:]
+	}
+	return exprs
+}
+
+// firstAt is compiledAt for the first entry of a block.
+func (vm *VM) firstAt(entry pBlockEntry) []expr {
+	if vm.recent == nil {
+		vm.recent = make([]recent, recentSize)
+	}
+	r := &vm.recent[uint(entry)%recentSize]
+	if r.entry != entry || r.exprs == nil {
+		r.entry, r.exprs = entry, vm.compiledAt(entry)
+	}
+	return r.exprs
+}
+
+// arity returns the function a word is bound to and the number of its
+// arguments, or 0 and -1 when unknown.
+func (vm *VM) arity(w Word) (Value, int) {
+	binding := Binding(vm.read(ptr(w.bindings())))
+	if binding == 0 || binding.Kind() != MapBinding {
+		return 0, 0
+	}
+	value := vm.getBound[MapBinding](binding)
+	switch value.Kind() {
+	case NativeType:
+		if n, ok := nativeArity[vm.procNames[value.Val()]]; ok {
+			return value, n
+		}
+		if n, ok := vm.Library.arity(vm.procNames[value.Val()]); ok {
+			return value, n
+		}
+		return 0, -1
+	case ProcType:
+		spec, err := vm.spec(Proc(value))
+		if err != 0 {
+			vm.raised = 0
+			return 0, -1
+		}
+		return value, len(spec.params)
+	}
+	return 0, 0
+}
+
+// compileExpr compiles the expression at the entry and returns the entry after
+// it.
+func (vm *VM) compileExpr(entry pBlockEntry) (code, pBlockEntry) {
+	primary, end := vm.compilePrimary(entry, true)
+	valueEnd := end
+	var ops []infixOp
+	for end != 0 && end != unknownEntry {
+		op := vm.infixAt(end)
+		if op == nil {
+			break
+		}
+		next := end.Next(vm)
+		if next == 0 {
+			// left to the walker to fail
+			end = unknownEntry
+			break
+		}
+		vm.compiledEntries[end] = struct{}{}
+		right, rightEnd := vm.compilePrimary(next, false)
+		ops = append(ops, infixOp{entry: end, next: next, op: op, right: right})
+		end = rightEnd
+	}
+	if len(ops) == 0 && end == valueEnd {
+		return primary, end
+	}
+	gen := vm.gen
+	return func(vm *VM) Value {
+		result := primary(vm)
+		for i := range ops {
+			op := &ops[i]
+			if vm.pc != op.entry || vm.raised != 0 || vm.gen != gen {
+				return vm.infixTail(result)
+			}
+			vm.pc = op.next
+			right := op.right(vm)
+			if vm.raised != 0 {
+				return vm.raised
+			}
+			vm.at = op.entry
+			result = op.op(vm, result, right)
+		}
+		return vm.ended(result, end, gen, true)
+	}, end
+}
+
+// walk evaluates the value at vm.pc by walking, like Next with infix set and
+// like nextNoInfix otherwise.
+func (vm *VM) walk(infix bool) Value {
+	if infix {
+		return vm.Next()
+	}
+	return vm.nextNoInfix()
+}
+
+// ended returns the result of compiled code ending at end. With infix set the
+// operators following the value are applied when evaluation took another
+// path, the compiled ones are left to compileExpr otherwise.
+func (vm *VM) ended(result Value, end pBlockEntry, gen int, infix bool) Value {
+	if !infix || vm.pc == end && vm.gen == gen {
+		return result
+	}
+	return vm.infixTail(result)
+}
+
+// compilePrimary compiles the value at the entry with its arguments, without
+// infix operators following it. infix is set for the first value of an
+// expression and not for the right operand of an operator.
+func (vm *VM) compilePrimary(entry pBlockEntry, infix bool) (code, pBlockEntry) {
+	vm.compiledEntries[entry] = struct{}{}
+	value := entry.Value(vm)
+	next := entry.Next(vm)
+	gen := vm.gen
+	switch kind := value.Kind(); {
+	case plain[kind]:
+		return func(vm *VM) Value {
+			if vm.pc != entry || vm.gen != gen {
+				return vm.walk(infix)
+			}
+			if err := vm.step(); err != 0 {
+				return err
+			}
+			vm.at, vm.pc = entry, next
+			return vm.ended(value, next, gen, infix)
+		}, next
+	case kind == WordType:
+		return vm.compileWord(entry, next, value, infix)
+	case kind == SetWordType && next != 0:
+		binding := ptr(value.Word().bindings())
+		expr, end := vm.compileExpr(next)
+		return func(vm *VM) Value {
+			if vm.pc != entry || vm.gen != gen {
+				return vm.walk(infix)
+			}
+			if err := vm.step(); err != 0 {
+				return err
+			}
+			vm.at, vm.pc = entry, next
+			b := Binding(vm.read(binding))
+			if b == 0 {
+				return vm.ended(setWordExec(vm, value), end, gen, infix)
+			}
+			result := expr(vm)
+			if vm.raised != 0 {
+				return vm.raised
+			}
+			vm.setBound[b.Kind()](b, result)
+			return vm.ended(result, end, gen, infix)
+		}, end
+	}
+	end := next
+	if kind := value.Kind(); kind != GetWordType && kind != GetPathType {
+		end = unknownEntry
+	}
+	exec := vm.execFunc[value.Kind()]
+	return func(vm *VM) Value {
+		if vm.pc != entry || vm.gen != gen {
+			return vm.walk(infix)
+		}
+		if err := vm.step(); err != 0 {
+			return err
+		}
+		vm.at, vm.pc = entry, next
+		return vm.ended(exec(vm, value), end, gen, infix)
+	}, end
+}
+
+// Calls of compiled words.
+const (
+	callNone   = iota // a variable, or a function taking no arguments
+	callFeed          // a native or function fed its compiled arguments
+	callBinary        // a native applying an operation to its two arguments
+	callForm          // a native in nativeForms
+	callProc          // a function evaluating its arguments into its frame
+)
+
+// compileWord compiles a word with the arguments of the function it is bound
+// to.
+func (vm *VM) compileWord(entry pBlockEntry, next pBlockEntry, value Value, infix bool) (code, pBlockEntry) {
+	binding := ptr(value.Word().bindings())
+	callee, n := vm.arity(value.Word())
+	end := next
+	if n < 0 {
+		end = unknownEntry
+	}
+	var args []code
+	for ; n > 0 && end != 0 && end != unknownEntry; n-- {
+		var arg code
+		arg, end = vm.compileExpr(end)
+		args = append(args, arg)
+	}
+	if n > 0 {
+		end = unknownEntry
+	}
+
+	call := callNone
+	var op binaryOp
+	var form *nativeForm
+	var spec *fnSpec
+	if len(args) != 0 {
+		call = callFeed
+		switch callee.Kind() {
+		case NativeType:
+			name := vm.procNames[callee.Val()]
+			if op = nativeOps[name]; op != nil && len(args) == 2 {
+				call = callBinary
+			}
+			if form = nativeForms[name]; form != nil && len(args) == len(form.kinds) {
+				call = callForm
+			}
+		case ProcType:
+			if n == 0 {
+				spec, _ = vm.spec(Proc(callee))
+				call = callProc
+			}
+		}
+	}
+
+	gen := vm.gen
+	if call == callNone {
+		return func(vm *VM) Value {
+			if vm.pc != entry || vm.gen != gen {
+				return vm.walk(infix)
+			}
+			if err := vm.step(); err != 0 {
+				return err
+			}
+			vm.at, vm.pc = entry, next
+			b := Binding(vm.read(binding))
+			if b == 0 {
+				return vm.ended(wordExec(vm, value), end, gen, infix)
+			}
+			var bound Value
+			if b.Kind() == StackBinding {
+				bound = vm.stack[int(vm.sp)+b.Val()]
+			} else {
+				bound = vm.bound(b)
+			}
+			if !plain[bound.Kind()] {
+				bound = vm.execFunc[bound.Kind()](vm, bound)
+			}
+			return vm.ended(bound, end, gen, infix)
+		}, end
+	}
+
+	// the value of a global word is kept until a cell is written
+	var global Value
+	writes := vm.writes - 1
+	return func(vm *VM) Value {
+		if vm.pc != entry || vm.gen != gen {
+			return vm.walk(infix)
+		}
+		if err := vm.step(); err != 0 {
+			return err
+		}
+		vm.at, vm.pc = entry, next
+		bound := global
+		if vm.writes != writes {
+			b := Binding(vm.read(binding))
+			if b == 0 {
+				return vm.ended(wordExec(vm, value), end, gen, infix)
+			}
+			bound = vm.bound(b)
+			if b.Kind() == MapBinding {
+				global, writes = bound, vm.writes
+			}
+		}
+		if plain[bound.Kind()] {
+			return vm.ended(bound, end, gen, infix)
+		}
+		var result Value
+		switch {
+		case bound != callee:
+			result = vm.execFunc[bound.Kind()](vm, bound)
+		case call == callBinary && vm.refs == 0:
+			x := args[0](vm)
+			if vm.raised != 0 {
+				return vm.raised
+			}
+			y := args[1](vm)
+			if vm.raised != 0 {
+				return vm.raised
+			}
+			result = op(vm, x, y)
+		case call == callForm && vm.refs == 0:
+			var values [maxFormArgs]Value
+			for i, kind := range form.kinds {
+				value := args[i](vm)
+				if vm.raised != 0 {
+					return vm.raised
+				}
+				if value.Kind() != kind {
+					return vm.typeError(form.name, typeName(kind), value)
+				}
+				values[i] = value
+			}
+			result = form.apply(vm, values)
+		case call == callProc:
+			result = vm.callCompiled(Proc(bound), spec, args)
+		default:
+			vm.feed = args
+			result = vm.execFunc[bound.Kind()](vm, bound)
+			vm.feed = nil
+		}
+		return vm.ended(result, end, gen, infix)
+	}, end
+}
+
+// callCompiled calls a function with the compiled expressions of its
+// arguments like callProc.
+func (vm *VM) callCompiled(p Proc, spec *fnSpec, args []code) Value {
+	at := vm.at
+	var buf [8]Value
+	slots := buf[:0]
+	if len(spec.slots) > len(buf) {
+		slots = make([]Value, 0, len(spec.slots))
+	}
+	slots = vm.initSlots(spec, slots)
+	for i, param := range spec.params {
+		value := args[i](vm)
+		if vm.raised != 0 {
+			return vm.raised
+		}
+		if err := vm.checkArg(at, 0, param, value); err != 0 {
+			return err
+		}
+		slots[i] = value
+	}
+	return vm.invoke(p, slots, at, 0)
+}
+
+// feedNext evaluates the next compiled argument of the native or function
+// being called.
+func (vm *VM) feedNext() Value {
+	arg, feed := vm.feed[0], vm.feed[1:]
+	vm.feed = nil
+	result := arg(vm)
+	vm.feed = feed
+	return result
+}
+
+// run evaluates code starting at the entry like Exec, through compiled code.
+func (vm *VM) run(first pBlockEntry) Value {
+	pc, feed := vm.pc, vm.feed
+	vm.pc, vm.feed = first, nil
+	var result Value
+	var exprs []expr
+	if first != 0 {
+		exprs = vm.firstAt(first)
+	}
+	gen := vm.gen
+	for vm.pc != 0 && vm.raised == 0 {
+		if len(exprs) == 0 || exprs[0].entry != vm.pc || vm.gen != gen {
+			exprs, gen = vm.compiledAt(vm.pc), vm.gen
+		}
+		result = exprs[0].eval(vm)
+		exprs = exprs[1:]
+	}
+	vm.pc, vm.feed = pc, feed
+	if vm.raised != 0 {
+		return vm.raised
+	}
+	return result
+}
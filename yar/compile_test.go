@@ -0,0 +1,167 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import "testing"
+
+// differential runs the source walked and compiled in fresh VMs and reports
+// any difference in results or in the state left.
+func differential(t *testing.T, source string) {
+	t.Helper()
+	var results [2]string
+	var hashes [2]uint64
+	for i, compile := range []bool{false, true} {
+		vm := NewVM(1000, 100)
+		BootVM(vm)
+		vm.Compile = compile
+		result := vm.BindAndExec(vm.MustParse(source))
+		results[i], hashes[i] = vm.ToString(result), vm.Hash()
+		if compile && len(vm.compiledEntries) == 0 {
+			t.Errorf("%s: nothing compiled", source)
+		}
+	}
+	if results[0] != results[1] {
+		t.Errorf("%s:\n walked   %s\n compiled %s", source, results[0], results[1])
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("%s: state differs", source)
+	}
+}
+
+func TestCompiled(t *testing.T) {
+	for _, source := range []string{
+		// functions and infix
+		`fib: fn [n] [either gt n 1 [add fib sub n 2 fib sub n 1] [n]] fib 15`,
+		`fib: fn [n] [either n > 1 [add fib n - 2 fib n - 1] [n]] fib 12`,
+		`x: 0 loop 10 [x: x + 1 * 2] x`,
+		`f: fn [a b /twice] [either twice [a + b * 2] [a + b]] reduce [f 1 2 f/twice 1 2]`,
+		`make-counter: fn [] [n: 0 fn [] [n: n + 1]] c: make-counter c c c`,
+		`o: make-object [a: 1 f: fn [x] [x + a]] o/a: 5 o/f 2`,
+		`sum: fn [b /local s] [s: 0 foreach x b [s: s + x] s] sum [1 2 3 4]`,
+		// control
+		`f: fn [n /local i] [i: 0 while [i < n] [i: i + 1 if i = 3 [continue] if i > 5 [break]] i] f 10`,
+		`sign: fn [n] [case [n > 0 [1] n < 0 [-1] true [0]]] reduce [sign 5 sign -5 sign 0]`,
+		`name: fn [x] [switch x [1 ["one"] 2 3 ["few"] ["many"]]] reduce [name 1 name 3 name 9]`,
+		`first-big: fn [b] [foreach x b [if x > 10 [return x]] none] first-big [1 20 30]`,
+		`i: 0 until [i: i + 1 i >= 4]`,
+		`try [cause-error 'user "boom"]`,
+		// series and strings
+		`map-each x [1 2 3] [x * 2]`,
+		`filter x [1 5 2 7] [x > 3]`,
+		`collect [keep 1 foreach x [2 3] [keep x]]`,
+		`rejoin ["a" 1 + 1 "b"]`,
+		`s: "host" append s ":" append s 80 uppercase s`,
+		`b: [3 1 2] sort b reverse b`,
+		`copy/part at [1 2 3] 2 1`,
+		`join "a" ["b" "c"]`,
+		// errors point at the same values
+		`add 1 "x"`,
+		`f: fn [a b] [a + b] f 1`,
+		`x: undefined-word`,
+		`1 +`,
+		`f: fn [n] [n / 0] loop 2 [f 1]`,
+		`g: fn [x [integer!]] [x] g "s"`,
+		`break`,
+		// words bound to other functions than at compile time
+		`f: fn [] [add 1 2] a: f add: fn [x] [x * 10] b: f reduce [a b]`,
+		`apply: fn [f x] [f x] reduce [apply :neg 5 apply :abs -5]`,
+		`twice: fn [g x] [g g x] twice :negate 3`,
+		`negate: fn [x] [neg x] twice: fn [g x] [g g x] twice :negate 3`,
+		`f: :add f 1 2`,
+		`x: 1 f: fn [] [x] a: f x: :add reduce [a]`,
+		`either: fn [c a b] [b] either true 1 2`,
+		`if: :add if 1 2`,
+		// globals changed while compiled code runs
+		`x: 1 s: 0 loop 3 [s: s + x x: x + 1] s`,
+		`f: fn [] [n] n: 1 a: f n: 2 reduce [a f]`,
+		// arguments unknown at compile time
+		`o: make-object [a: 1] f: fn [x y] [x + y] f o/a 2`,
+		`o: make-object [a: 1] add o/a 2 * 3`,
+		`either 1 [2] [3]`,
+		`if true "x"`,
+		`f: fn [x] [x] f/none 1`,
+		// code changed after it was compiled
+		`b: [1 + 1] r1: loop 1 b change skip b 2 10 r2: loop 1 b reduce [r1 r2]`,
+		`b: [1 + 1] r1: loop 1 b append b 2 r2: loop 1 b reduce [r1 r2]`,
+		`b: [x: 1] loop 3 [loop 1 b insert b [x: x + 1]] x`,
+		`b: [1 2 3] loop 1 [remove b] loop 1 b`,
+		`b: [change b 5 1 + 1] loop 1 b`,
+	} {
+		differential(t, source)
+	}
+}
+
+func TestCompiledCache(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Compile = true
+	vm.BindAndExec(vm.MustParse(`f: fn [n] [n + 1] loop 3 [f 1]`))
+	size := len(vm.compiledEntries)
+	vm.BindAndExec(vm.MustParse(`loop 2 [f 1]`))
+	if n := len(vm.compiledEntries) - size; n != 5 {
+		t.Errorf("compiled %d values for new code, want 5", n)
+	}
+
+	vm.GC()
+	if len(vm.compiledEntries) != 0 {
+		t.Errorf("compiled code survived collection")
+	}
+	if result := vm.BindAndExec(vm.MustParse(`f 2`)); result != MakeInt(3).Value() {
+		t.Errorf("f 2 = %s, want 3", vm.ToString(result))
+	}
+
+	size = len(vm.compiledEntries)
+	fork := vm.Clone().Fork(make([]Value, 100), 0)
+	if result := fork.BindAndExec(fork.MustParse(`f 3`)); result != MakeInt(4).Value() {
+		t.Errorf("fork: f 3 = %s, want 4", fork.ToString(result))
+	}
+	if len(fork.compiledEntries) == 0 || len(vm.compiledEntries) != size {
+		t.Errorf("fork compiled %d values, VM has %d, want own code", len(fork.compiledEntries), len(vm.compiledEntries)-size)
+	}
+}
+
+// benchmarkCompiled runs the code walked and compiled, it fails when the code
+// raises an error.
+func benchmarkCompiled(b *testing.B, setup string, code string) {
+	for _, compile := range []bool{false, true} {
+		name := "walk"
+		if compile {
+			name = "compiled"
+		}
+		b.Run(name, func(b *testing.B) {
+			vm := NewVM(1000, 100)
+			BootVM(vm)
+			vm.Compile = compile
+			vm.BindAndExec(vm.MustParse(setup))
+			block := vm.MustParse(code)
+			if result := vm.BindAndExec(block); result.Kind() == ErrorType {
+				b.Fatal(vm.scriptError(result))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				vm.BindAndExec(block)
+			}
+		})
+	}
+}
+
+func BenchmarkCompiledFib(b *testing.B) {
+	benchmarkCompiled(b, "fib: fn [n] [either gt n 1 [add fib sub n 2 fib sub n 1] [n]]", "fib 25")
+}
+
+func BenchmarkCompiledInfix(b *testing.B) {
+	benchmarkCompiled(b, "sum: fn [n /local s] [s: 0 while [n > 0] [s: s + n n: n - 1] s]", "sum 1000")
+}
@@ -0,0 +1,352 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+// C O N T R O L
+//
+// break, continue, return and exit unwind the way errors do: the native sets
+// vm.raised to a signal and every native and Exec on the way stops. Loops
+// consume break and continue, function calls consume return and exit. A signal
+// reaching the top of an evaluation is turned into an error.
+
+const (
+	signalBreak = iota + 1
+	signalContinue
+	signalReturn
+)
+
+// signals are raised none values, so they never look like an error.
+func makeSignal(signal int) Value { return makeValue(signal, NoneType) }
+
+func isSignal(value Value) bool { return value.Kind() == NoneType }
+
+func (vm *VM) signal(signal int, value Value) Value {
+	vm.returned = value
+	vm.raised = makeSignal(signal)
+	return vm.raised
+}
+
+// uncaughtSignal turns a signal raised outside of a loop or function into an
+// error.
+func (vm *VM) uncaughtSignal() Value {
+	signal := vm.raised.Val()
+	vm.raised, vm.returned = 0, 0
+	switch signal {
+	case signalBreak:
+		return vm.fail(ErrUser, "break outside of a loop", 0)
+	case signalContinue:
+		return vm.fail(ErrUser, "continue outside of a loop", 0)
+	}
+	return vm.fail(ErrUser, "return outside of a function", 0)
+}
+
+// loopBody evaluates the body of a loop, done tells the loop to stop. The
+// result of a body left by continue is none.
+func (vm *VM) loopBody(code Block) (result Value, done bool) {
+	result, done, _ = vm.loopStep(code)
+	return result, done
+}
+
+func (vm *VM) loopStep(code Block) (result Value, done bool, continued bool) {
+	result = vm.call(code)
+	switch vm.raised {
+	case 0:
+		return result, false, false
+	case makeSignal(signalBreak):
+		vm.raised, vm.returned = 0, 0
+		return None, true, false
+	case makeSignal(signalContinue):
+		vm.raised, vm.returned = 0, 0
+		return None, false, true
+	}
+	return vm.raised, true, false
+}
+
+// returnedFrom consumes return and exit signals of a function call.
+func (vm *VM) returnedFrom(result Value) Value {
+	if vm.raised == makeSignal(signalReturn) {
+		result = vm.returned
+		vm.raised, vm.returned = 0, 0
+	}
+	return result
+}
+
+// equal tells if two values are the same, strings and decimals compare by
+// content, words of any kind by symbol, blocks by their values from their
+// index as eq compares them, objects by identity.
+func (vm *VM) equal(x Value, y Value) bool {
+	if isWord(x.Kind()) && isWord(y.Kind()) {
+		return x.Word().Sym() == y.Word().Sym()
+	}
+	if x.Kind() != y.Kind() {
+		return false
+	}
+	switch x.Kind() {
+	case StringType, IssueType, FileType, UrlType:
+		return x.Text(vm) == y.Text(vm)
+	case HostPortType:
+		return x.Host(vm) == y.Host(vm) && x.Port() == y.Port()
+	case DecimalType:
+		return x.Decimal(vm) == y.Decimal(vm)
+	case RefinementType:
+		return x.Word().Sym() == y.Word().Sym()
+	case BlockType:
+		if x == y {
+			return true
+		}
+		i, j := x.Block().First(vm), y.Block().First(vm)
+		for ; i != 0 && j != 0; i, j = i.Next(vm), j.Next(vm) {
+			if !eqOp(vm, i.Value(vm), j.Value(vm)).Bool().Val() {
+				return false
+			}
+		}
+		return i == 0 && j == 0
+	}
+	return x == y
+}
+
+func _if(vm *VM) Value {
+	cond, err := vm.nextArg("if", BooleanType)
+	if err != 0 {
+		return err
+	}
+	body, err := vm.nextArg("if", BlockType)
+	if err != 0 {
+		return err
+	}
+	if cond.Bool().Val() {
+		return vm.call(body.Block())
+	}
+	return None
+}
+
+func unless(vm *VM) Value {
+	cond, err := vm.nextArg("unless", BooleanType)
+	if err != 0 {
+		return err
+	}
+	body, err := vm.nextArg("unless", BlockType)
+	if err != 0 {
+		return err
+	}
+	if !cond.Bool().Val() {
+		return vm.call(body.Block())
+	}
+	return None
+}
+
+// case [cond [body] ...] evaluates the body of the first true condition.
+func _case(vm *VM) Value {
+	cases, err := vm.nextArg("case", BlockType)
+	if err != 0 {
+		return err
+	}
+
+	pc := vm.pc
+	defer func() { vm.pc = pc }()
+	vm.pc = cases.Block().First(vm)
+	for vm.pc != 0 {
+		cond, err := vm.nextArg("case", BooleanType)
+		if err != 0 {
+			return err
+		}
+		if vm.pc == 0 {
+			return vm.fail(ErrType, "case expected block! after condition", 0)
+		}
+		body, err := vm.nextArg("case", BlockType)
+		if err != 0 {
+			return err
+		}
+		if cond.Bool().Val() {
+			return vm.call(body.Block())
+		}
+	}
+	return None
+}
+
+// switch value [value [body] ... [default]] evaluates the body following the
+// value equal to the first argument, case values are not evaluated and several
+// values may share a body. A block at the end without a value is the default.
+func _switch(vm *VM) Value {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	cases, err := vm.nextArg("switch", BlockType)
+	if err != 0 {
+		return err
+	}
+
+	matched, afterBody := false, true
+	for i := cases.Block().First(vm); i != 0; i = i.Next(vm) {
+		v := i.Value(vm)
+		if v.Kind() != BlockType {
+			matched = matched || vm.equal(value, v)
+			afterBody = false
+			continue
+		}
+		if matched || afterBody && i.Next(vm) == 0 {
+			return vm.call(v.Block())
+		}
+		afterBody = true
+	}
+	return None
+}
+
+func while(vm *VM) Value {
+	c, err := vm.nextArg("while", BlockType)
+	if err != 0 {
+		return err
+	}
+	b, err := vm.nextArg("while", BlockType)
+	if err != 0 {
+		return err
+	}
+
+	result := None
+	for {
+		cond := vm.call(c.Block())
+		if vm.raised != 0 {
+			return vm.raised
+		}
+		if cond.Kind() != BooleanType {
+			return vm.typeError("while", "logic!", cond)
+		}
+		if !cond.Bool().Val() {
+			return result
+		}
+		var done bool
+		if result, done = vm.loopBody(b.Block()); done {
+			return result
+		}
+	}
+}
+
+func until(vm *VM) Value {
+	b, err := vm.nextArg("until", BlockType)
+	if err != 0 {
+		return err
+	}
+
+	for {
+		result, done, continued := vm.loopStep(b.Block())
+		if done {
+			return result
+		}
+		if continued {
+			continue
+		}
+		if result.Kind() != BooleanType {
+			return vm.typeError("until", "logic!", result)
+		}
+		if result.Bool().Val() {
+			return result
+		}
+	}
+}
+
+func loop(vm *VM) Value {
+	n, err := vm.nextArg("loop", IntegerType)
+	if err != 0 {
+		return err
+	}
+	b, err := vm.nextArg("loop", BlockType)
+	if err != 0 {
+		return err
+	}
+
+	result := None
+	for i := 0; i < n.Val(); i++ {
+		var done bool
+		if result, done = vm.loopBody(b.Block()); done {
+			break
+		}
+	}
+	return result
+}
+
+func forever(vm *VM) Value {
+	b, err := vm.nextArg("forever", BlockType)
+	if err != 0 {
+		return err
+	}
+
+	for {
+		if result, done := vm.loopBody(b.Block()); done {
+			return result
+		}
+	}
+}
+
+func _break(vm *VM) Value    { return vm.signal(signalBreak, 0) }
+func _continue(vm *VM) Value { return vm.signal(signalContinue, 0) }
+func exit(vm *VM) Value      { return vm.signal(signalReturn, 0) }
+
+func _return(vm *VM) Value {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	return vm.signal(signalReturn, value)
+}
+
+// unset? value tells if the value is unset, a word with no value is unset
+// rather than an error.
+func isUnset(vm *VM) Value {
+	if len(vm.feed) == 0 && vm.pc != 0 {
+		entry := blockEntry(vm.read(ptr(vm.pc)))
+		if w := Value(vm.read(entry.pval())); w.Kind() == WordType && !vm.hasValue(w.Word()) {
+			if err := vm.step(); err != 0 {
+				return err
+			}
+			vm.at, vm.pc = vm.pc, entry.next()
+			return MakeBool(true).Value()
+		}
+	}
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	return MakeBool(value == 0).Value()
+}
+
+// set 'word value sets the value of a word, an unbound word is bound to a
+// new global.
+func set(vm *VM) Value {
+	w, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	if !isWord(w.Kind()) {
+		return vm.typeError("set", "word!", w)
+	}
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	cell := w.Word().bindings()
+	binding := Binding(vm.read(ptr(cell)))
+	if binding == 0 {
+		sv := vm.Dictionary.Find(vm, w.Word().Sym())
+		if sv == 0 {
+			sv = vm.Dictionary.Put(vm, w.Word().Sym(), 0)
+		}
+		binding = makeMapBinding(ptr(sv))
+		vm.writeBinding(ptr(cell), binding)
+	}
+	vm.setBound[binding.Kind()](binding, value)
+	return value
+}
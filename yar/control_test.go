@@ -0,0 +1,138 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestControl(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	_, err := vm.Eval(`
+		sign: fn [n] [case [gt n 0 [1] gt 0 n [-1] true [0]]]
+		name: fn [x] [switch x [1 ["one"] 2 3 ["few"] "s" ["string"] ["many"]]]
+		first-big: fn [b] [foreach x b [if gt x 10 [return x]] none]
+		nothing: fn [] [exit 1]
+		count-down: fn [n /local r] [r: [] while [gt n 0] [n: sub n 1 if gt n 5 [continue] append r n] r]
+		deep: fn [] [foreach x [1 2 3] [repeat i 10 [if gt i 1 [return i]]]]
+		leave: fn [] [try [return 1] 2]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		code   string
+		result string
+	}{
+		{`if true [1]`, "1"},
+		{`if false [1]`, "none"},
+		{`unless false [1]`, "1"},
+		{`sign 5`, "1"},
+		{`sign -5`, "-1"},
+		{`sign 0`, "0"},
+		{`case [false [1]]`, "none"},
+		{`name 1`, `"one"`},
+		{`name 3`, `"few"`},
+		{`name "s"`, `"string"`},
+		{`name 7`, `"many"`},
+		{`switch 7 [1 [2]]`, "none"},
+		{`first-big [1 20 30]`, "20"},
+		{`first-big [1 2]`, "none"},
+		{`nothing`, "[]"},
+		{`count-down 8`, "[5 4 3 2 1 0 ]"},
+		{`deep`, "2"},
+		{`leave`, "1"},
+		{`n: 0 until [n: add n 1 gt n 3]`, "true"},
+		{`n: 0 loop 5 [n: add n 1]`, "5"},
+		{`loop 5 [break]`, "none"},
+		{`n: 0 forever [n: add n 1 if gt n 4 [break]] n`, "5"},
+		{`foreach x [1 2 3] [if gt x 1 [break] x]`, "none"},
+		{`r: 0 foreach x [1 2 3] [if gt x 1 [continue] r: x] r`, "1"},
+		{`unset? nothing`, "true"},
+		{`unset? none`, "false"},
+		{`o: make-object [a: 1] set in o 'a 5 o/a`, "5"},
+		{`o: make-object [] put o "a" 1 put o 'b 2 reduce [o/a get in o "b"]`, "[1 2 ]"},
+		{`unset? get in make-object [] "missing"`, "true"},
+		{`s: 0 foreach v make-object [a: 1 b: 2] [s: add s v] s`, "3"},
+	} {
+		result, err := vm.Eval(test.code)
+		if err != nil {
+			t.Errorf("%s: %v", test.code, err)
+			continue
+		}
+		if got := vm.ToString(result); got != test.result {
+			t.Errorf("%s: got %s, want %s", test.code, got, test.result)
+		}
+	}
+}
+
+func TestUnboundWords(t *testing.T) {
+	for _, compile := range []bool{false, true} {
+		vm := NewVM(1000, 100)
+		BootVM(vm)
+		vm.Compile = compile
+		for _, test := range []struct {
+			code   string
+			result string
+		}{
+			{`set 'fresh 5 fresh`, "5"},
+			{`f: fn [] [set 'inner 6] f inner`, "6"},
+			{`unset? missing`, "true"},
+			{`unset? fresh`, "false"},
+			{`f: fn [] [unset? never-set] f`, "true"},
+			{`if unset? later [later: 2] later`, "2"},
+			{`unset? later`, "false"},
+		} {
+			result, err := vm.Eval(test.code)
+			if err != nil {
+				t.Errorf("compile %v: %s: %v", compile, test.code, err)
+				continue
+			}
+			if got := vm.ToString(result); got != test.result {
+				t.Errorf("compile %v: %s: got %s, want %s", compile, test.code, got, test.result)
+			}
+		}
+		if vm.field(vm.Dictionary, "fresh") != MakeInt(5).Value() {
+			t.Errorf("compile %v: set made no global", compile)
+		}
+	}
+}
+
+func TestControlOutside(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	for _, test := range []struct {
+		code    string
+		message string
+	}{
+		{`break`, "break outside of a loop"},
+		{`if true [continue]`, "continue outside of a loop"},
+		{`return 1`, "return outside of a function"},
+		{`try [break]`, "break outside of a loop"},
+		{`while [1] []`, "while expected logic!"},
+	} {
+		_, err := vm.Eval(test.code)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: got %v, want %s", test.code, err, test.message)
+		}
+	}
+	if result, err := vm.Eval(`add 1 1`); err != nil || result.Val() != 2 {
+		t.Errorf("vm unusable after a stray signal: %v", err)
+	}
+}
@@ -17,87 +17,76 @@ package yar
 
 import "fmt"
 
-func add(vm *VM) Value {
-	x := vm.Next().Val()
-	y := vm.Next().Val()
-	return MakeInt(x + y).Value()
-}
-
-func sub(vm *VM) Value {
-	x := vm.Next().Val()
-	y := vm.Next().Val()
-	return MakeInt(x - y).Value()
-}
-
-func gt(vm *VM) Value {
-	x := vm.Next().Val()
-	y := vm.Next().Val()
-	return MakeBool(x > y).Value()
-}
-
-func blockOfRefinements(vm *VM, code Block) []sym {
-	var result []sym
-
-	for i := code.First(vm); i != 0; i = i.Next(vm) {
-		w := Word(i.Value(vm))
-		result = append(result, w.Sym())
-	}
-
-	return result
-}
-
-// type pcAlias = pc
-
-func fn(vm *VM) Value {
-	params := vm.Next().Block()
-	code := vm.Next().Block()
-
-	defaults := blockOfRefinements(vm, params)
-	stackSize := len(defaults)
-
-	bind(vm, code, func(sym sym, create bool) Binding {
-		for i, def := range defaults {
-			if def == sym {
-				return MakeStackBinding(i - stackSize)
-			}
-		}
-		return 0
-	})
-
-	return makeProc(stackSize, ptr(code.First(vm)))
-}
-
 func either(vm *VM) Value {
-	cond := vm.Next().Bool()
-	ifTrue := vm.Next().Block()
-	ifFalse := Block(vm.Next())
+	cond, err := vm.nextArg("either", BooleanType)
+	if err != 0 {
+		return err
+	}
+	ifTrue, err := vm.nextArg("either", BlockType)
+	if err != 0 {
+		return err
+	}
+	ifFalse, err := vm.nextArg("either", BlockType)
+	if err != 0 {
+		return err
+	}
 
-	if cond.Val() {
-		return vm.call(ifTrue)
+	if cond.Bool().Val() {
+		return vm.call(ifTrue.Block())
 	}
 
-	return vm.call(ifFalse)
+	return vm.call(ifFalse.Block())
 }
 
 func print(vm *VM) Value {
-	val := vm.Next()
+	val, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
 	fmt.Printf("PRINT: %s\n", vm.ToString(val))
 	return val
 }
 
+// append series value adds the value at the tail of a block, or its text at
+// the tail of a string.
 func _append(vm *VM) Value {
-	series := vm.Next().Block()
-	value := vm.Next()
+	s, err := vm.nextSeries("append")
+	if err != 0 {
+		return err
+	}
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
 
+	if s.Kind() == StringType {
+		str := s.String()
+		vm.setRunes(str, append(vm.runes(str), vm.form(value)...))
+		return s
+	}
+	series := s.Block()
 	series.Add(vm, value)
 
 	return series.Value()
 }
 
-func foreach(vm *VM) Value {
-	w := vm.ReadNext().Word()
-	series := vm.Next().Block()
-	code := vm.Next().Block()
+// nextWord reads the next word of a native without evaluating it.
+func (vm *VM) nextWord(native string) (Word, Value) {
+	value := vm.ReadNext()
+	if value.Kind() != WordType {
+		return 0, vm.typeError(native, "word!", value)
+	}
+	return value.Word(), 0
+}
+
+// loopBinding returns the binding a native sets its word through. In functions
+// the word is a local of the function and already bound, elsewhere the word
+// in code is bound to a slot of the bind stack, freed by release.
+func (vm *VM) loopBinding(w Word, code Block) (binding Binding, release func()) {
+	binding = Binding(vm.read(ptr(w.bindings())))
+	if binding != 0 && (binding.Kind() == StackBinding || binding.Kind() == EnvBinding) {
+		return binding, func() {}
+	}
 
 	offset := int(vm.bp)
 	bind(vm, code, func(sym sym, create bool) Binding {
@@ -106,50 +95,113 @@ func foreach(vm *VM) Value {
 		}
 		return 0
 	})
+	vm.bp++
+	return MakeWordBinding(offset), func() { vm.bp-- }
+}
+
+func foreach(vm *VM) Value {
+	w, err := vm.nextWord("foreach")
+	if err != 0 {
+		return err
+	}
+	s, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	var values []Value
+	switch s.Kind() {
+	case BlockType:
+		values = s.Block().values(vm)
+	case MapType:
+		values = vm.fieldValues(s.Dict())
+	default:
+		return vm.typeError("foreach", "block! or object!", s)
+	}
+	c, err := vm.nextArg("foreach", BlockType)
+	if err != 0 {
+		return err
+	}
+	code := c.Block()
 
+	binding, release := vm.loopBinding(w, code)
 	var result Value
-	vm.bp++
 
-	for i := series.First(vm); i != 0; i = i.Next(vm) {
-		vm.bindStack[offset] = i.Value(vm)
-		result = vm.call(code)
+	for _, value := range values {
+		vm.setBound[binding.Kind()](binding, value)
+		var done bool
+		if result, done = vm.loopBody(code); done {
+			break
+		}
 	}
 
-	vm.bp = vm.bp - 1
+	release()
+	return result
+}
 
+// fieldValues returns the values of the fields of an object in order, unset
+// fields are skipped.
+func (vm *VM) fieldValues(object dict) []Value {
+	var result []Value
+	d := dictFirst(vm.read(ptr(object.dictFirst())))
+	for e := d.first(); e != 0; e = e.next(vm) {
+		if value := Value(vm.read(ptr(e.symval(vm).val(vm)))); value != 0 {
+			result = append(result, value)
+		}
+	}
 	return result
 }
 
 func repeat(vm *VM) Value {
-	w := vm.ReadNext().Word()
-	times := vm.Next().Integer().Value().Val()
-	code := vm.Next().Block()
-
-	offset := int(vm.bp)
-	bind(vm, code, func(sym sym, create bool) Binding {
-		if sym == w.Sym() {
-			return MakeWordBinding(offset)
-		}
-		return 0
-	})
+	w, err := vm.nextWord("repeat")
+	if err != 0 {
+		return err
+	}
+	n, err := vm.nextArg("repeat", IntegerType)
+	if err != 0 {
+		return err
+	}
+	c, err := vm.nextArg("repeat", BlockType)
+	if err != 0 {
+		return err
+	}
+	times := n.Val()
+	code := c.Block()
 
+	binding, release := vm.loopBinding(w, code)
 	var result Value
-	vm.bp++
 
 	for i := 0; i < times; i++ {
-		vm.bindStack[offset] = MakeInt(i).Value()
-		result = vm.call(code)
+		vm.setBound[binding.Kind()](binding, MakeInt(i).Value())
+		var done bool
+		if result, done = vm.loopBody(code); done {
+			break
+		}
 	}
 
-	vm.bp = vm.bp - 1
-
+	release()
 	return result
 }
 
 func makeObject(vm *VM) Value {
-	block := vm.Next().Block()
+	b, err := vm.nextArg("make-object", BlockType)
+	if err != 0 {
+		return err
+	}
+	block := b.Block()
 
 	object := vm.AllocDict()
+	vm.bindObject(block, object)
+
+	vm.call(block)
+	if vm.raised != 0 {
+		return vm.raised
+	}
+	return object.Value()
+}
+
+// bindObject binds the words a block sets and the words of the object it
+// already has to the object, other words keep their binding.
+func (vm *VM) bindObject(block Block, object dict) {
 	bind(vm, block, func(sym sym, create bool) Binding {
 		symValPtr := object.Find(vm, sym)
 		if symValPtr == 0 {
@@ -161,15 +213,21 @@ func makeObject(vm *VM) Value {
 		}
 		return makeMapBinding(ptr(symValPtr))
 	})
-
-	vm.call(block)
-	return object.Value()
 }
 
 func in(vm *VM) Value {
-	m := vm.Next().Dict()
-	w := vm.Next().Word()
-	sym := w.Sym()
+	o, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	if o.Kind() != MapType && o.Kind() != ErrorType {
+		return vm.typeError("in", "object!", o)
+	}
+	sym, err := vm.nextKey("in")
+	if err != 0 {
+		return err
+	}
+	m := o.Dict()
 
 	symval := m.Find(vm, sym)
 	if symval == 0 {
@@ -179,53 +237,212 @@ func in(vm *VM) Value {
 	return Value(_makeWord(sym, pBinding(vm.alloc(cell(binding))), QuoteType))
 }
 
+// nextKey evaluates the next argument of a native taking a field of an
+// object, given as a word or a string.
+func (vm *VM) nextKey(native string) (sym, Value) {
+	key, err := vm.nextAny()
+	if err != 0 {
+		return 0, err
+	}
+	switch {
+	case isWord(key.Kind()):
+		return key.Word().Sym(), 0
+	case key.Kind() == StringType:
+		return vm.GetSymbolID(key.String().String(vm)), 0
+	}
+	return 0, vm.typeError(native, "word!", key)
+}
+
+// put object key value sets a field of an object, adding it when the object
+// has none.
+func put(vm *VM) Value {
+	o, err := vm.nextArg("put", MapType)
+	if err != 0 {
+		return err
+	}
+	sym, err := vm.nextKey("put")
+	if err != 0 {
+		return err
+	}
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	o.Dict().Put(vm, sym, value)
+	return value
+}
+
+// get word returns the value of a word, get of an unset value is unset so
+// `get in object key` is unset for a missing field.
 func get(vm *VM) Value {
-	w := vm.Next()
+	w, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	if w == 0 {
+		return 0
+	}
+	if !isWord(w.Kind()) {
+		return vm.typeError("get", "word!", w)
+	}
 
 	return getWordExec(vm, w)
 	// return vm.execFunc[bound.Kind()](vm, bound)
 }
 
 func none(vm *VM) Value {
-	return 0
+	return None
+}
+
+func try(vm *VM) Value {
+	block, err := vm.nextArg("try", BlockType)
+	if err != 0 {
+		return err
+	}
+	result, _ := vm.evalCaught(block.Block())
+	return result
+}
+
+func attempt(vm *VM) Value {
+	block, err := vm.nextArg("attempt", BlockType)
+	if err != 0 {
+		return err
+	}
+	result, caught := vm.evalCaught(block.Block())
+	if caught {
+		return None
+	}
+	return result
+}
+
+// catch err [code] [handler] evaluates the handler with err bound to the
+// error raised by code.
+func catch(vm *VM) Value {
+	w, err := vm.nextWord("catch")
+	if err != 0 {
+		return err
+	}
+	c, err := vm.nextArg("catch", BlockType)
+	if err != 0 {
+		return err
+	}
+	h, err := vm.nextArg("catch", BlockType)
+	if err != 0 {
+		return err
+	}
+
+	result, caught := vm.evalCaught(c.Block())
+	if !caught {
+		return result
+	}
+
+	handler := h.Block()
+	binding, release := vm.loopBinding(w, handler)
+	vm.setBound[binding.Kind()](binding, result)
+	result = vm.call(handler)
+	release()
+
+	return result
+}
+
+func isError(vm *VM) Value {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	return MakeBool(value.Kind() == ErrorType).Value()
+}
+
+// cause-error 'kind "message" raises a user error.
+func causeError(vm *VM) Value {
+	at := vm.at
+	kind, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	if !isWord(kind.Kind()) {
+		return vm.typeError("cause-error", "word!", kind)
+	}
+	message, err := vm.nextArg("cause-error", StringType)
+	if err != 0 {
+		return err
+	}
+	vm.at = at
+	e := vm.makeError(ErrUser, vm.InverseSymbols[kind.Word().Sym()], message.String().String(vm), 0)
+	return vm.raise(e)
+}
+
+func mold(vm *VM) Value {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	return vm.AllocString(vm.Mold(value)).Value()
+}
+
+// load parses a string, the result is the value if the source holds exactly one
+// and the block of values otherwise. Loaded words are not bound.
+func load(vm *VM) Value {
+	source, err := vm.nextArg("load", StringType)
+	if err != 0 {
+		return err
+	}
+	code, e := vm.Parse(source.String().String(vm))
+	if e != nil {
+		return vm.raise(vm.syntaxError(e.(*SyntaxError)))
+	}
+	if first := code.First(vm); first != 0 && first.Next(vm) == 0 {
+		return first.Value(vm)
+	}
+	return code.Value()
 }
 
 func CorePackage() *Pkg {
 	result := NewPackage("core")
-	result.AddFunc("add", add)
-	result.AddFunc("sub", sub)
-	result.AddFunc("gt", gt)
 	result.AddFunc("either", either)
 	result.AddFunc("fn", fn)
 	result.AddFunc("make-object", makeObject)
-	result.AddFunc("foreach", foreach)
+	result.AddLoopFunc("foreach", foreach)
 	result.AddFunc("print", print)
 	result.AddFunc("append", _append)
-	result.AddFunc("repeat", repeat)
+	result.AddLoopFunc("repeat", repeat)
 	result.AddFunc("in", in)
 	result.AddFunc("get", get)
+	result.AddFunc("put", put)
 	result.AddFunc("none", none)
+	result.AddFunc("try", try)
+	result.AddFunc("attempt", attempt)
+	result.AddLoopFunc("catch", catch)
+	result.AddFunc("error?", isError)
+	result.AddFunc("cause-error", causeError)
+	result.AddFunc("mold", mold)
+	result.AddFunc("load", load)
+	result.AddFunc("if", _if)
+	result.AddFunc("unless", unless)
+	result.AddFunc("case", _case)
+	result.AddFunc("switch", _switch)
+	result.AddFunc("while", while)
+	result.AddFunc("until", until)
+	result.AddFunc("loop", loop)
+	result.AddFunc("forever", forever)
+	result.AddFunc("break", _break)
+	result.AddFunc("continue", _continue)
+	result.AddFunc("return", _return)
+	result.AddFunc("exit", exit)
+	result.AddFunc("unset?", isUnset)
+	result.AddFunc("set", set)
+	result.AddFunc("module", module)
+	result.AddFunc("import", _import)
+	mathPackage(result)
+	seriesPackage(result)
+	stringPackage(result)
 	return result
 }
 
-const coreY = `
-add: load-native "core/add"
-sub: load-native "core/sub"
-gt: load-native "core/gt"
-either: load-native "core/either"
-fn: load-native "core/fn"
-make-object: load-native "core/make-object"
-foreach: load-native "core/foreach"
-print: load-native "core/print"
-append: load-native "core/append"
-repeat: load-native "core/repeat"
-in: load-native "core/in"
-get: load-native "core/get"
-none: load-native "core/none"
-`
-
+// CoreModule sets a word to each native of the core package through its
+// loader script.
 func CoreModule(vm *VM) Value {
-	code := vm.Parse(coreY)
+	code := vm.MustParse(vm.Library.pkg("core").Script())
 	return vm.BindAndExec(code)
 }
 
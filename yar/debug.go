@@ -0,0 +1,213 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// T R A C E R
+
+// traceWidth is the length values are cut to in a trace.
+const traceWidth = 60
+
+// Tracer is a hook printing each value evaluated with its position, and each
+// function call and return, indented by the depth of calls.
+type Tracer struct {
+	w io.Writer
+}
+
+func NewTracer(w io.Writer) *Tracer { return &Tracer{w: w} }
+
+func (t *Tracer) Next(vm *VM, pos Position) {
+	fmt.Fprintf(t.w, "%s%d:%d %s\n", indent(pos.Depth), pos.Line, pos.Column, shorten(vm.Mold(pos.Value)))
+}
+
+func (t *Tracer) Call(vm *VM, frame *Frame) {
+	if frame.Native {
+		return
+	}
+	var args []string
+	for _, local := range frame.Locals(vm) {
+		args = append(args, local.Name+": "+shorten(vm.Mold(local.Value)))
+	}
+	fmt.Fprintf(t.w, "%s-> %s [%s]\n", indent(frame.depth-1), frame.Name, strings.Join(args, " "))
+}
+
+func (t *Tracer) Return(vm *VM, frame *Frame, result Value) {
+	if !frame.Native {
+		fmt.Fprintf(t.w, "%s<- %s == %s\n", indent(frame.depth-1), frame.Name, shorten(vm.Mold(result)))
+	}
+}
+
+func indent(depth int) string { return strings.Repeat("  ", depth) }
+
+func shorten(s string) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) > traceWidth {
+		return s[:traceWidth-3] + "..."
+	}
+	return s
+}
+
+// D E B U G G E R
+
+// Resume tells a stopped debugger how to go on.
+type Resume int
+
+const (
+	// Continue runs to the next breakpoint.
+	Continue Resume = iota
+	// StepIn stops at the next value evaluated.
+	StepIn
+	// StepOver stops at the next value evaluated outside of the functions
+	// called by the current one.
+	StepOver
+	// StepOut stops at the next value evaluated after the current function
+	// returns.
+	StepOut
+)
+
+// Debugger is a hook stopping evaluation at breakpoints on words or lines and
+// after steps. Stopped is called at each stop, it inspects the VM through the
+// debugger and returns how to resume. Line breakpoints stop when evaluation
+// enters the line from another one.
+type Debugger struct {
+	Stopped func(d *Debugger, pos Position) Resume
+
+	vm     *VM
+	words  map[string]bool
+	lines  map[int]bool
+	resume Resume
+	depth  int
+	line   int
+}
+
+func NewDebugger(stopped func(d *Debugger, pos Position) Resume) *Debugger {
+	return &Debugger{Stopped: stopped, words: make(map[string]bool), lines: make(map[int]bool)}
+}
+
+// BreakOnWord stops before a word, or a path starting with it, is evaluated.
+func (d *Debugger) BreakOnWord(name string) { d.words[name] = true }
+
+// BreakOnLine stops before the first value of a line is evaluated.
+func (d *Debugger) BreakOnLine(line int) { d.lines[line] = true }
+
+// ClearBreakpoints removes all breakpoints.
+func (d *Debugger) ClearBreakpoints() {
+	d.words = make(map[string]bool)
+	d.lines = make(map[int]bool)
+}
+
+// Step makes the debugger stop at the next value evaluated.
+func (d *Debugger) Step() { d.resume = StepIn }
+
+// Continue drops a step left to make, so the debugger stops at breakpoints
+// only.
+func (d *Debugger) Continue() { d.resume = Continue }
+
+func (d *Debugger) Next(vm *VM, pos Position) {
+	d.vm = vm
+	line := d.line
+	d.line = pos.Line
+	if !d.stops(vm, pos, line) {
+		return
+	}
+	d.resume, d.depth = Continue, pos.Depth
+	if d.Stopped != nil {
+		d.resume = d.Stopped(d, pos)
+	}
+}
+
+func (d *Debugger) stops(vm *VM, pos Position, line int) bool {
+	switch d.resume {
+	case StepIn:
+		return true
+	case StepOver:
+		if pos.Depth <= d.depth {
+			return true
+		}
+	case StepOut:
+		if pos.Depth < d.depth {
+			return true
+		}
+	}
+	if pos.Line != 0 && pos.Line != line && d.lines[pos.Line] {
+		return true
+	}
+	return d.words[vm.wordName(pos.Value)]
+}
+
+func (d *Debugger) Call(vm *VM, frame *Frame)                 {}
+func (d *Debugger) Return(vm *VM, frame *Frame, result Value) {}
+
+// Stack returns the functions being called, the innermost last. Natives are
+// left out.
+func (d *Debugger) Stack() []*Frame {
+	var stack []*Frame
+	for _, frame := range d.vm.Frames() {
+		if !frame.Native {
+			stack = append(stack, frame)
+		}
+	}
+	return stack
+}
+
+// Locals returns the locals of the innermost function, or nothing at the top
+// level.
+func (d *Debugger) Locals() []Local {
+	stack := d.Stack()
+	if len(stack) == 0 {
+		return nil
+	}
+	return stack[len(stack)-1].Locals(d.vm)
+}
+
+// Get returns the value of a word as seen from the innermost function: one of
+// its locals, or else a global.
+func (d *Debugger) Get(name string) (Value, bool) {
+	for _, local := range d.Locals() {
+		if local.Name == name {
+			return local.Value, true
+		}
+	}
+	sym, ok := d.vm.symbols[name]
+	if !ok {
+		return 0, false
+	}
+	sv := d.vm.Dictionary.Find(d.vm, sym)
+	if sv == 0 {
+		return 0, false
+	}
+	return Value(d.vm.read(ptr(sv.val(d.vm)))), true
+}
+
+// VM returns the VM the debugger stopped in.
+func (d *Debugger) VM() *VM { return d.vm }
+
+// wordName returns the name of a word, or of the first word of a path, or "".
+func (vm *VM) wordName(value Value) string {
+	switch value.Kind() {
+	case WordType, GetWordType, SetWordType, QuoteType:
+		return vm.InverseSymbols[value.Word().Sym()]
+	case PathType, GetPathType, SetPathType:
+		fl := firstLast(vm.read(ptr(value.Path().firstLast())))
+		return vm.InverseSymbols[sym(fl.first().pval(vm))]
+	}
+	return ""
+}
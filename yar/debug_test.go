@@ -0,0 +1,195 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	var out bytes.Buffer
+	vm.Hook = NewTracer(&out)
+	if _, err := vm.Eval("f: fn [a] [\n  a + 1\n]\nf 2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"1:1 f:",
+		"4:1 f",
+		"-> f [a: 2]",
+		"  2:3 a",
+		"<- f == 3",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("trace has no %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestHookFrames(t *testing.T) {
+	for _, compile := range []bool{false, true} {
+		vm := NewVM(1000, 100)
+		BootVM(vm)
+		vm.Compile = compile
+		var depths []int
+		vm.Hook = hookFunc(func(vm *VM, pos Position) { depths = append(depths, pos.Depth) })
+		if _, err := vm.Eval(`f: fn [n] [either n = 0 [add 1 "x"] [f n - 1]] f 3`); err == nil {
+			t.Fatal("no error")
+		}
+		if len(vm.Frames()) != 0 {
+			t.Errorf("compiled %v: %d frames left", compile, len(vm.Frames()))
+		}
+		max := 0
+		for _, depth := range depths {
+			if depth > max {
+				max = depth
+			}
+		}
+		if max != 4 {
+			t.Errorf("compiled %v: max depth %d, want 4", compile, max)
+		}
+	}
+}
+
+type hookFunc func(vm *VM, pos Position)
+
+func (f hookFunc) Next(vm *VM, pos Position)                 { f(vm, pos) }
+func (f hookFunc) Call(vm *VM, frame *Frame)                 {}
+func (f hookFunc) Return(vm *VM, frame *Frame, result Value) {}
+
+const debugged = `fact: fn [n] [
+	either n > 1 [
+		n * fact n - 1
+	] [1]
+]
+total: 0
+foreach x [1 2 3] [
+	total: total + fact x
+]
+total`
+
+// stops runs debugged and returns "line:value" of each stop, the debugger
+// resumes with the given steps in turn, then continues.
+func stops(t *testing.T, setup func(d *Debugger), steps ...Resume) []string {
+	t.Helper()
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	var result []string
+	d := NewDebugger(func(d *Debugger, pos Position) Resume {
+		result = append(result, vm.Mold(pos.Value))
+		if len(steps) == 0 {
+			return Continue
+		}
+		next := steps[0]
+		steps = steps[1:]
+		return next
+	})
+	setup(d)
+	vm.Hook = d
+	value, err := vm.Eval(debugged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.ToString(value); got != "9" {
+		t.Errorf("debugged result %s, want 9", got)
+	}
+	return result
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	got := stops(t, func(d *Debugger) { d.BreakOnWord("fact") })
+	if len(got) != 7 {
+		// fact: once, fact in the loop three times, then the recursive
+		// calls of fact 2 and fact 3.
+		t.Errorf("word breakpoint stopped %d times: %v", len(got), got)
+	}
+	got = stops(t, func(d *Debugger) { d.BreakOnLine(8) })
+	if strings.Join(got, " ") != "total: total: total:" {
+		t.Errorf("line breakpoint stops: %v", got)
+	}
+}
+
+func TestDebuggerSteps(t *testing.T) {
+	line := func(d *Debugger) { d.BreakOnLine(8) }
+	got := stops(t, line, StepIn, StepIn, StepIn, StepIn)
+	if want := "total: total fact x either"; strings.Join(got[:5], " ") != want {
+		t.Errorf("step in: %v, want %s", got, want)
+	}
+	got = stops(t, line, StepOver, StepOver, StepOver, StepOver)
+	if want := "total: total fact x total:"; strings.Join(got[:5], " ") != want {
+		t.Errorf("step over: %v, want %s", got, want)
+	}
+	got = stops(t, func(d *Debugger) { d.BreakOnWord("n") }, StepOut)
+	if got[0] != "n" || got[1] != "total:" {
+		t.Errorf("step out: %v, want n total: ...", got)
+	}
+}
+
+func TestDebuggerInspect(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	var stack []string
+	var n, total string
+	d := NewDebugger(func(d *Debugger, pos Position) Resume {
+		if len(d.Stack()) < 3 {
+			return Continue
+		}
+		for _, frame := range d.Stack() {
+			stack = append(stack, frame.Name)
+		}
+		value, _ := d.Get("n")
+		n = vm.ToString(value)
+		value, _ = d.Get("total")
+		total = vm.ToString(value)
+		d.ClearBreakpoints()
+		return Continue
+	})
+	d.BreakOnWord("either")
+	vm.Hook = d
+	if _, err := vm.Eval(debugged); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(stack, " ") != "fact fact fact" || n != "1" || total != "3" {
+		t.Errorf("stack %v, n %s, total %s", stack, n, total)
+	}
+}
+
+func TestDebuggerPathStack(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	var stack []string
+	d := NewDebugger(func(d *Debugger, pos Position) Resume {
+		if len(d.Stack()) < 2 {
+			return Continue
+		}
+		for _, frame := range d.Stack() {
+			stack = append(stack, frame.Name)
+		}
+		d.ClearBreakpoints()
+		return Continue
+	})
+	d.BreakOnWord("x")
+	vm.Hook = d
+	if _, err := vm.Eval(`o: make-object [f: fn [x /twice] [o/in/g x] in: make-object [g: fn [x] [x]]] o/f/twice 1`); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(stack, " "); got != "o/f o/in/g" {
+		t.Errorf("stack %s, want o/f o/in/g", got)
+	}
+}
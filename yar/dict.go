@@ -20,6 +20,21 @@ import (
 	"strings"
 )
 
+// D I C T
+//-------------------------------------
+//   INDEX   |   FIRST ENTRY   | KIND |
+//-------------------------------------
+//
+// A dictionary is a linked list of entries pointing to symvals, kept in
+// insertion order for mold. Once it holds more than indexThreshold entries it
+// also gets an index, an open-addressing hash table of symval pointers keyed by
+// symbol:
+//
+//   item(count, last entry) item(capacity, 0) slot ... slot
+//
+// Symvals never move while the dictionary grows, so map bindings pointing to
+// them stay valid.
+
 type dict Value
 type dictFirst cell
 type pDictFirst ptr
@@ -27,6 +42,10 @@ type pDictEntry ptr
 type symval item
 type pSymval ptr
 
+// indexThreshold is the size up to which walking the list is faster than
+// hashing.
+const indexThreshold = 8
+
 func makeDict(first pDictFirst) dict {
 	return dict(makeValue(int(first), MapType))
 }
@@ -41,14 +60,18 @@ func (d dict) Value() Value                             { return Value(d) }
 func (d dict) dictFirst() pDictFirst                    { return pDictFirst(d.Value().Val()) }
 func (v Value) Dict() dict                              { return dict(v) }
 
+func makeDictFirst(index ptr, first pDictEntry) dictFirst {
+	return dictFirst(makeObj(int(index), ptr(first), MapType))
+}
+
 func (d dictFirst) first() pDictEntry { return pDictEntry(obj(d).ptr()) }
+func (d dictFirst) index() ptr        { return ptr(obj(d).val()) }
 
 func (p pDictEntry) next(vm *VM) pDictEntry { return pDictEntry(pItem(p).ptr(vm)) }
 func (p pDictEntry) symval(vm *VM) pSymval  { return pSymval(pItem(p).val(vm)) }
 
-func (p pSymval) sym(vm *VM) sym           { return sym(pItem(p).ptr(vm)) }
-func (p pSymval) val(vm *VM) int           { return pItem(p).val(vm) }
-func (p pSymval) setPtr(vm *VM, value ptr) { pItem(p).setPtr(vm, value) }
+func (p pSymval) sym(vm *VM) sym { return sym(pItem(p).ptr(vm)) }
+func (p pSymval) val(vm *VM) int { return pItem(p).val(vm) }
 
 func makeSymval(sym sym, value ptr) symval { return symval(makeItem(int(value), ptr(sym))) }
 
@@ -59,32 +82,58 @@ func (s symval) val() ptr { return ptr(item(s).val()) }
 
 func (pd pDictFirst) put(vm *VM, sym sym, value Value) pSymval {
 	p := vm.alloc(cell(value))
-	d := dictFirst(vm.read(ptr(pd)))
-	last := pDictEntry(0)
-	for i := d.first(); i != 0; i = i.next(vm) {
-		last = i
-		sv := i.symval(vm)
-		if sv.sym(vm) == sym {
-			sv.setPtr(vm, p)
-			return sv
-		}
+	if sv := pd.find(vm, sym); sv != 0 {
+		vm.write(ptr(sv), cell(makeSymval(sym, p)))
+		return sv
 	}
 
-	symval := vm.alloc(cell(makeSymval(sym, p)))
-	pair := vm.alloc(cell(makeItem(int(symval), 0)))
+	symval := pSymval(vm.alloc(cell(makeSymval(sym, p))))
+	pair := pDictEntry(vm.alloc(cell(makeItem(int(symval), 0))))
 
-	if last != 0 {
-		pItem(last).setPtr(vm, ptr(pair))
-	} else {
-		vm.write(ptr(pd), cell(makeObj(0, ptr(pair), MapType)))
+	d := dictFirst(vm.read(ptr(pd)))
+	index := d.index()
+	if index == 0 {
+		count, last := 1, pDictEntry(0)
+		for i := d.first(); i != 0; i = i.next(vm) {
+			count, last = count+1, i
+		}
+		first := d.first()
+		if last != 0 {
+			pItem(last).setPtr(vm, ptr(pair))
+		} else {
+			first = pair
+		}
+		if count > indexThreshold {
+			index = vm.buildIndex(first, pair, count)
+		}
+		if last == 0 || index != 0 {
+			vm.write(ptr(pd), cell(makeDictFirst(index, first)))
+		}
+		return symval
 	}
 
-	return pSymval(symval)
+	header := item(vm.read(index))
+	count, last := header.val()+1, pDictEntry(header.ptr())
+	pItem(last).setPtr(vm, ptr(pair))
+	if count*4 > indexCapacity(vm, index)*3 {
+		vm.write(ptr(pd), cell(makeDictFirst(vm.buildIndex(d.first(), pair, count), d.first())))
+		return symval
+	}
+	vm.write(index, cell(makeItem(count, ptr(pair))))
+	indexInsert(vm, index, symval)
+	return symval
 }
 
 func (pd pDictFirst) find(vm *VM, sym sym) pSymval {
 	d := dictFirst(vm.read(ptr(pd)))
-	for i := d.first(); i != 0; i = i.next(vm) {
+	if index := d.index(); index != 0 {
+		return indexFind(vm, index, sym)
+	}
+	return findInList(vm, d.first(), sym)
+}
+
+func findInList(vm *VM, first pDictEntry, sym sym) pSymval {
+	for i := first; i != 0; i = i.next(vm) {
 		sv := i.symval(vm)
 		if sv.sym(vm) == sym {
 			return sv
@@ -93,6 +142,51 @@ func (pd pDictFirst) find(vm *VM, sym sym) pSymval {
 	return 0
 }
 
+// buildIndex allocates an index for count entries starting at first, with room
+// to grow before the next rebuild.
+func (vm *VM) buildIndex(first pDictEntry, last pDictEntry, count int) ptr {
+	capacity := 16
+	for capacity < count*2 {
+		capacity *= 2
+	}
+	index := vm.alloc(cell(makeItem(count, ptr(last))))
+	vm.alloc(cell(makeItem(capacity, 0)))
+	for i := 0; i < capacity; i++ {
+		vm.alloc(0)
+	}
+	for i := first; i != 0; i = i.next(vm) {
+		indexInsert(vm, index, i.symval(vm))
+	}
+	return index
+}
+
+func indexCapacity(vm *VM, index ptr) int { return item(vm.read(index + 1)).val() }
+
+func indexSlot(sym sym, capacity int) int {
+	return int((uint64(sym) * 0x9e3779b97f4a7c15) >> 32 & uint64(capacity-1))
+}
+
+func indexInsert(vm *VM, index ptr, sv pSymval) {
+	capacity := indexCapacity(vm, index)
+	slots := index + 2
+	i := indexSlot(sv.sym(vm), capacity)
+	for vm.read(slots+ptr(i)) != 0 {
+		i = (i + 1) & (capacity - 1)
+	}
+	vm.write(slots+ptr(i), cell(sv))
+}
+
+func indexFind(vm *VM, index ptr, sym sym) pSymval {
+	capacity := indexCapacity(vm, index)
+	slots := index + 2
+	for i := indexSlot(sym, capacity); ; i = (i + 1) & (capacity - 1) {
+		sv := pSymval(vm.read(slots + ptr(i)))
+		if sv == 0 || sv.sym(vm) == sym {
+			return sv
+		}
+	}
+}
+
 func dictToString(vm *VM, b Value) string {
 	var result strings.Builder
 	// result.WriteString(fmt.Sprintf(" #%016x ", b))
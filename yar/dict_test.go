@@ -0,0 +1,116 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func fillDict(vm *VM, n int) (dict, []sym) {
+	d := vm.AllocDict()
+	syms := make([]sym, n)
+	for i := range syms {
+		syms[i] = vm.GetSymbolID(fmt.Sprintf("f%d", i))
+		d.Put(vm, syms[i], MakeInt(i).Value())
+	}
+	return d, syms
+}
+
+func TestDictIndex(t *testing.T) {
+	vm := NewVM(1000, 100)
+	d, syms := fillDict(vm, 100)
+	first := d.Find(vm, syms[0])
+	if index := dictFirst(vm.read(ptr(d.dictFirst()))).index(); index == 0 {
+		t.Fatal("dictionary of 100 entries has no index")
+	}
+
+	d.Put(vm, syms[0], MakeInt(-1).Value())
+	if sv := d.Find(vm, syms[0]); sv != first {
+		t.Errorf("symval moved from %d to %d", first, sv)
+	}
+	for i, sym := range syms[1:] {
+		if sv := d.Find(vm, sym); sv == 0 || Value(vm.read(ptr(sv.val(vm)))) != MakeInt(i+1).Value() {
+			t.Errorf("f%d not found", i+1)
+		}
+	}
+	if sv := d.Find(vm, vm.GetSymbolID("missing")); sv != 0 {
+		t.Errorf("found missing field")
+	}
+
+	s := vm.ToString(d.Value())
+	if !strings.HasPrefix(s, "[f0(") || strings.Index(s, "f98(") > strings.Index(s, "f99(") {
+		t.Errorf("entries are not in insertion order: %s", s)
+	}
+}
+
+func TestDictIndexSurvivesGC(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse(`
+		o: make-object [a: 1 b: 2 c: 3 d: 4 e: 5 f: 6 g: 7 h: 8 i: 9 j: 10 k: 11]
+		ref: in o 'k
+	`))
+	vm.BindAndExec(vm.MustParse(`x: "garbage" x: none`))
+	vm.GC()
+
+	if result := vm.BindAndExec(vm.MustParse("add o/a o/k")); result != MakeInt(12).Value() {
+		t.Errorf("add o/a o/k = %s, want 12", vm.ToString(result))
+	}
+	vm.BindAndExec(vm.MustParse("o/k: 42"))
+	if result := vm.BindAndExec(vm.MustParse("get ref")); result != MakeInt(42).Value() {
+		t.Errorf("get ref = %s, want 42", vm.ToString(result))
+	}
+	o := vm.BindAndExec(vm.MustParse("o")).Dict()
+	o.Put(vm, vm.GetSymbolID("l"), MakeInt(12).Value())
+	if result := vm.BindAndExec(vm.MustParse("o/l")); result != MakeInt(12).Value() {
+		t.Errorf("o/l = %s, want 12", vm.ToString(result))
+	}
+}
+
+// The list benchmarks walk the same dictionary the way lookups did before it
+// was indexed.
+func BenchmarkDictFind(b *testing.B) {
+	for _, n := range []int{4, 16, 64, 512} {
+		vm := NewVM(1000, 100)
+		d, syms := fillDict(vm, n)
+		first := dictFirst(vm.read(ptr(d.dictFirst()))).first()
+		b.Run(fmt.Sprintf("index/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d.Find(vm, syms[i%n])
+			}
+		})
+		b.Run(fmt.Sprintf("list/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				findInList(vm, first, syms[i%n])
+			}
+		})
+	}
+}
+
+func BenchmarkDictPut(b *testing.B) {
+	for _, n := range []int{4, 16, 64, 512} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				vm := NewVM(1000, 100)
+				b.StartTimer()
+				fillDict(vm, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// E R R O R
+//-------------------------
+//   DICT FIRST    | KIND |
+//-------------------------
+//
+// An error is an object with code, kind, message, where and near fields, and
+// line and column when the failed value was parsed, so paths like err/message
+// work on it. Errors are plain values, an error is
+// raised by storing it in vm.raised: evaluation of blocks stops, natives
+// return it from their arguments, and the top-level entry points hand it back
+// as the result.
+
+type Error Value
+
+func (e Error) Value() Value { return Value(e) }
+func (v Value) Error() Error { return Error(v) }
+func (e Error) dict() dict   { return dict(makeValue(e.Value().Val(), MapType)) }
+
+const (
+	ErrNoValue    = 1
+	ErrNotBound   = 2
+	ErrNoField    = 3
+	ErrType       = 4
+	ErrNoFunction = 5
+	ErrReadOnly   = 6
+	ErrSyntax     = 7
+	ErrInternal   = 8
+	ErrUser       = 9
+	ErrMath       = 10
+	ErrLimit      = 11
+	ErrModule     = 12
+)
+
+var errorKinds = map[int]string{
+	ErrNoValue:    "script",
+	ErrNotBound:   "script",
+	ErrNoField:    "script",
+	ErrType:       "script",
+	ErrNoFunction: "script",
+	ErrReadOnly:   "access",
+	ErrSyntax:     "syntax",
+	ErrInternal:   "internal",
+	ErrMath:       "math",
+	ErrLimit:      "limit",
+	ErrModule:     "access",
+}
+
+// nearSize is the number of values starting at the failed one kept in the
+// near field.
+const nearSize = 4
+
+var typeNames = [LastType]string{
+	"block!", "word!", "get-word!", "set-word!", "lit-word!", "object!",
+	"integer!", "logic!", "native!", "function!", "path!", "get-path!",
+	"string!", "error!", "set-path!", "refinement!", "decimal!", "none!",
+	"issue!", "file!", "url!", "host-port!", "duration!",
+}
+
+func typeName(kind int) string {
+	if kind < len(typeNames) && typeNames[kind] != "" {
+		return typeNames[kind]
+	}
+	return fmt.Sprintf("type(%d)!", kind)
+}
+
+// MakeError allocates an error. where is the offending word or path, or 0.
+func (vm *VM) MakeError(code int, message string, where Value) Error {
+	kind := errorKinds[code]
+	if kind == "" {
+		kind = "user"
+	}
+	return vm.makeError(code, kind, message, where)
+}
+
+func (vm *VM) makeError(code int, kind string, message string, where Value) Error {
+	fields := vm.AllocDict()
+	fields.Put(vm, vm.GetSymbolID("code"), MakeInt(code).Value())
+	fields.Put(vm, vm.GetSymbolID("kind"), vm.AllocQuoteWord(vm.GetSymbolID(kind)).Value())
+	fields.Put(vm, vm.GetSymbolID("message"), vm.AllocString(message).Value())
+	if where != 0 {
+		block := vm.AllocBlock()
+		block.Add(vm, where)
+		where = block.Value()
+	}
+	fields.Put(vm, vm.GetSymbolID("where"), where)
+	fields.Put(vm, vm.GetSymbolID("near"), vm.near())
+	if span, ok := vm.spanAt(vm.at); ok {
+		fields.Put(vm, vm.GetSymbolID("line"), MakeInt(span.Line).Value())
+		fields.Put(vm, vm.GetSymbolID("column"), MakeInt(span.Column).Value())
+	}
+	return Error(makeValue(fields.Value().Val(), ErrorType))
+}
+
+func (vm *VM) syntaxError(e *SyntaxError) Error {
+	err := vm.MakeError(ErrSyntax, e.Message, 0)
+	err.dict().Put(vm, vm.GetSymbolID("line"), MakeInt(e.Line).Value())
+	err.dict().Put(vm, vm.GetSymbolID("column"), MakeInt(e.Column).Value())
+	return err
+}
+
+func (vm *VM) near() Value {
+	block := vm.AllocBlock()
+	i := vm.at
+	for n := 0; i != 0 && n < nearSize; n++ {
+		block.Add(vm, i.Value(vm))
+		i = i.Next(vm)
+	}
+	return block.Value()
+}
+
+func (e Error) field(vm *VM, name string) Value {
+	sv := e.dict().Find(vm, vm.GetSymbolID(name))
+	if sv == 0 {
+		return 0
+	}
+	return Value(vm.read(ptr(sv.val(vm))))
+}
+
+// Code returns error code.
+func (e Error) Code(vm *VM) int { return e.field(vm, "code").Val() }
+
+// Message returns error message.
+func (e Error) Message(vm *VM) string {
+	message := e.field(vm, "message")
+	if message.Kind() != StringType {
+		return ""
+	}
+	return message.String().String(vm)
+}
+
+// raise sets the error being raised and returns it, natives fail with
+// `return vm.raise(...)`.
+func (vm *VM) raise(err Error) Value {
+	vm.raised = err.Value()
+	return vm.raised
+}
+
+func (vm *VM) fail(code int, message string, where Value) Value {
+	return vm.raise(vm.MakeError(code, message, where))
+}
+
+// Raised returns the error being raised or 0.
+func (vm *VM) Raised() Value { return vm.raised }
+
+func (vm *VM) typeError(native string, expected string, got Value) Value {
+	return vm.fail(ErrType, fmt.Sprintf("%s expected %s argument, got %s", native, expected, typeName(got.Kind())), 0)
+}
+
+// nextArg evaluates the next argument of a native and checks its type. When
+// the second result isn't 0 the native must return it.
+func (vm *VM) nextArg(native string, kind int) (Value, Value) {
+	value := vm.Next()
+	if vm.raised != 0 {
+		return 0, vm.raised
+	}
+	if value.Kind() != kind {
+		return 0, vm.typeError(native, typeName(kind), value)
+	}
+	return value, 0
+}
+
+// nextAny evaluates the next argument of a native of any type.
+func (vm *VM) nextAny() (Value, Value) {
+	value := vm.Next()
+	if vm.raised != 0 {
+		return 0, vm.raised
+	}
+	return value, 0
+}
+
+// evalCaught evaluates the block and returns a raised error as its result.
+func (vm *VM) evalCaught(block Block) (Value, bool) {
+	return vm.catch(func() Value { return vm.call(block) })
+}
+
+// catch runs f and returns the error it raised or panicked with as its result,
+// the registers are restored on panic. break, continue and return signals are
+// not caught, they keep unwinding.
+func (vm *VM) catch(f func() Value) (result Value, caught bool) {
+	pc, sp, bp, env, feed, depth, frames := vm.pc, vm.sp, vm.bp, vm.env, vm.feed, vm.budget.depth, len(vm.frames)
+	defer func() {
+		if r := recover(); r != nil {
+			vm.env, vm.refs, vm.feed, vm.budget.depth = env, 0, feed, depth
+			vm.frames = vm.frames[:frames]
+			result = vm.recoverError(r, pc, sp, bp)
+		}
+		if vm.raised != 0 && !isSignal(vm.raised) {
+			result, caught = vm.raised, true
+			vm.raised = 0
+		}
+		vm.exhausted = false
+	}()
+	return f(), false
+}
+
+// catchAll is catch for the top of an evaluation, a signal left unconsumed is
+// caught as an error.
+func (vm *VM) catchAll(f func() Value) (Value, bool) {
+	return vm.catch(func() Value {
+		result := f()
+		if vm.raised != 0 && isSignal(vm.raised) {
+			return vm.uncaughtSignal()
+		}
+		return result
+	})
+}
+
+// thrown carries an error out of code which can't return one, it is turned
+// into an error value by recoverError.
+type thrown struct {
+	code    int
+	message string
+}
+
+func throw(code int, message string) {
+	panic(thrown{code: code, message: message})
+}
+
+// recoverError converts a panic into a raised error. The VM registers are
+// restored to the state at the entry point.
+func (vm *VM) recoverError(r interface{}, pc pBlockEntry, sp uint, bp uint) Value {
+	at := vm.at
+	vm.pc, vm.sp, vm.bp = pc, sp, bp
+	vm.at = at
+	switch e := r.(type) {
+	case thrown:
+		return vm.fail(e.code, e.message, 0)
+	case limitExceeded:
+		return vm.fail(ErrLimit, vm.budget.exceeded, 0)
+	case runtime.Error:
+		return vm.fail(ErrInternal, e.Error(), 0)
+	case error:
+		return vm.fail(ErrInternal, e.Error(), 0)
+	default:
+		return vm.fail(ErrInternal, fmt.Sprint(e), 0)
+	}
+}
+
+func errorToString(vm *VM, value Value) string {
+	var result strings.Builder
+	e := value.Error()
+	result.WriteString("Error(")
+	if kind := e.field(vm, "kind"); kind.Kind() == QuoteType {
+		result.WriteString(vm.InverseSymbols[kind.Word().Sym()])
+	}
+	result.WriteString(" ")
+	result.WriteString(vm.ToString(e.field(vm, "code")))
+	result.WriteString("): ")
+	result.WriteString(e.Message(vm))
+	if where := e.field(vm, "where"); where != 0 {
+		result.WriteString(" where: ")
+		result.WriteString(vm.Mold(where))
+	}
+	result.WriteString(" near: ")
+	result.WriteString(vm.Mold(e.field(vm, "near")))
+	if line := e.field(vm, "line"); line != 0 {
+		fmt.Fprintf(&result, " at line %d, column %d", line.Val(), e.field(vm, "column").Val())
+	}
+	return result.String()
+}
@@ -0,0 +1,148 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse(`o: make-object [a: 1 b: "x"] f: fn [n [integer!]] [n] deep: fn [n] [deep add n 1]`))
+
+	for _, test := range []struct {
+		code    string
+		errCode int
+		message string
+	}{
+		{`unknown 5`, ErrNoValue, "word has no value: unknown"},
+		{`add 1 "two"`, ErrType, "add expected number! argument, got string!"},
+		{`either 1 [1] [2]`, ErrType, "either expected logic! argument"},
+		{`add 1 add unknown 2`, ErrNoValue, "unknown"},
+		{`o/c`, ErrNoField, "no field c in path o/c"},
+		{`o/a/b`, ErrType, "can't take b of integer! in path o/a/b"},
+		{`f "x"`, ErrType, "f expected integer! argument n, got string!"},
+		{`x: load-native "core/missing"`, ErrNoFunction, "function not found: core/missing"},
+		{`foreach 1 [] []`, ErrType, "foreach expected word!"},
+		{`deep 1`, ErrInternal, "index out of range"},
+		{`make-object [a: add 1 "b"]`, ErrType, "add expected number!"},
+	} {
+		result, err := vm.Eval(test.code)
+		if err == nil {
+			t.Errorf("%s: expected error, got %s", test.code, vm.ToString(result))
+			continue
+		}
+		e := err.(*ScriptError)
+		if e.Code != test.errCode || !strings.Contains(e.Message, test.message) {
+			t.Errorf("%s: got error %d %q, want %d %q", test.code, e.Code, e.Message, test.errCode, test.message)
+		}
+		if vm.sp != 0 || vm.bp != 0 || vm.pc != 0 || vm.raised != 0 {
+			t.Errorf("%s: registers not restored: sp %d bp %d pc %d", test.code, vm.sp, vm.bp, vm.pc)
+		}
+	}
+
+	if result, err := vm.Eval(`add o/a 41`); err != nil || result != MakeInt(42).Value() {
+		t.Errorf("VM unusable after errors: %v", err)
+	}
+}
+
+func TestErrorFields(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	result, _ := vm.Eval(`print "before" missing 1 2`)
+	e := result.Error()
+	if e.Code(vm) != ErrNoValue {
+		t.Errorf("code = %d, want %d", e.Code(vm), ErrNoValue)
+	}
+	if got := vm.ToString(e.field(vm, "where")); got != "[missing(0) ]" {
+		t.Errorf("where = %s", got)
+	}
+	if got := vm.ToString(e.field(vm, "near")); got != "[missing(0) 1 2 ]" {
+		t.Errorf("near = %s", got)
+	}
+	if kind := e.field(vm, "kind"); vm.InverseSymbols[kind.Word().Sym()] != "script" {
+		t.Errorf("kind = %s", vm.ToString(kind))
+	}
+	want := "Error(script 1): word has no value: missing where: [missing] near: [missing 1 2] at line 1, column 16"
+	if got := vm.ToString(result); got != want {
+		t.Errorf("error text %s, want %s", got, want)
+	}
+}
+
+func TestReadOnlyError(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`b: []`)
+	view := vm.Clone().Fork(make([]Value, 100), 0)
+	_, err := view.Eval(`append b 1`)
+	if err == nil || err.(*ScriptError).Code != ErrReadOnly {
+		t.Errorf("append in view: %v, want read only error", err)
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+
+	for _, test := range []struct {
+		code   string
+		result string
+	}{
+		{`either error? try [missing] [1] [0]`, "1"},
+		{`either error? try [add 1 2] [1] [0]`, "0"},
+		{`try [add 1 2]`, "3"},
+		{`e: try [missing] e/code`, "1"},
+		{`e: try [missing] e/message`, `"word has no value: missing"`},
+		{`e: try [missing 1] e/where`, "[missing(0) ]"},
+		{`attempt [add 1 2]`, "3"},
+		{`catch err [missing] [err/code]`, "1"},
+		{`catch err [add 1 2] [err/code]`, "3"},
+		{`catch err [cause-error 'deploy "node down"] [err/message]`, `"node down"`},
+		{`e: try [cause-error 'deploy "node down"] e/code`, "9"},
+		{`add 1 catch err [add 1 "x"] [41]`, "42"},
+	} {
+		result, err := vm.Eval(test.code)
+		if err != nil {
+			t.Errorf("%s: %v", test.code, err)
+			continue
+		}
+		if got := vm.ToString(result); got != test.result {
+			t.Errorf("%s: got %s, want %s", test.code, got, test.result)
+		}
+		if vm.sp != 0 || vm.bp != 0 || vm.pc != 0 {
+			t.Errorf("%s: registers not restored: sp %d bp %d pc %d", test.code, vm.sp, vm.bp, vm.pc)
+		}
+	}
+
+	if result, err := vm.Eval(`attempt [missing]`); err != nil || result != None {
+		t.Errorf("attempt: got %s, want none", vm.ToString(result))
+	}
+	result, _ := vm.Eval(`e: try [cause-error 'deploy "node down"] e/kind`)
+	if result.Kind() != QuoteType || vm.InverseSymbols[result.Word().Sym()] != "deploy" {
+		t.Errorf("kind = %s, want 'deploy", vm.ToString(result))
+	}
+
+	_, err := vm.Eval(`cause-error 'deploy "node down"`)
+	if err == nil || err.(*ScriptError).Code != ErrUser || !strings.Contains(err.Error(), "node down") {
+		t.Errorf("cause-error: %v", err)
+	}
+	_, err = vm.Eval(`error? missing`)
+	if err == nil || err.(*ScriptError).Code != ErrNoValue {
+		t.Errorf("error? should propagate raised argument: %v", err)
+	}
+}
@@ -0,0 +1,576 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// F U N C T I O N S
+//
+// A function spec is a block of parameters and refinements:
+//
+//   fn ["doc" a [integer!] "doc of a" b /only c /local x y] [...]
+//
+// Every parameter, refinement, refinement parameter and local gets a stack
+// slot, in the order they appear in the spec. A refinement slot holds true
+// when the function is called through a path like f/only, its parameters
+// follow the positional ones in the order of refinements in the path. Slots
+// of unused refinements and locals are none.
+//
+// Frames of functions live on the stack, unless the function makes closures:
+// those get frames in the heap. A function captures the heap frame it was made
+// in, words bound to frames of enclosing functions are reached through the
+// chain of captured frames.
+//
+// PROC
+//-------------------------
+//  STACK SIZE | FUNC | KIND |
+//-------------------------
+
+type param struct {
+	sym   sym
+	types uint64
+}
+
+type refinement struct {
+	sym    sym
+	slot   int
+	params []param
+}
+
+type fnSpec struct {
+	doc         string
+	params      []param
+	refinements []*refinement
+	slots       []sym
+}
+
+// anyType accepts every kind.
+const anyType = 1<<LastType - 1
+
+// typeSets are the type names standing for several kinds in type constraints.
+var typeSets = map[string]uint64{
+	"any-type!": anyType,
+	"number!":   1<<IntegerType | 1<<DecimalType,
+	"any-word!": 1<<WordType | 1<<GetWordType | 1<<SetWordType | 1<<QuoteType,
+}
+
+func (vm *VM) typeSet(name string) (uint64, bool) {
+	if set, ok := typeSets[name]; ok {
+		return set, true
+	}
+	for kind, n := range typeNames {
+		if n == name {
+			return 1 << kind, true
+		}
+	}
+	return 0, false
+}
+
+func typeSetName(types uint64) string {
+	var names []string
+	for kind := 0; kind < LastType; kind++ {
+		if types&(1<<kind) != 0 {
+			names = append(names, typeName(kind))
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+// parseSpec parses a function spec, it returns an error value if the spec is
+// invalid.
+func (vm *VM) parseSpec(spec Block) (*fnSpec, Value) {
+	result := &fnSpec{}
+	invalid := func(format string, args ...interface{}) (*fnSpec, Value) {
+		return nil, vm.fail(ErrType, "invalid fn spec: "+fmt.Sprintf(format, args...), 0)
+	}
+
+	var last *param
+	var ref *refinement
+	locals := false
+	slot := func(sym sym) bool {
+		for _, s := range result.slots {
+			if s == sym {
+				return false
+			}
+		}
+		result.slots = append(result.slots, sym)
+		return true
+	}
+
+	for i := spec.First(vm); i != 0; i = i.Next(vm) {
+		value := i.Value(vm)
+		switch value.Kind() {
+		case StringType:
+			if i == spec.First(vm) {
+				result.doc = value.String().String(vm)
+			}
+		case WordType:
+			sym := value.Word().Sym()
+			if !slot(sym) {
+				return invalid("duplicate %s", vm.InverseSymbols[sym])
+			}
+			last = nil
+			if locals {
+				continue
+			}
+			p := param{sym: sym, types: anyType}
+			if ref != nil {
+				ref.params = append(ref.params, p)
+				last = &ref.params[len(ref.params)-1]
+			} else {
+				result.params = append(result.params, p)
+				last = &result.params[len(result.params)-1]
+			}
+		case BlockType:
+			if last == nil {
+				return invalid("types %s must follow a parameter", vm.Mold(value))
+			}
+			last.types = 0
+			for t := value.Block().First(vm); t != 0; t = t.Next(vm) {
+				name := t.Value(vm)
+				if name.Kind() != WordType {
+					return invalid("bad type %s", vm.Mold(name))
+				}
+				set, ok := vm.typeSet(vm.InverseSymbols[name.Word().Sym()])
+				if !ok {
+					return invalid("unknown type %s", vm.Mold(name))
+				}
+				last.types |= set
+			}
+			last = nil
+		case RefinementType:
+			sym := value.Word().Sym()
+			last = nil
+			if vm.InverseSymbols[sym] == "local" {
+				locals = true
+				continue
+			}
+			if locals {
+				return invalid("refinement %s after /local", vm.Mold(value))
+			}
+			if !slot(sym) {
+				return invalid("duplicate %s", vm.Mold(value))
+			}
+			ref = &refinement{sym: sym, slot: len(result.slots) - 1}
+			result.refinements = append(result.refinements, ref)
+		default:
+			return invalid("unexpected %s", vm.Mold(value))
+		}
+	}
+	return result, 0
+}
+
+// addLoopLocals adds the words of loops in the body to the slots, loops are
+// calls of natives added by AddLoopFunc.
+func (vm *VM) addLoopLocals(spec *fnSpec, body Block) {
+	seen := make(map[pFirstLast]bool)
+	var scan func(block Block)
+	scan = func(block Block) {
+		if seen[block.firstLast()] {
+			return
+		}
+		seen[block.firstLast()] = true
+		for i := block.First(vm); i != 0; i = i.Next(vm) {
+			value := i.Value(vm)
+			switch value.Kind() {
+			case BlockType:
+				scan(value.Block())
+			case WordType:
+				next := i.Next(vm)
+				if next == 0 || next.Value(vm).Kind() != WordType {
+					continue
+				}
+				if vm.isLoop(value.Word()) {
+					spec.addLocal(next.Value(vm).Word().Sym())
+				}
+			}
+		}
+	}
+	scan(body)
+}
+
+// isLoop tells if a word refers to a global native added by AddLoopFunc.
+func (vm *VM) isLoop(w Word) bool {
+	var value Value
+	switch binding := Binding(vm.read(ptr(w.bindings()))); {
+	case binding == 0:
+		sv := vm.Dictionary.Find(vm, w.Sym())
+		if sv == 0 {
+			return false
+		}
+		value = Value(vm.read(ptr(sv.val(vm))))
+	case binding.Kind() == MapBinding:
+		value = vm.getBound[MapBinding](binding)
+	default:
+		return false
+	}
+	return value.Kind() == NativeType && vm.Library.loop(vm.procNames[value.Val()])
+}
+
+func (spec *fnSpec) addLocal(sym sym) {
+	for _, s := range spec.slots {
+		if s == sym {
+			return
+		}
+	}
+	spec.slots = append(spec.slots, sym)
+}
+
+// makesClosures tells if the body creates functions, which capture the frame
+// of the call. Frames of such functions are allocated in the heap.
+func (vm *VM) makesClosures(body Block) bool {
+	fn := vm.GetSymbolID("fn")
+	seen := make(map[pFirstLast]bool)
+	var scan func(block Block) bool
+	scan = func(block Block) bool {
+		if seen[block.firstLast()] {
+			return false
+		}
+		seen[block.firstLast()] = true
+		for i := block.First(vm); i != 0; i = i.Next(vm) {
+			value := i.Value(vm)
+			switch value.Kind() {
+			case BlockType:
+				if scan(value.Block()) {
+					return true
+				}
+			case WordType:
+				if value.Word().Sym() == fn {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return scan(body)
+}
+
+// copyBody copies the block deep. Words and paths get their own binding cells,
+// so binding the copy leaves the original intact.
+func (vm *VM) copyBody(block Block) Block {
+	copies := make(map[pFirstLast]Block)
+	var copy func(block Block) Block
+	copy = func(block Block) Block {
+		if c, ok := copies[block.firstLast()]; ok {
+			return c
+		}
+		result := vm.AllocBlock()
+		copies[block.firstLast()] = result
+		for i := block.First(vm); i != 0; i = i.Next(vm) {
+			value := i.Value(vm)
+			switch kind := value.Kind(); kind {
+			case BlockType:
+				value = copy(value.Block()).Value()
+			case WordType, GetWordType, SetWordType, QuoteType:
+				w := value.Word()
+				value = _makeWord(w.Sym(), pBinding(vm.alloc(vm.read(ptr(w.bindings())))), kind).Value()
+			case PathType, GetPathType, SetPathType:
+				p := value.Path()
+				value = _makePath(pBinding(vm.alloc(vm.read(ptr(p.bindings())))), p.firstLast(), kind).Value()
+			}
+			result.Add(vm, value)
+			if span, ok := vm.spanAt(i); ok {
+				vm.setSpan(firstLast(vm.read(ptr(result.firstLast()))).last(), span)
+			}
+		}
+		return result
+	}
+	return copy(block)
+}
+
+// bindBody binds the words of the body to the slots of the function. In a body
+// of a function with heap frames, words bound to frames of enclosing functions
+// get one level deeper.
+func (vm *VM) bindBody(body Block, slots []sym, heap bool) {
+	seen := make(map[pFirstLast]bool)
+	rebind := func(sym sym, bindings pBinding) {
+		for i, slot := range slots {
+			if slot == sym {
+				if heap {
+					vm.writeBinding(ptr(bindings), makeEnvBinding(0, i))
+				} else {
+					vm.writeBinding(ptr(bindings), MakeStackBinding(i-len(slots)))
+				}
+				return
+			}
+		}
+		binding := Binding(vm.read(ptr(bindings)))
+		if heap && binding != 0 && binding.Kind() == EnvBinding {
+			vm.writeBinding(ptr(bindings), makeEnvBinding(binding.depth()+1, binding.index()))
+		}
+	}
+	var walk func(block Block)
+	walk = func(block Block) {
+		if seen[block.firstLast()] {
+			return
+		}
+		seen[block.firstLast()] = true
+		for i := block.First(vm); i != 0; i = i.Next(vm) {
+			value := i.Value(vm)
+			switch value.Kind() {
+			case BlockType:
+				walk(value.Block())
+			case WordType, GetWordType, SetWordType, QuoteType:
+				rebind(value.Word().Sym(), value.Word().bindings())
+			case PathType, GetPathType, SetPathType:
+				p := value.Path()
+				first := firstLast(vm.read(ptr(p.firstLast()))).first()
+				rebind(sym(first.pval(vm)), p.bindings())
+			}
+		}
+	}
+	walk(body)
+}
+
+// FUNC
+//-------------------------
+//    SPEC     |  BODY  |
+//-------------------------
+//    HEAP     |  ENV   |
+//-------------------------
+
+func (p Proc) fn() ptr { return ptr(obj(p).ptr()) }
+
+func (p Proc) blocks(vm *VM) (spec Block, body Block) {
+	f := item(vm.read(p.fn()))
+	return makeBlock(pFirstLast(f.val())), makeBlock(pFirstLast(f.ptr()))
+}
+
+func (p Proc) closure(vm *VM) (heap bool, env ptr) {
+	c := item(vm.read(p.fn() + 1))
+	return c.val() != 0, c.ptr()
+}
+
+// Body returns the body block of a function.
+func (p Proc) Body(vm *VM) Block {
+	_, body := p.blocks(vm)
+	return body
+}
+
+// spec returns the parsed spec of a proc, specs are parsed once per VM.
+func (vm *VM) spec(p Proc) (*fnSpec, Value) {
+	if spec, ok := vm.specs[p.fn()]; ok {
+		return spec, 0
+	}
+	block, body := p.blocks(vm)
+	spec, err := vm.parseSpec(block)
+	if err != 0 {
+		return nil, err
+	}
+	vm.addLoopLocals(spec, body)
+	vm.specs[p.fn()] = spec
+	return spec, 0
+}
+
+// callName returns the name a function was called by: its word, or its path
+// up to refs, the first of its refinements.
+func (vm *VM) callName(at pBlockEntry, refs pBlockEntry) string {
+	if at == 0 {
+		return "fn"
+	}
+	switch value := at.Value(vm); value.Kind() {
+	case WordType:
+		return vm.InverseSymbols[value.Word().Sym()]
+	case PathType:
+		first := firstLast(vm.read(ptr(value.Path().firstLast()))).first()
+		name := vm.InverseSymbols[sym(first.pval(vm))]
+		for e := first.Next(vm); e != 0 && e != refs; e = e.Next(vm) {
+			name += "/" + vm.InverseSymbols[sym(e.pval(vm))]
+		}
+		return name
+	}
+	return "fn"
+}
+
+func (vm *VM) initSlots(spec *fnSpec, slots []Value) []Value {
+	for range spec.slots {
+		slots = append(slots, None)
+	}
+	for _, ref := range spec.refinements {
+		slots[ref.slot] = MakeBool(false).Value()
+	}
+	return slots
+}
+
+// callProc evaluates the arguments of a proc and runs it. refinements are the
+// path entries following the function in a call like f/only.
+func (vm *VM) callProc(p Proc, refinements pBlockEntry) Value {
+	at := vm.at
+	spec, err := vm.spec(p)
+	if err != 0 {
+		return err
+	}
+
+	var buf [8]Value
+	slots := buf[:0]
+	if len(spec.slots) > len(buf) {
+		slots = make([]Value, 0, len(spec.slots))
+	}
+	slots = vm.initSlots(spec, slots)
+
+	arg := func(slot int, param param) Value {
+		if vm.pc == 0 && len(vm.feed) == 0 {
+			vm.at = at
+			return vm.fail(ErrType, fmt.Sprintf("%s is missing argument %s", vm.callName(at, refinements),
+				vm.InverseSymbols[param.sym]), at.Value(vm))
+		}
+		value := vm.Next()
+		if vm.raised != 0 {
+			return vm.raised
+		}
+		if err := vm.checkArg(at, refinements, param, value); err != 0 {
+			return err
+		}
+		slots[slot] = value
+		return 0
+	}
+
+	for i, param := range spec.params {
+		if err := arg(i, param); err != 0 {
+			return err
+		}
+	}
+	for r := refinements; r != 0; r = r.Next(vm) {
+		sym := sym(r.pval(vm))
+		var ref *refinement
+		for _, r := range spec.refinements {
+			if r.sym == sym {
+				ref = r
+			}
+		}
+		if ref == nil {
+			vm.at = at
+			return vm.fail(ErrNoField, fmt.Sprintf("%s has no refinement /%s", vm.callName(at, refinements), vm.InverseSymbols[sym]), at.Value(vm))
+		}
+		slots[ref.slot] = MakeBool(true).Value()
+		for i, param := range ref.params {
+			if err := arg(ref.slot+1+i, param); err != 0 {
+				return err
+			}
+		}
+	}
+
+	return vm.invoke(p, slots, at, refinements)
+}
+
+// checkArg fails unless the value is of a type the parameter of a function
+// called from at, with refinements from refs, accepts.
+func (vm *VM) checkArg(at pBlockEntry, refs pBlockEntry, param param, value Value) Value {
+	if param.types&(1<<value.Kind()) == 0 {
+		vm.at = at
+		return vm.fail(ErrType, fmt.Sprintf("%s expected %s argument %s, got %s", vm.callName(at, refs),
+			typeSetName(param.types), vm.InverseSymbols[param.sym], typeName(value.Kind())), at.Value(vm))
+	}
+	return 0
+}
+
+// invoke runs the body of a proc with the slots of its frame, at is the word
+// or path it was called by or 0 and refs its refinements.
+func (vm *VM) invoke(p Proc, slots []Value, at pBlockEntry, refs pBlockEntry) Value {
+	heap, env := p.closure(vm)
+	saved := vm.env
+	base := vm.sp
+	if heap {
+		frame := vm.alloc(cell(makeItem(len(slots), env)))
+		for _, value := range slots {
+			vm.alloc(cell(value))
+		}
+		vm.env = frame
+		base = uint(frame)
+	} else {
+		for _, value := range slots {
+			vm.push(value)
+		}
+		vm.env = env
+	}
+
+	var frame *Frame
+	if vm.Hook != nil {
+		spec, _ := vm.spec(p)
+		frame = vm.hookCall(p, at, refs, spec, heap, base)
+	}
+	result := vm.returnedFrom(vm.call(p.Body(vm)))
+	if frame != nil {
+		vm.hookReturn(frame, result)
+	}
+
+	vm.env = saved
+	if !heap {
+		vm.sp -= uint(len(slots))
+	}
+	return result
+}
+
+// Call calls a function with positional arguments, refinements are not set.
+// It is meant for Go code running functions, like request handlers.
+func (vm *VM) Call(p Proc, args ...Value) (Value, error) {
+	result, raised := vm.limited(func() (Value, bool) {
+		return vm.catchAll(func() Value {
+			spec, err := vm.spec(p)
+			if err != 0 {
+				return err
+			}
+			if len(args) != len(spec.params) {
+				return vm.fail(ErrType, fmt.Sprintf("fn expected %d arguments, got %d", len(spec.params), len(args)), 0)
+			}
+			slots := vm.initSlots(spec, make([]Value, 0, len(spec.slots)))
+			copy(slots, args)
+			return vm.invoke(p, slots, 0, 0)
+		})
+	})
+	if raised {
+		return result, vm.scriptError(result)
+	}
+	return result, nil
+}
+
+// fn makes a function. The body is copied, so each function made by the same
+// fn call has its own bindings. A function made while another one runs
+// captures the frame of the running function.
+func fn(vm *VM) Value {
+	p, err := vm.nextArg("fn", BlockType)
+	if err != 0 {
+		return err
+	}
+	c, err := vm.nextArg("fn", BlockType)
+	if err != 0 {
+		return err
+	}
+	params := p.Block()
+	code := c.Block()
+
+	spec, err := vm.parseSpec(params)
+	if err != 0 {
+		return err
+	}
+	vm.addLoopLocals(spec, code)
+	heap := vm.makesClosures(code)
+
+	code = vm.copyBody(code)
+	vm.bindBody(code, spec.slots, heap)
+
+	flag := 0
+	if heap {
+		flag = 1
+	}
+	f := vm.alloc(cell(makeItem(int(params.firstLast()), ptr(code.firstLast()))))
+	vm.alloc(cell(makeItem(flag, vm.env)))
+	vm.specs[f] = spec
+	return makeProc(len(spec.slots), f)
+}
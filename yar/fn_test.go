@@ -0,0 +1,250 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFnSpec(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	_, err := vm.Eval(`
+		local: fn [a /local b] [b: add a 1 b]
+		plus: fn ["adds b when called as plus/with" a [integer!] /with b [integer!] "added"] [
+			either with [add a b] [a]
+		]
+		order: fn [a /x b /y c] [make-object [ra: a rb: b rc: c]]
+		typed: fn [n [number!] s [string! none!]] [s]
+		minus: fn [a b] [sub a b]
+		callsMinus: fn [x] [minus 10 x]
+		counter: 0
+		inc: fn [] [counter: add counter 1]
+		node-info: fn [nodeID nodeName cores cpuModelName /local node] [node: make-object [id: nodeID n-cores: cores]]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		code   string
+		result string
+	}{
+		{`local 1`, "2"},
+		{`b`, "[]"},
+		{`plus 1`, "1"},
+		{`plus/with 1 2`, "3"},
+		{`o: order/y/x 1 2 3 o/rc`, "2"},
+		{`o: order/y/x 1 2 3 o/rb`, "3"},
+		{`o: order/x 1 2 o/rc`, "none"},
+		{`typed 1.5 "s"`, `"s"`},
+		{`typed 1 none`, "none"},
+		{`callsMinus 3`, "7"},
+		{`inc inc counter`, "2"},
+		{`n: node-info 1 "node" 4 "cpu" n/n-cores`, "4"},
+	} {
+		result, err := vm.Eval(test.code)
+		if err != nil {
+			t.Errorf("%s: %v", test.code, err)
+			continue
+		}
+		if got := vm.ToString(result); got != test.result {
+			t.Errorf("%s: got %s, want %s", test.code, got, test.result)
+		}
+	}
+
+	plus, _ := vm.Eval(`:plus`)
+	if spec, _ := vm.spec(Proc(plus)); spec.doc != "adds b when called as plus/with" {
+		t.Errorf("doc = %q", spec.doc)
+	}
+}
+
+func TestFnSpecErrors(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`plus: fn [a [integer!] /with b [integer!]] [a] o: make-object [f: fn [a /with b [integer!]] [a]]`)
+
+	for _, test := range []struct {
+		code    string
+		errCode int
+		message string
+	}{
+		{`plus "1"`, ErrType, "plus expected integer! argument a, got string!"},
+		{`plus/with 1 "2"`, ErrType, "plus expected integer! argument b, got string!"},
+		{`plus/without 1`, ErrNoField, "plus has no refinement /without"},
+		{`o/f/with 1 "2"`, ErrType, "o/f expected integer! argument b, got string!"},
+		{`o/f/with/without 1 2`, ErrNoField, "o/f has no refinement /without"},
+		{`plus`, ErrType, "plus is missing argument a"},
+		{`plus/with 1`, ErrType, "plus is missing argument b"},
+		{`o/f/with 1`, ErrType, "o/f is missing argument b"},
+		{`if true [plus]`, ErrType, "plus is missing argument a"},
+		{`:plus/with`, ErrType, "refinements need a function call: plus/with"},
+		{`fn [a a] []`, ErrType, "invalid fn spec: duplicate a"},
+		{`fn [[integer!]] []`, ErrType, "invalid fn spec: types [integer!] must follow a parameter"},
+		{`fn [a [foo!]] []`, ErrType, "invalid fn spec: unknown type foo!"},
+		{`fn [1] []`, ErrType, "invalid fn spec: unexpected 1"},
+		{`fn [/local a /x] []`, ErrType, "invalid fn spec: refinement /x after /local"},
+	} {
+		_, err := vm.Eval(test.code)
+		if err == nil {
+			t.Errorf("%s: expected error", test.code)
+			continue
+		}
+		e := err.(*ScriptError)
+		if e.Code != test.errCode || !strings.Contains(e.Message, test.message) {
+			t.Errorf("%s: got error %d %q, want %d %q", test.code, e.Code, e.Message, test.errCode, test.message)
+		}
+	}
+
+	result, _ := vm.Eval(`e: try [plus "1"] e/where`)
+	if got := vm.Mold(result); got != "[plus]" {
+		t.Errorf("where = %s", got)
+	}
+}
+
+func TestFnMissingArgs(t *testing.T) {
+	for _, compile := range []bool{false, true} {
+		vm := NewVM(1000, 100)
+		BootVM(vm)
+		vm.Compile = compile
+		result, err := vm.Eval(`f: fn [a b] [b] g: fn [] [f 1] e: try [g] e/message`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := vm.Mold(result); got != `"f is missing argument b"` {
+			t.Errorf("compile %v: got %s", compile, got)
+		}
+	}
+}
+
+func TestLoopLocals(t *testing.T) {
+	pkg := NewPackage("test")
+	pkg.AddLoopFunc("twice", func(vm *VM) Value {
+		w, err := vm.nextWord("twice")
+		if err != 0 {
+			return err
+		}
+		c, err := vm.nextArg("twice", BlockType)
+		if err != 0 {
+			return err
+		}
+		binding, release := vm.loopBinding(w, c.Block())
+		defer release()
+		var result Value
+		for i := 1; i <= 2; i++ {
+			vm.setBound[binding.Kind()](binding, MakeInt(i).Value())
+			var done bool
+			if result, done = vm.loopBody(c.Block()); done {
+				break
+			}
+		}
+		return result
+	})
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Library.Add(pkg)
+	if _, err := vm.Eval(pkg.Script() + `
+		each: :foreach
+		sum: fn [/local s] [s: 0 twice i [s: add s i] s]
+		total: fn [b /local s] [s: 0 each x b [s: add s x] s]
+		plain: fn [f] [f y 1]
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := evalString(t, vm, `add sum total [1 2]`); got != "6" {
+		t.Errorf("got %s", got)
+	}
+	for _, test := range []struct {
+		fn    string
+		word  string
+		local bool
+	}{
+		{"sum", "i", true},
+		{"total", "x", true},
+		{"plain", "y", false},
+	} {
+		p, _ := vm.Eval(":" + test.fn)
+		spec, _ := vm.spec(Proc(p))
+		local := false
+		for _, slot := range spec.slots {
+			local = local || slot == vm.GetSymbolID(test.word)
+		}
+		if local != test.local {
+			t.Errorf("%s: %s local = %v", test.fn, test.word, local)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	_, err := vm.Eval(`
+		make-counter: fn [/local count] [count: 0 fn [] [count: add count 1]]
+		c1: make-counter
+		c2: make-counter
+		adder: fn [a] [fn [b] [add a b]]
+		add2: adder 2
+		add5: adder 5
+		apply-to: fn [f x] [f x]
+		nest: fn [a] [fn [b] [fn [c] [add a add b c]]]
+		pow2: fn [n /local r] [r: 0 repeat i n [r: add r pow2 i] add r 1]
+		sum-all: fn [b /local total] [total: 0 foreach x b [total: add total x] total]
+		safe: fn [x] [catch e [cause-error 'user "failed"] [x]]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		code   string
+		result string
+	}{
+		{`c1 c1 c1`, "3"},
+		{`c2`, "1"},
+		{`add2 1`, "3"},
+		{`add5 1`, "6"},
+		{`apply-to :add2 10`, "12"},
+		{`f: nest 1 g: f 10 g 100`, "111"},
+		{`pow2 5`, "32"},
+		{`sum-all [1 2 3]`, "6"},
+		{`safe 7`, "7"},
+		{`count`, "[]"},
+	} {
+		result, err := vm.Eval(test.code)
+		if err != nil {
+			t.Errorf("%s: %v", test.code, err)
+			continue
+		}
+		if got := vm.ToString(result); got != test.result {
+			t.Errorf("%s: got %s, want %s", test.code, got, test.result)
+		}
+	}
+
+	vm.GC()
+	if result, err := vm.Eval(`c1`); err != nil || vm.ToString(result) != "4" {
+		t.Errorf("c1 after gc: %v %v", vm.ToString(result), err)
+	}
+
+	add2, _ := vm.Eval(`:add2`)
+	if result, err := vm.Call(Proc(add2), MakeInt(40).Value()); err != nil || result.Val() != 42 {
+		t.Errorf("call add2: %v %v", result, err)
+	}
+	if _, err := vm.Call(Proc(add2)); err == nil {
+		t.Errorf("call add2 without arguments succeeded")
+	}
+}
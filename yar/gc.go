@@ -0,0 +1,344 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+// G A R B A G E   C O L L E C T O R
+//
+// A copying collector. Cells don't carry their layout, so reachable values are
+// copied type by type starting from the roots: the dictionary, the live part of
+// the stack and the bind stack, and whatever values the caller still holds.
+// Every copied cell leaves a forwarding address, which keeps sharing and cycles
+// intact. Natives keep pointers in Go variables the collector can't see, so it
+// only runs between evaluations. The collected heap goes into fresh pages,
+// views taken before keep the old ones.
+
+type gcState struct {
+	initial     int
+	threshold   int
+	live        int
+	collections int
+	collected   int
+}
+
+func newGCState(initial int) gcState {
+	return gcState{initial: initial, threshold: initial}
+}
+
+// HeapStats describes the heap of a VM.
+type HeapStats struct {
+	// Cells allocated so far, including garbage.
+	Cells int
+	// Pages of memory backing the heap.
+	Pages int
+	// Live cells left by the last collection.
+	Live int
+	// Threshold of allocated cells for the next collection by MaybeGC.
+	Threshold   int
+	Collections int
+	// Collected is the total number of cells reclaimed.
+	Collected int
+}
+
+// HeapStats returns heap statistics.
+func (vm *VM) HeapStats() HeapStats {
+	return HeapStats{
+		Cells:       int(vm.top),
+		Pages:       len(vm.mem.pages),
+		Live:        vm.gc.live,
+		Threshold:   vm.gc.threshold,
+		Collections: vm.gc.collections,
+		Collected:   vm.gc.collected,
+	}
+}
+
+// MaybeGC collects garbage once the heap has grown past the threshold, the
+// threshold is then set to twice the live heap. It does nothing while a
+// transaction is open. See GC for roots.
+func (vm *VM) MaybeGC(roots ...*Value) bool {
+	if int(vm.top) < vm.gc.threshold || vm.journal != nil {
+		return false
+	}
+	vm.GC(roots...)
+	return true
+}
+
+// GC collects garbage. Values reachable from the given roots survive and the
+// roots are updated in place, any other Value held outside of the VM is invalid
+// after the call. GC must not be called while the VM is evaluating code or a
+// transaction is open.
+func (vm *VM) GC(roots ...*Value) {
+	if vm.readOnly {
+		panic("gc in read only mode")
+	}
+	if vm.pc != 0 {
+		panic("gc during evaluation")
+	}
+	if vm.journal != nil {
+		panic("gc in a transaction")
+	}
+
+	c := &collector{vm: vm, forward: make(map[ptr]ptr)}
+	vm.Dictionary = c.value(vm.Dictionary.Value()).Dict()
+	vm.modules = c.value(vm.modules.Value()).Dict()
+	vm.moduleFiles = c.value(vm.moduleFiles.Value()).Dict()
+	for i := uint(0); i < vm.sp; i++ {
+		vm.stack[i] = c.value(vm.stack[i])
+	}
+	for i := uint(0); i < vm.bp; i++ {
+		vm.bindStack[i] = c.value(vm.bindStack[i])
+	}
+	for _, root := range roots {
+		*root = c.value(*root)
+	}
+	vm.env = c.env(vm.env)
+
+	vm.gc.collections++
+	vm.gc.collected += int(vm.top - uint(c.top))
+	vm.gc.live = int(c.top)
+	vm.gc.threshold = 2 * vm.gc.live
+	if vm.gc.threshold < vm.gc.initial {
+		vm.gc.threshold = vm.gc.initial
+	}
+
+	vm.mem = c.to
+	vm.top = uint(c.top)
+	vm.spans = c.spans()
+	vm.specs = make(map[ptr]*fnSpec)
+	vm.resetCode()
+	vm.sharedMaps = false
+	vm.at = 0
+}
+
+type collector struct {
+	vm      *VM
+	to      memory
+	top     ptr
+	forward map[ptr]ptr
+}
+
+// spans returns the spans of the entries that survived.
+func (c *collector) spans() map[pBlockEntry]Span {
+	spans := make(map[pBlockEntry]Span)
+	for entry, span := range c.vm.spans {
+		if q, ok := c.forward[ptr(entry)]; ok {
+			spans[pBlockEntry(q)] = span
+		}
+	}
+	return spans
+}
+
+func (c *collector) alloc() ptr {
+	c.top++
+	c.to.write(c.top, 0)
+	return c.top
+}
+
+// copy moves the cell at p once, its content is produced by f after the
+// forwarding address is set, so f may reach p again.
+func (c *collector) copy(p ptr, f func(old cell) cell) ptr {
+	if p == 0 {
+		return 0
+	}
+	if q, ok := c.forward[p]; ok {
+		return q
+	}
+	q := c.alloc()
+	c.forward[p] = q
+	c.to.write(q, f(c.vm.read(p)))
+	return q
+}
+
+// copyRange moves n cells starting at p, like copy does for one cell.
+func (c *collector) copyRange(p ptr, n int, f func(i int, old cell) cell) ptr {
+	if p == 0 {
+		return 0
+	}
+	if q, ok := c.forward[p]; ok {
+		return q
+	}
+	q := c.alloc()
+	for i := 1; i < n; i++ {
+		c.alloc()
+	}
+	c.forward[p] = q
+	for i := 0; i < n; i++ {
+		c.to.write(q+ptr(i), f(i, c.vm.read(p+ptr(i))))
+	}
+	return q
+}
+
+// text copies a text cell and its data.
+func (c *collector) text(p ptr) ptr {
+	return c.copy(p, func(old cell) cell {
+		t := item(old)
+		data := c.copyRange(t.ptr(), textCells(t.val()), func(i int, old cell) cell { return old })
+		return cell(makeItem(t.val(), data))
+	})
+}
+
+// env copies a heap frame and the frames enclosing it.
+func (c *collector) env(p ptr) ptr {
+	if p == 0 {
+		return 0
+	}
+	size := item(c.vm.read(p)).val()
+	return c.copyRange(p, size+1, func(i int, old cell) cell {
+		if i == 0 {
+			return cell(makeItem(size, c.env(item(old).ptr())))
+		}
+		return cell(c.value(Value(old)))
+	})
+}
+
+func (c *collector) valueCell(p ptr) ptr {
+	return c.copy(p, func(old cell) cell { return cell(c.value(Value(old))) })
+}
+
+// entries copies a chain of block entries, values are copied by f.
+func (c *collector) entries(first pBlockEntry, f func(pval ptr) ptr) pBlockEntry {
+	var head, prev ptr
+	for i := first; i != 0; i = i.Next(c.vm) {
+		if q, ok := c.forward[ptr(i)]; ok {
+			// shared tail, a proc body is the tail of its code block
+			if prev == 0 {
+				head = q
+			} else {
+				c.link(prev, q)
+			}
+			break
+		}
+		q := c.alloc()
+		c.forward[ptr(i)] = q
+		c.to.write(q, cell(makeItem(int(f(i.pval(c.vm))), 0)))
+		if prev == 0 {
+			head = q
+		} else {
+			c.link(prev, q)
+		}
+		prev = q
+	}
+	return pBlockEntry(head)
+}
+
+func (c *collector) link(entry ptr, next ptr) {
+	old := item(c.to.read(entry))
+	c.to.write(entry, cell(makeItem(old.val(), next)))
+}
+
+func (c *collector) firstLast(p pFirstLast, f func(pval ptr) ptr) pFirstLast {
+	return pFirstLast(c.copy(ptr(p), func(old cell) cell {
+		fl := firstLast(old)
+		first := c.entries(fl.first(), f)
+		last := pBlockEntry(c.forward[ptr(fl.last())])
+		return cell(makeFirstLast(first, last))
+	}))
+}
+
+func (c *collector) binding(p pBinding) pBinding {
+	return pBinding(c.copy(ptr(p), func(old cell) cell {
+		binding := Binding(old)
+		if binding != 0 && binding.Kind() == MapBinding {
+			return cell(makeMapBinding(c.symval(ptr(binding.Val()))))
+		}
+		return old
+	}))
+}
+
+func (c *collector) symval(p ptr) ptr {
+	return c.copy(p, func(old cell) cell {
+		sv := symval(old)
+		return cell(makeSymval(sv.sym(), c.valueCell(sv.val())))
+	})
+}
+
+func (c *collector) dict(p pDictFirst) pDictFirst {
+	return pDictFirst(c.copy(ptr(p), func(old cell) cell {
+		d := dictFirst(old)
+		var head, prev ptr
+		for i := d.first(); i != 0; i = i.next(c.vm) {
+			q := c.alloc()
+			c.forward[ptr(i)] = q
+			c.to.write(q, cell(makeItem(int(c.symval(ptr(i.symval(c.vm)))), 0)))
+			if prev == 0 {
+				head = q
+			} else {
+				c.link(prev, q)
+			}
+			prev = q
+		}
+		if head == 0 {
+			return old
+		}
+		return cell(makeDictFirst(c.index(d.index()), pDictEntry(head)))
+	}))
+}
+
+// index copies a dictionary index after its entries, slots depend on symbols
+// only so they keep their places.
+func (c *collector) index(p ptr) ptr {
+	if p == 0 {
+		return 0
+	}
+	capacity := item(c.vm.read(p + 1)).val()
+	return c.copyRange(p, capacity+2, func(i int, old cell) cell {
+		switch {
+		case i == 0:
+			return cell(makeItem(item(old).val(), c.forward[item(old).ptr()]))
+		case i == 1 || old == 0:
+			return old
+		}
+		return cell(c.symval(ptr(old)))
+	})
+}
+
+func (c *collector) value(value Value) Value {
+	switch kind := value.Kind(); kind {
+	case BlockType:
+		block := value.Block()
+		return makeBlock(c.firstLast(block.firstLast(), c.valueCell)).at(block.Index()).Value()
+	case WordType, GetWordType, SetWordType, QuoteType, RefinementType:
+		w := value.Word()
+		return _makeWord(w.Sym(), c.binding(w.bindings()), kind).Value()
+	case PathType, GetPathType, SetPathType:
+		p := value.Path()
+		syms := func(pval ptr) ptr { return pval }
+		return _makePath(c.binding(p.bindings()), c.firstLast(p.firstLast(), syms), kind).Value()
+	case MapType:
+		return makeDict(c.dict(value.Dict().dictFirst())).Value()
+	case ErrorType:
+		return makeValue(int(c.dict(value.Dict().dictFirst())), ErrorType)
+	case ProcType:
+		p := Proc(value)
+		return makeProc(p.StackSize(), c.copyRange(p.fn(), 2, func(i int, old cell) cell {
+			f := item(old)
+			if i == 1 {
+				return cell(makeItem(f.val(), c.env(f.ptr())))
+			}
+			spec := c.firstLast(pFirstLast(f.val()), c.valueCell)
+			body := c.firstLast(pFirstLast(f.ptr()), c.valueCell)
+			return cell(makeItem(int(spec), ptr(body)))
+		}))
+	case StringType, IssueType, FileType, UrlType:
+		index := value.Val() >> textBits
+		return makeValue(index<<textBits|int(c.text(value.text())), kind)
+	case HostPortType:
+		return makeValue(value.Port()<<hostBits|int(c.text(value.hostText())), kind)
+	case DecimalType:
+		return makeValue(int(c.copy(ptr(value.Val()), func(old cell) cell { return old })), DecimalType)
+	default:
+		return value
+	}
+}
@@ -0,0 +1,108 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import "testing"
+
+func TestGC(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse(`
+		o: make-object [a: 1 b: "two" nested: make-object [c: [x y "z"]]]
+		sum: fn [n] [either gt n 1 [add n sum sub n 1] [n]]
+		items: []
+		append items items
+		ref: in o 'a
+	`))
+	before := vm.Hash()
+	for i := 0; i < 20; i++ {
+		vm.BindAndExec(vm.MustParse(`o/a: add o/a 1 append o/nested/c "garbage" x: "temporary"`))
+	}
+	vm.BindAndExec(vm.MustParse(`o/a: 1`))
+	keep := vm.MustParse("sum 10").Value()
+	allocated := vm.HeapStats().Cells
+	vm.GC(&keep)
+
+	stats := vm.HeapStats()
+	if stats.Cells >= allocated || stats.Collections != 1 || stats.Collected != allocated-stats.Cells {
+		t.Errorf("unexpected stats after collection: %+v (allocated %d)", stats, allocated)
+	}
+	if result := vm.BindAndExec(keep.Block()); result != MakeInt(55).Value() {
+		t.Errorf("sum 10 = %s, want 55", vm.ToString(result))
+	}
+	if result := vm.BindAndExec(vm.MustParse("get ref")); result != MakeInt(1).Value() {
+		t.Errorf("get ref = %s, want 1", vm.ToString(result))
+	}
+
+	vm.BindAndExec(vm.MustParse(`o/nested/c: [x y "z"] x: none`))
+	vm.GC()
+	vm2 := NewVM(1000, 100)
+	BootVM(vm2)
+	vm2.BindAndExec(vm2.MustParse(`
+		o: make-object [a: 1 b: "two" nested: make-object [c: [x y "z"]]]
+		sum: fn [n] [either gt n 1 [add n sum sub n 1] [n]]
+		items: []
+		append items items
+		ref: in o 'a
+		x: none
+	`))
+	if vm.Hash() != vm2.Hash() {
+		t.Error("collected heap differs from a fresh one")
+	}
+	if before == vm.Hash() {
+		t.Error("hash expected to change with x set")
+	}
+	if result := vm.BindAndExec(vm.MustParse(`o/b`)); result.Text(vm) != "two" {
+		t.Errorf("o/b after collection = %s, want \"two\"", vm.ToString(result))
+	}
+}
+
+func TestGCKeepsViews(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse(`counter: 41`))
+	view := vm.Clone()
+	vm.BindAndExec(vm.MustParse(`counter: 0`))
+	vm.GC()
+
+	fork := view.Fork(make([]Value, 100), 0)
+	if result := fork.BindAndExec(fork.MustParse("add counter 1")); result != MakeInt(42).Value() {
+		t.Errorf("view after collection = %s, want 42", fork.ToString(result))
+	}
+}
+
+func TestHeapGrowth(t *testing.T) {
+	vm := NewVM(100, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse(`items: []`))
+	step := vm.MustParse(`append items "x" garbage: [1 2 3 4 5]`).Value()
+	for i := 0; i < 5000; i++ {
+		vm.BindAndExec(step.Block())
+		vm.MaybeGC(&step)
+	}
+	stats := vm.HeapStats()
+	if stats.Collections == 0 || stats.Cells > 2*stats.Threshold {
+		t.Errorf("unexpected heap stats: %+v", stats)
+	}
+	n := 0
+	items := vm.BindAndExec(vm.MustParse("items")).Block()
+	for i := items.First(vm); i != 0; i = i.Next(vm) {
+		n++
+	}
+	if n != 5000 {
+		t.Errorf("items = %d, want 5000", n)
+	}
+}
@@ -0,0 +1,410 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// AddGoFunc adds a Go function as a native. Its arguments are evaluated in
+// order and converted to the types of the parameters, the results are
+// converted back:
+//
+//	int, uint and sized ints     integer!
+//	float32, float64             decimal!, an integer! argument is accepted
+//	string                       string!
+//	bool                         logic!
+//	[]T                          block!
+//	map[string]T                 object!
+//	struct, *struct              object! with a word per exported field
+//	Value                        any value, not converted
+//
+// Integers that don't fit the Go type of a parameter, or the 56 bits of an
+// integer! for a result, raise a math error.
+//
+// A leading *VM parameter receives the VM and takes no argument. A function
+// returning nothing returns none, one returning several values returns a
+// block of them. A last error result is raised as a user error when not nil.
+// Struct fields are named by their yar tag, or by the field name with its
+// first letter lowercased; fields tagged "-" are skipped.
+//
+// AddGoFunc panics when fn is not a function or uses other types.
+func (p *Pkg) AddGoFunc(name string, fn interface{}) {
+	f := reflect.ValueOf(fn)
+	t := f.Type()
+	if t.Kind() != reflect.Func || t.IsVariadic() {
+		panic(fmt.Sprintf("yar: %s/%s: not a function of fixed arity: %s", p.name, name, t))
+	}
+	in := make([]reflect.Type, t.NumIn())
+	for i := range in {
+		in[i] = t.In(i)
+		if i == 0 && in[i] == vmType {
+			continue
+		}
+		if err := checkGoType(in[i], map[reflect.Type]bool{}); err != nil {
+			panic(fmt.Sprintf("yar: %s/%s: %v", p.name, name, err))
+		}
+	}
+	results := t.NumOut()
+	raises := results > 0 && t.Out(results-1) == errorType
+	if raises {
+		results--
+	}
+	for i := 0; i < results; i++ {
+		if err := checkGoType(t.Out(i), map[reflect.Type]bool{}); err != nil {
+			panic(fmt.Sprintf("yar: %s/%s: %v", p.name, name, err))
+		}
+	}
+
+	arity := len(in)
+	if arity > 0 && in[0] == vmType {
+		arity--
+	}
+	p.AddFunc(name, func(vm *VM) Value {
+		args := make([]reflect.Value, len(in))
+		for i, t := range in {
+			if i == 0 && t == vmType {
+				args[i] = reflect.ValueOf(vm)
+				continue
+			}
+			value, err := vm.nextAny()
+			if err != 0 {
+				return err
+			}
+			arg, e := vm.toGo(value, t)
+			if e == errOverflow {
+				return vm.fail(ErrMath, name+": integer overflow", 0)
+			}
+			if e != nil {
+				return vm.typeError(name, goTypeName(t), value)
+			}
+			args[i] = arg
+		}
+
+		out := f.Call(args)
+		if raises {
+			if err := out[results]; !err.IsNil() {
+				return vm.fail(ErrUser, err.Interface().(error).Error(), 0)
+			}
+		}
+		switch results {
+		case 0:
+			return None
+		case 1:
+			return vm.fromGo(name, out[0], make(map[goRef]bool))
+		}
+		block := vm.AllocBlock()
+		for _, result := range out[:results] {
+			value := vm.fromGo(name, result, make(map[goRef]bool))
+			if vm.raised != 0 {
+				return vm.raised
+			}
+			block.Add(vm, value)
+		}
+		return block.Value()
+	})
+	p.arity[name] = arity
+}
+
+var (
+	vmType    = reflect.TypeOf((*VM)(nil))
+	valueType = reflect.TypeOf(Value(0))
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+	errMismatch = errors.New("kind mismatch")
+	errOverflow = errors.New("integer overflow")
+)
+
+func checkGoType(t reflect.Type, seen map[reflect.Type]bool) error {
+	if t == valueType || seen[t] {
+		return nil
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool:
+		return nil
+	case reflect.Slice:
+		return checkGoType(t.Elem(), seen)
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", t)
+		}
+		return checkGoType(t.Elem(), seen)
+	case reflect.Ptr:
+		if t.Elem().Kind() != reflect.Struct {
+			return fmt.Errorf("unsupported type %s", t)
+		}
+		return checkGoType(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				if err := checkGoType(f.Type, seen); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported type %s", t)
+}
+
+func goTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return "decimal!"
+	case reflect.String:
+		return "string!"
+	case reflect.Bool:
+		return "logic!"
+	case reflect.Slice:
+		return "block!"
+	case reflect.Map, reflect.Struct, reflect.Ptr:
+		return "object!"
+	}
+	return "integer!"
+}
+
+// fieldName returns the word of a struct field, "" when it is not converted.
+func fieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	if tag, ok := f.Tag.Lookup("yar"); ok {
+		if tag == "-" {
+			return ""
+		}
+		return tag
+	}
+	r, n := utf8.DecodeRuneInString(f.Name)
+	return string(unicode.ToLower(r)) + f.Name[n:]
+}
+
+// toGo converts a value to the Go type. It returns errMismatch when the kind of
+// the value, or of a value in it, doesn't match and errOverflow when an
+// integer doesn't fit.
+func (vm *VM) toGo(value Value, t reflect.Type) (reflect.Value, error) {
+	if t == valueType {
+		return reflect.ValueOf(value), nil
+	}
+	result := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Kind() != IntegerType {
+			return result, errMismatch
+		}
+		if result.OverflowInt(int64(value.Val())) {
+			return result, errOverflow
+		}
+		result.SetInt(int64(value.Val()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if value.Kind() != IntegerType {
+			return result, errMismatch
+		}
+		if value.Val() < 0 || result.OverflowUint(uint64(value.Val())) {
+			return result, errOverflow
+		}
+		result.SetUint(uint64(value.Val()))
+	case reflect.Float32, reflect.Float64:
+		switch value.Kind() {
+		case DecimalType:
+			result.SetFloat(value.Decimal(vm))
+		case IntegerType:
+			result.SetFloat(float64(value.Val()))
+		default:
+			return result, errMismatch
+		}
+	case reflect.String:
+		if value.Kind() != StringType {
+			return result, errMismatch
+		}
+		result.SetString(value.String().String(vm))
+	case reflect.Bool:
+		if value.Kind() != BooleanType {
+			return result, errMismatch
+		}
+		result.SetBool(value.Bool().Val())
+	case reflect.Slice:
+		if value.Kind() != BlockType {
+			return result, errMismatch
+		}
+		result = reflect.MakeSlice(t, 0, 0)
+		for i := value.Block().First(vm); i != 0; i = i.Next(vm) {
+			elem, e := vm.toGo(i.Value(vm), t.Elem())
+			if e != nil {
+				return result, e
+			}
+			result = reflect.Append(result, elem)
+		}
+	case reflect.Map:
+		if value.Kind() != MapType {
+			return result, errMismatch
+		}
+		result = reflect.MakeMap(t)
+		d := dictFirst(vm.read(ptr(value.Dict().dictFirst())))
+		for e := d.first(); e != 0; e = e.next(vm) {
+			sv := e.symval(vm)
+			field := Value(vm.read(ptr(sv.val(vm))))
+			if field == 0 {
+				continue
+			}
+			elem, e := vm.toGo(field, t.Elem())
+			if e != nil {
+				return result, e
+			}
+			result.SetMapIndex(reflect.ValueOf(vm.InverseSymbols[sv.sym(vm)]).Convert(t.Key()), elem)
+		}
+	case reflect.Ptr:
+		if value == None {
+			return result, nil
+		}
+		elem, e := vm.toGo(value, t.Elem())
+		if e != nil {
+			return result, e
+		}
+		result = reflect.New(t.Elem())
+		result.Elem().Set(elem)
+	case reflect.Struct:
+		if value.Kind() != MapType {
+			return result, errMismatch
+		}
+		for i := 0; i < t.NumField(); i++ {
+			name := fieldName(t.Field(i))
+			if name == "" {
+				continue
+			}
+			field := vm.field(value.Dict(), name)
+			if field == 0 {
+				continue
+			}
+			elem, e := vm.toGo(field, t.Field(i).Type)
+			if e != nil {
+				return result, e
+			}
+			result.Field(i).Set(elem)
+		}
+	}
+	return result, nil
+}
+
+// goRef identifies a slice, map or pointer fromGo is converting.
+type goRef struct {
+	kind reflect.Kind
+	ptr  uintptr
+	len  int
+}
+
+// fromGo converts a Go value of a type accepted by AddGoFunc, returned by the
+// native, to a value. Map keys are sorted, so the result doesn't depend on the
+// order Go iterates them. seen holds the slices, maps and pointers being
+// converted, a value reaching one of them again is cyclic and raises.
+func (vm *VM) fromGo(native string, v reflect.Value, seen map[goRef]bool) Value {
+	if v.Type() == valueType {
+		return v.Interface().(Value)
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Ptr:
+		if v.IsNil() {
+			break
+		}
+		ref := goRef{kind: v.Kind(), ptr: v.Pointer()}
+		if ref.kind != reflect.Ptr {
+			ref.len = v.Len()
+		}
+		if seen[ref] {
+			return vm.fail(ErrType, native+": cyclic value of type "+v.Type().String(), 0)
+		}
+		seen[ref] = true
+		defer delete(seen, ref)
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i <= maxInt && i >= -maxInt {
+			return MakeInt(int(i)).Value()
+		}
+		return vm.fail(ErrMath, native+": integer overflow", 0)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i := v.Uint(); i <= maxInt {
+			return MakeInt(int(i)).Value()
+		}
+		return vm.fail(ErrMath, native+": integer overflow", 0)
+	case reflect.Float32, reflect.Float64:
+		return vm.AllocDecimal(v.Float())
+	case reflect.String:
+		return vm.AllocString(v.String()).Value()
+	case reflect.Bool:
+		return MakeBool(v.Bool()).Value()
+	case reflect.Slice:
+		block := vm.AllocBlock()
+		for i := 0; i < v.Len(); i++ {
+			value := vm.fromGo(native, v.Index(i), seen)
+			if vm.raised != 0 {
+				return vm.raised
+			}
+			block.Add(vm, value)
+		}
+		return block.Value()
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		object := vm.AllocDict()
+		for _, key := range keys {
+			value := vm.fromGo(native, v.MapIndex(key), seen)
+			if vm.raised != 0 {
+				return vm.raised
+			}
+			object.Put(vm, vm.GetSymbolID(key.String()), value)
+		}
+		return object.Value()
+	case reflect.Ptr:
+		if v.IsNil() {
+			return None
+		}
+		return vm.fromGo(native, v.Elem(), seen)
+	case reflect.Struct:
+		object := vm.AllocDict()
+		for i := 0; i < v.NumField(); i++ {
+			name := fieldName(v.Type().Field(i))
+			if name == "" {
+				continue
+			}
+			value := vm.fromGo(native, v.Field(i), seen)
+			if vm.raised != 0 {
+				return vm.raised
+			}
+			object.Put(vm, vm.GetSymbolID(name), value)
+		}
+		return object.Value()
+	}
+	panic("yar: unsupported type " + v.Type().String())
+}
+
+// Script returns the loader of the package, setting a word to each of its
+// natives in the order they were added.
+func (p *Pkg) Script() string {
+	var b strings.Builder
+	for _, name := range p.names {
+		fmt.Fprintf(&b, "%s: load-native %s\n", name, escape(p.name+"/"+name))
+	}
+	return b.String()
+}
@@ -0,0 +1,231 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testNode struct {
+	Addr     string
+	CPUs     int `yar:"cpus"`
+	Tags     []string
+	Labels   map[string]string
+	internal int
+	Skipped  bool `yar:"-"`
+}
+
+type testLink struct {
+	Name string
+	Next *testLink
+}
+
+type testPair struct {
+	A, B *testLink
+}
+
+type testList []testList
+
+func goFuncVM(t *testing.T, compile bool) *VM {
+	pkg := NewPackage("test")
+	pkg.AddGoFunc("add3", func(a, b, c int) int { return a + b + c })
+	pkg.AddGoFunc("greet", func(name string, loud bool) string {
+		if loud {
+			return strings.ToUpper("hello " + name)
+		}
+		return "hello " + name
+	})
+	pkg.AddGoFunc("half", func(x float64) float64 { return x / 2 })
+	pkg.AddGoFunc("sum", func(xs []int) int {
+		total := 0
+		for _, x := range xs {
+			total += x
+		}
+		return total
+	})
+	pkg.AddGoFunc("keys", func(m map[string]int) []string {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		return keys
+	})
+	pkg.AddGoFunc("counts", func(words []string) map[string]int {
+		counts := map[string]int{}
+		for _, w := range words {
+			counts[w]++
+		}
+		return counts
+	})
+	pkg.AddGoFunc("scale", func(n testNode, factor int) *testNode {
+		n.CPUs *= factor
+		n.Tags = append(n.Tags, "scaled")
+		return &n
+	})
+	pkg.AddGoFunc("divmod", func(a, b int) (int, int, error) {
+		if b == 0 {
+			return 0, 0, errors.New("division by zero")
+		}
+		return a / b, a % b, nil
+	})
+	pkg.AddGoFunc("kind", func(vm *VM, v Value) string { return typeName(v.Kind()) })
+	pkg.AddGoFunc("nothing", func() {})
+	pkg.AddGoFunc("ring", func() *testLink {
+		a := &testLink{Name: "a"}
+		a.Next = &testLink{Name: "b", Next: a}
+		return a
+	})
+	pkg.AddGoFunc("shared", func() testPair {
+		l := &testLink{Name: "l"}
+		return testPair{l, l}
+	})
+	pkg.AddGoFunc("nested", func() testList {
+		l := testList{nil}
+		l[0] = l
+		return l
+	})
+	pkg.AddGoFunc("int8", func(x int8) int8 { return x })
+	pkg.AddGoFunc("uint8", func(x uint8) uint8 { return x })
+	pkg.AddGoFunc("uint64", func(x uint64) uint64 { return x })
+	pkg.AddGoFunc("shift", func(x uint) (int64, uint64) { return int64(1) << x, uint64(1) << x })
+	pkg.AddGoFunc("shifts", func(x uint) []int64 { return []int64{1, -int64(1) << x} })
+	pkg.AddGoFunc("big", func() map[string]uint64 { return map[string]uint64{"a": 1, "b": 1 << 63} })
+
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Library.Add(pkg)
+	vm.Compile = compile
+	if _, err := vm.Eval(pkg.Script()); err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+func TestGoFunc(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{`add3 1 2 3`, `6`},
+		{`add3 1 2 3 + 1`, `7`},
+		{`greet "yar" true`, `"HELLO YAR"`},
+		{`half 3`, `1.5`},
+		{`sum [1 2 3 4]`, `10`},
+		{`sum []`, `0`},
+		{`keys make-object [a: 1]`, `["a" ]`},
+		{`mold counts ["a" "b" "a"]`, `"make-object [a: 2 b: 1]"`},
+		{`n: scale make-object [addr: "h:1" cpus: 2 tags: ["x"] skipped: true] 3 reduce [n/addr n/cpus n/tags n/labels]`, `["h:1" 6 ["x" "scaled" ] [] ]`},
+		{`divmod 7 2`, `[3 1 ]`},
+		{`kind [1]`, `"block!"`},
+		{`mold nothing`, `"none"`},
+		{`reduce [int8 127 int8 -128 uint8 255 uint64 0]`, `[127 -128 255 0 ]`},
+		{`shift 54`, `[18014398509481984 18014398509481984 ]`},
+		{`shifts 54`, `[1 -18014398509481984 ]`},
+		{`p: shared reduce [p/a/name p/b/name]`, `["l" "l" ]`},
+	}
+	for _, compile := range []bool{false, true} {
+		vm := goFuncVM(t, compile)
+		for _, test := range tests {
+			result, err := vm.Eval(test.code)
+			if err != nil {
+				t.Errorf("%s: %v", test.code, err)
+				continue
+			}
+			if got := vm.ToString(result); got != test.want {
+				t.Errorf("%s = %s, want %s", test.code, got, test.want)
+			}
+		}
+	}
+}
+
+func TestGoFuncErrors(t *testing.T) {
+	vm := goFuncVM(t, false)
+	tests := []struct {
+		code string
+		want string
+	}{
+		{`divmod 1 0`, "division by zero"},
+		{`add3 1 "2" 3`, "add3 expected integer! argument, got string!"},
+		{`sum [1 "x"]`, "sum expected block! argument, got block!"},
+		{`scale make-object [cpus: "x"] 1`, "scale expected object! argument, got object!"},
+		{`int8 128`, "int8: integer overflow"},
+		{`int8 -129`, "int8: integer overflow"},
+		{`uint8 256`, "uint8: integer overflow"},
+		{`uint64 -1`, "uint64: integer overflow"},
+		{`shift 55`, "shift: integer overflow"},
+		{`shifts 55`, "shifts: integer overflow"},
+		{`big`, "big: integer overflow"},
+		{`ring`, "ring: cyclic value of type *yar.testLink"},
+		{`nested`, "nested: cyclic value of type yar.testList"},
+	}
+	for _, test := range tests {
+		_, err := vm.Eval(test.code)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %s", test.code, err, test.want)
+			continue
+		}
+		if code := err.(*ScriptError).Code; strings.Contains(test.want, "overflow") && code != ErrMath {
+			t.Errorf("%s: got error code %d, want %d", test.code, code, ErrMath)
+		}
+	}
+	if _, err := vm.Eval(`catch e [divmod 1 0] [e/code]`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddGoFuncPanics(t *testing.T) {
+	for _, fn := range []interface{}{
+		42,
+		func(xs ...int) {},
+		func(c chan int) {},
+		func(m map[int]int) {},
+		func() *int { return nil },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("no panic adding %T", fn)
+				}
+			}()
+			NewPackage("test").AddGoFunc("f", fn)
+		}()
+	}
+}
+
+func TestPackageScript(t *testing.T) {
+	pkg := NewPackage("test")
+	pkg.AddFunc("b", none)
+	pkg.AddGoFunc("a", func() {})
+	pkg.AddFunc("b", none)
+	want := "b: load-native \"test/b\"\na: load-native \"test/a\"\n"
+	if got := pkg.Script(); got != want {
+		t.Errorf("got %q", got)
+	}
+
+	pkg = NewPackage(`say "hi"`)
+	pkg.AddFunc("a", none)
+	if got, want := pkg.Script(), "a: load-native \"say ^\"hi^\"/a\"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Library.Add(pkg)
+	if _, err := vm.Eval(pkg.Script()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,144 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+)
+
+// Hash returns a content hash of everything reachable from the dictionary and
+// the module registries. Symbols are hashed by name and shared series by the
+// order they were first visited, so the result does not depend on allocation
+// addresses.
+func (vm *VM) Hash() uint64 {
+	h := &hasher{vm: vm, hash: fnv.New64a(), seen: make(map[ptr]int)}
+	h.value(vm.Dictionary.Value())
+	h.value(vm.modules.Value())
+	h.value(vm.moduleFiles.Value())
+	return h.hash.Sum64()
+}
+
+type hasher struct {
+	vm   *VM
+	hash hash.Hash64
+	seen map[ptr]int
+	buf  [8]byte
+}
+
+func (h *hasher) int(i int) {
+	binary.LittleEndian.PutUint64(h.buf[:], uint64(i))
+	h.hash.Write(h.buf[:])
+}
+
+func (h *hasher) string(s string) {
+	h.int(len(s))
+	h.hash.Write([]byte(s))
+}
+
+func (h *hasher) sym(sym sym) {
+	h.string(h.vm.InverseSymbols[sym])
+}
+
+// visit reports whether p is seen for the first time, writing a back
+// reference otherwise.
+func (h *hasher) visit(p ptr) bool {
+	if n, ok := h.seen[p]; ok {
+		h.int(-1)
+		h.int(n)
+		return false
+	}
+	h.seen[p] = len(h.seen)
+	return true
+}
+
+func (h *hasher) entries(first pBlockEntry) {
+	n := 0
+	for i := first; i != 0; i = i.Next(h.vm) {
+		n++
+	}
+	h.int(n)
+	for i := first; i != 0; i = i.Next(h.vm) {
+		h.value(i.Value(h.vm))
+	}
+}
+
+// env hashes the values a closure captured.
+func (h *hasher) env(env ptr) {
+	for ; env != 0 && h.visit(env); env = item(h.vm.read(env)).ptr() {
+		size := item(h.vm.read(env)).val()
+		h.int(size)
+		for i := 1; i <= size; i++ {
+			h.value(Value(h.vm.read(env + ptr(i))))
+		}
+	}
+	h.int(-3)
+}
+
+func (h *hasher) value(value Value) {
+	vm := h.vm
+	kind := value.Kind()
+	h.int(kind)
+
+	switch kind {
+	case BlockType:
+		block := value.Block()
+		h.int(block.Index())
+		if h.visit(ptr(block.firstLast())) {
+			h.entries(block.head(vm))
+		}
+	case WordType, GetWordType, SetWordType, QuoteType, RefinementType:
+		h.sym(value.Word().Sym())
+	case MapType, ErrorType:
+		first := value.Dict().dictFirst()
+		if h.visit(ptr(first)) {
+			d := dictFirst(vm.read(ptr(first)))
+			for i := d.first(); i != 0; i = i.next(vm) {
+				sv := i.symval(vm)
+				h.sym(sv.sym(vm))
+				h.value(Value(vm.read(ptr(sv.val(vm)))))
+			}
+			h.int(-2)
+		}
+	case NativeType:
+		h.string(vm.procNames[value.Val()])
+	case ProcType:
+		p := Proc(value)
+		if h.visit(p.fn()) {
+			spec, body := p.blocks(vm)
+			h.value(spec.Value())
+			h.value(body.Value())
+			_, env := p.closure(vm)
+			h.env(env)
+		}
+	case PathType, GetPathType, SetPathType:
+		fl := firstLast(vm.read(ptr(value.Path().firstLast())))
+		for i := fl.first(); i != 0; i = i.Next(vm) {
+			h.sym(sym(i.pval(vm)))
+		}
+		h.int(-2)
+	case StringType, IssueType, FileType, UrlType:
+		h.string(value.Text(vm))
+	case HostPortType:
+		h.string(value.Host(vm))
+		h.int(value.Port())
+	case DecimalType:
+		h.int(int(vm.read(ptr(value.Val()))))
+	default:
+		h.int(value.Val())
+	}
+}
@@ -0,0 +1,52 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import "testing"
+
+const hashScript = `o: make-object [a: 1 b: "two" c: [x y "z"]] f: fn [n] [add n 1] b: [] append b b`
+
+func TestHashIgnoresAllocation(t *testing.T) {
+	vm1 := NewVM(1000, 100)
+	BootVM(vm1)
+	vm1.BindAndExec(vm1.MustParse(hashScript))
+
+	vm2 := NewVM(1000, 100)
+	BootVM(vm2)
+	vm2.MustParse(`garbage [1 2 3] "that is never bound"`)
+	vm2.GetSymbolID("unused-symbol")
+	vm2.BindAndExec(vm2.MustParse(hashScript))
+
+	if vm1.Hash() != vm2.Hash() {
+		t.Errorf("hash differs: %016x != %016x", vm1.Hash(), vm2.Hash())
+	}
+}
+
+func TestHashDetectsChanges(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse(hashScript))
+	before := vm.Hash()
+
+	for _, cmd := range []string{`o/a: 2`, `append o/c "w"`, `o/b: "three"`, `x: 1`} {
+		vm.BindAndExec(vm.MustParse(cmd))
+		after := vm.Hash()
+		if after == before {
+			t.Errorf("hash unchanged after %q", cmd)
+		}
+		before = after
+	}
+}
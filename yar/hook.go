@@ -0,0 +1,152 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+// H O O K S
+//
+// A hook set in vm.Hook sees every value evaluated and every function and
+// native call and return, infix operators are not calls. Blocks are walked
+// while a hook is set, compiled code isn't used. The VM keeps the frames of the
+// calls for hooks; frames unwound by a panic are dropped without a Return.
+
+// Hook observes an evaluation.
+type Hook interface {
+	// Next is called before a value is evaluated.
+	Next(vm *VM, pos Position)
+	// Call is called when a function or a native starts, its frame is on top
+	// of vm.Frames.
+	Call(vm *VM, frame *Frame)
+	// Return is called when a function or a native returns, before its frame
+	// is dropped.
+	Return(vm *VM, frame *Frame, result Value)
+}
+
+// Position is a value about to be evaluated.
+type Position struct {
+	Value  Value
+	Line   int // 0 when the value wasn't parsed
+	Column int
+	Depth  int // number of functions being called, natives aren't counted
+}
+
+// Frame is a function or a native being called.
+type Frame struct {
+	Name   string // see hookCall
+	Native bool
+	Line   int // of the call, 0 when it is unknown
+	Column int
+
+	depth int // functions up to this frame
+	slots []sym
+	heap  bool
+	base  uint // first stack slot or heap frame
+}
+
+// Local is a parameter, refinement or local of a function.
+type Local struct {
+	Name  string
+	Value Value
+}
+
+// Locals returns the current values of the parameters, refinements and locals
+// of the frame in the order of the spec.
+func (f *Frame) Locals(vm *VM) []Local {
+	locals := make([]Local, len(f.slots))
+	for i, sym := range f.slots {
+		var value Value
+		if f.heap {
+			value = Value(vm.read(ptr(f.base) + ptr(i) + 1))
+		} else {
+			value = vm.stack[f.base+uint(i)]
+		}
+		locals[i] = Local{Name: vm.InverseSymbols[sym], Value: value}
+	}
+	return locals
+}
+
+// Frames returns the functions being called, the innermost last. Only calls
+// made while a hook was set are known.
+func (vm *VM) Frames() []*Frame { return vm.frames }
+
+func (vm *VM) depth() int {
+	if len(vm.frames) == 0 {
+		return 0
+	}
+	return vm.frames[len(vm.frames)-1].depth
+}
+
+func (vm *VM) hookNext() {
+	pos := Position{Value: vm.pc.Value(vm), Depth: vm.depth()}
+	if span, ok := vm.spanAt(vm.pc); ok {
+		pos.Line, pos.Column = span.Line, span.Column
+	}
+	vm.Hook.Next(vm, pos)
+}
+
+// hookCall pushes the frame of a function called from at with refinements from
+// refs, its slots start at base. The function is named by the word or the path
+// it was called by, or else by the global word it was set to, or fn.
+func (vm *VM) hookCall(p Proc, at pBlockEntry, refs pBlockEntry, spec *fnSpec, heap bool, base uint) *Frame {
+	name := ""
+	if at != 0 {
+		if kind := at.Value(vm).Kind(); kind == WordType || kind == PathType {
+			name = vm.callName(at, refs)
+		}
+	}
+	if name == "" {
+		name = vm.globalName(Value(p))
+	}
+	frame := &Frame{Name: name, depth: vm.depth() + 1, slots: spec.slots, heap: heap, base: base}
+	vm.pushFrame(frame, at)
+	return frame
+}
+
+// hookNative calls a native with its frame pushed, the native is named by
+// procNames.
+func (vm *VM) hookNative(i int) Value {
+	at := vm.at
+	frame := &Frame{Name: vm.procNames[i], Native: true, depth: vm.depth()}
+	vm.pushFrame(frame, at)
+	result := vm.proc[i](vm)
+	vm.hookReturn(frame, result)
+	return result
+}
+
+func (vm *VM) pushFrame(frame *Frame, at pBlockEntry) {
+	if span, ok := vm.spanAt(at); ok && at != 0 {
+		frame.Line, frame.Column = span.Line, span.Column
+	}
+	vm.frames = append(vm.frames, frame)
+	vm.Hook.Call(vm, frame)
+}
+
+// globalName returns a global word set to the value or fn.
+func (vm *VM) globalName(value Value) string {
+	for e := dictFirst(vm.read(ptr(vm.Dictionary.dictFirst()))).first(); e != 0; e = e.next(vm) {
+		sv := e.symval(vm)
+		if Value(vm.read(ptr(sv.val(vm)))) == value {
+			return vm.InverseSymbols[sv.sym(vm)]
+		}
+	}
+	return "fn"
+}
+
+func (vm *VM) hookReturn(frame *Frame, result Value) {
+	if vm.Hook != nil {
+		vm.Hook.Return(vm, frame, result)
+	}
+	vm.frames = vm.frames[:len(vm.frames)-1]
+}
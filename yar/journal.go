@@ -0,0 +1,120 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+// J O U R N A L
+//
+// A transaction keeps the old content of the heap cells written since it
+// began. Cells allocated since then are dropped by moving the top back, and
+// symbols and natives added are dropped the same way, so a rolled back
+// transaction leaves no trace in the heap, the dictionary or the symbol table.
+// Savepoints within a transaction roll back a part of it, limited uses them.
+
+type journal struct {
+	begin  savepoint
+	top    uint // writes to cells up to top are recorded
+	writes []journalWrite
+}
+
+type journalWrite struct {
+	p   ptr
+	old cell
+}
+
+type savepoint struct {
+	writes int
+	top    uint
+	symbol uint
+	procs  int
+	limit  uint // journal top to restore
+}
+
+// Begin starts a transaction, it must end with Commit or Rollback. Garbage
+// can't be collected while a transaction is open.
+func (vm *VM) Begin() {
+	if vm.journal != nil {
+		panic("transaction already open")
+	}
+	vm.journal = &journal{top: vm.top}
+	vm.journal.begin = vm.mark()
+}
+
+// Commit keeps the changes made since Begin.
+func (vm *VM) Commit() {
+	if vm.journal == nil {
+		panic("no transaction")
+	}
+	vm.journal = nil
+}
+
+// Rollback undoes the changes made since Begin. Values allocated since then,
+// including errors returned by the evaluation, are invalid after the call.
+func (vm *VM) Rollback() {
+	if vm.journal == nil {
+		panic("no transaction")
+	}
+	vm.rollbackTo(vm.journal.begin)
+	vm.journal = nil
+}
+
+// InTransaction tells if a transaction is open.
+func (vm *VM) InTransaction() bool { return vm.journal != nil }
+
+// mark returns a savepoint of the open transaction, release or rollbackTo
+// must follow.
+func (vm *VM) mark() savepoint {
+	j := vm.journal
+	s := savepoint{writes: len(j.writes), top: vm.top, symbol: vm.nextSymbol, procs: len(vm.proc), limit: j.top}
+	j.top = vm.top
+	return s
+}
+
+// release keeps the changes made since the savepoint.
+func (vm *VM) release(s savepoint) { vm.journal.top = s.limit }
+
+func (vm *VM) journalWrite(p ptr) {
+	if j := vm.journal; j != nil && uint(p) <= j.top {
+		j.writes = append(j.writes, journalWrite{p, vm.mem.read(p)})
+	}
+}
+
+// rollbackTo restores the VM to the state it had at the savepoint. Caches keyed
+// by heap addresses are dropped.
+func (vm *VM) rollbackTo(s savepoint) {
+	j := vm.journal
+	for i := len(j.writes) - 1; i >= s.writes; i-- {
+		vm.mem.write(j.writes[i].p, j.writes[i].old)
+	}
+	j.writes = j.writes[:s.writes]
+	j.top = s.limit
+	vm.top = s.top
+
+	vm.ownMaps()
+	for id := s.symbol + 1; id <= vm.nextSymbol; id++ {
+		delete(vm.symbols, vm.InverseSymbols[id])
+		delete(vm.InverseSymbols, id)
+	}
+	vm.nextSymbol = s.symbol
+	vm.proc = vm.proc[:s.procs]
+	vm.procNames = vm.procNames[:s.procs]
+	for entry := range vm.spans {
+		if uint(entry) > vm.top {
+			delete(vm.spans, entry)
+		}
+	}
+	vm.specs = make(map[ptr]*fnSpec)
+	vm.resetCode()
+}
@@ -0,0 +1,115 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import "testing"
+
+func TestRollback(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	if _, err := vm.Eval(`x: 1 b: [1 2] o: make-object [a: 1] s: "abc"`); err != nil {
+		t.Fatal(err)
+	}
+	hash, top, symbols, procs := vm.Hash(), vm.top, vm.nextSymbol, len(vm.proc)
+
+	vm.Begin()
+	if _, err := vm.Eval(`x: 2 append b 3 o/a: 2 append s "d" fresh-word: 5 plus: load-native "core/add" add 1 "x"`); err == nil {
+		t.Fatal("no error")
+	}
+	vm.Rollback()
+
+	if vm.Hash() != hash {
+		t.Error("state changed by a rolled back transaction")
+	}
+	if vm.top != top {
+		t.Errorf("top %d, want %d", vm.top, top)
+	}
+	if vm.nextSymbol != symbols || len(vm.symbols) != int(symbols) {
+		t.Errorf("symbols %d (%d in the table), want %d", vm.nextSymbol, len(vm.symbols), symbols)
+	}
+	if _, ok := vm.symbols["fresh-word"]; ok {
+		t.Error("symbol added by a rolled back transaction")
+	}
+	if len(vm.proc) != procs || len(vm.procNames) != procs {
+		t.Errorf("natives %d, want %d", len(vm.proc), procs)
+	}
+	result, err := vm.Eval(`reduce [x b o/a s]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.ToString(result); got != `[1 [1 2 ] 1 "abc" ]` {
+		t.Errorf("got %s after rollback", got)
+	}
+	if _, err := vm.Eval(`fresh-word`); err == nil {
+		t.Error("word set by a rolled back transaction has a value")
+	}
+}
+
+func TestCommit(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Begin()
+	if _, err := vm.Eval(`x: 1 b: [1 2]`); err != nil {
+		t.Fatal(err)
+	}
+	vm.Commit()
+	vm.Begin()
+	if _, err := vm.Eval(`x: 2 append b 3`); err != nil {
+		t.Fatal(err)
+	}
+	vm.Commit()
+	if vm.InTransaction() {
+		t.Error("transaction still open")
+	}
+	vm.GC()
+	result, err := vm.Eval(`reduce [x b]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.ToString(result); got != `[2 [1 2 3 ] ]` {
+		t.Errorf("got %s after commit", got)
+	}
+}
+
+// A limit exceeded in a transaction rolls back the evaluation only, the rest
+// of the transaction is kept until it ends.
+func TestRollbackSavepoint(t *testing.T) {
+	for _, compile := range []bool{false, true} {
+		vm := limitedVM(compile, Limits{Steps: 10000})
+		if _, err := vm.Eval(`x: 1 y: 1`); err != nil {
+			t.Fatal(err)
+		}
+		hash := vm.Hash()
+		vm.Begin()
+		if _, err := vm.Eval(`x: 2`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vm.Eval(`y: 2 forever []`); err == nil {
+			t.Fatal("no limit error")
+		}
+		result, err := vm.Eval(`reduce [x y]`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := vm.ToString(result); got != `[2 1 ]` {
+			t.Errorf("compiled %v: got %s after the limit", compile, got)
+		}
+		vm.Rollback()
+		if vm.Hash() != hash {
+			t.Errorf("compiled %v: state changed by a rolled back transaction", compile)
+		}
+	}
+}
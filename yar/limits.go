@@ -0,0 +1,163 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"math"
+	"time"
+)
+
+// L I M I T S
+//
+// Limits bound every top-level evaluation of a VM: Eval, BindAndExec and Call.
+// Steps count the values and blocks evaluated, cells the heap cells allocated and depth
+// the blocks being evaluated at once, so two VMs in the same state running the
+// same code stop at the same point. The time limit depends on the machine and
+// is meant for evaluations which aren't replicated, like reads.
+//
+// An evaluation over a limit raises a limit error. The error can't be caught:
+// try and catch see it, but the next value evaluated raises it again, so the
+// evaluation unwinds to the top. There the changes it made are rolled back, see
+// journal.go, and the error is returned.
+
+// Limits of an evaluation, a zero field is no limit.
+type Limits struct {
+	Steps int
+	Cells int
+	Depth int
+	Time  time.Duration
+}
+
+// checkInterval is the number of steps between two looks at the clock.
+const checkInterval = 1024
+
+type budget struct {
+	active   bool
+	left     int // steps before the next check
+	steps    int // steps granted so far
+	depth    int
+	cells    bool // maxTop is in force
+	maxTop   uint
+	deadline time.Time
+	exceeded string
+}
+
+// limitExceeded unwinds allocation over the cell limit, see recoverError.
+type limitExceeded struct{}
+
+// step counts a value evaluated, when the result isn't 0 it must be returned.
+func (vm *VM) step() Value {
+	vm.budget.left--
+	if vm.budget.left < 0 {
+		return vm.checkBudget()
+	}
+	return 0
+}
+
+func (vm *VM) checkBudget() Value {
+	b := &vm.budget
+	if b.exceeded != "" {
+		b.left = 0
+		return vm.fail(ErrLimit, b.exceeded, 0)
+	}
+	if !b.active {
+		b.left = math.MaxInt64
+		return 0
+	}
+	if vm.Limits.Steps > 0 && b.steps >= vm.Limits.Steps {
+		return vm.exceed("step")
+	}
+	if !b.deadline.IsZero() && time.Now().After(b.deadline) {
+		return vm.exceed("time")
+	}
+	chunk := math.MaxInt64 - b.steps
+	if !b.deadline.IsZero() {
+		chunk = checkInterval
+	}
+	if vm.Limits.Steps > 0 && chunk > vm.Limits.Steps-b.steps {
+		chunk = vm.Limits.Steps - b.steps
+	}
+	b.steps += chunk
+	b.left = chunk - 1
+	return 0
+}
+
+// exceed raises the limit error, from then on every step raises it.
+func (vm *VM) exceed(limit string) Value {
+	b := &vm.budget
+	b.exceeded = limit + " limit exceeded"
+	b.cells = false
+	b.left = 0
+	return vm.fail(ErrLimit, b.exceeded, 0)
+}
+
+// enter counts a block evaluated by call as a step and a level of depth, leave
+// must follow unless it fails.
+func (vm *VM) enter() Value {
+	if err := vm.step(); err != 0 {
+		return err
+	}
+	if vm.Limits.Depth > 0 && vm.budget.depth >= vm.Limits.Depth && vm.budget.active {
+		return vm.exceed("depth")
+	}
+	vm.budget.depth++
+	return 0
+}
+
+func (vm *VM) leave() { vm.budget.depth-- }
+
+// allocExceeded is called by alloc when the cell limit is reached.
+func (vm *VM) allocExceeded() {
+	vm.exceed("heap")
+	panic(limitExceeded{})
+}
+
+// limited runs a top-level evaluation within vm.Limits. Evaluations started
+// while another one runs share its budget.
+func (vm *VM) limited(f func() (Value, bool)) (Value, bool) {
+	if vm.budget.active || vm.Limits == (Limits{}) {
+		return f()
+	}
+	vm.budget = budget{active: true}
+	if vm.Limits.Cells > 0 {
+		vm.budget.cells, vm.budget.maxTop = true, vm.top+uint(vm.Limits.Cells)
+	}
+	if vm.Limits.Time > 0 {
+		vm.budget.deadline = time.Now().Add(vm.Limits.Time)
+	}
+	began := vm.journal == nil
+	if began {
+		vm.Begin()
+	}
+	mark := vm.mark()
+	defer func() {
+		vm.budget = budget{}
+		if began {
+			vm.Commit()
+		}
+	}()
+
+	result, raised := f()
+	if vm.budget.exceeded == "" {
+		vm.release(mark)
+		return result, raised
+	}
+	vm.rollbackTo(mark)
+	if uint(vm.at) > vm.top {
+		vm.at = 0
+	}
+	return vm.MakeError(ErrLimit, vm.budget.exceeded, 0).Value(), true
+}
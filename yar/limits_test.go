@@ -0,0 +1,137 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func limitedVM(compile bool, limits Limits) *VM {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Compile = compile
+	vm.Limits = limits
+	return vm
+}
+
+func TestLimits(t *testing.T) {
+	for _, test := range []struct {
+		code    string
+		limits  Limits
+		message string
+	}{
+		{`forever []`, Limits{Steps: 1000}, "step limit exceeded"},
+		{`x: 0 while [true] [x: x + 1]`, Limits{Steps: 1000}, "step limit exceeded"},
+		{`b: [] forever [append b "grow"]`, Limits{Cells: 1000}, "heap limit exceeded"},
+		{`f: fn [n] [f n + 1] f 0`, Limits{Depth: 50}, "depth limit exceeded"},
+		{`forever []`, Limits{Time: 10 * time.Millisecond}, "time limit exceeded"},
+		{`forever [try [forever []]]`, Limits{Steps: 1000}, "step limit exceeded"},
+		{`forever [attempt [loop 10 []]]`, Limits{Steps: 1000}, "step limit exceeded"},
+		{`catch err [forever []] [42]`, Limits{Steps: 1000}, "step limit exceeded"},
+	} {
+		for _, compile := range []bool{false, true} {
+			vm := limitedVM(compile, test.limits)
+			_, err := vm.Eval(test.code)
+			var e *ScriptError
+			if !errors.As(err, &e) || e.Code != ErrLimit {
+				t.Errorf("%s (compiled %v): got %v, want limit error", test.code, compile, err)
+				continue
+			}
+			if got := e.Value.Error().Message(vm); got != test.message {
+				t.Errorf("%s (compiled %v): got %q, want %q", test.code, compile, got, test.message)
+			}
+			if vm.sp != 0 || vm.bp != 0 || vm.pc != 0 {
+				t.Errorf("%s: registers not restored: sp %d bp %d pc %d", test.code, vm.sp, vm.bp, vm.pc)
+			}
+			if result, err := vm.Eval(`add 1 2`); err != nil || vm.ToString(result) != "3" {
+				t.Errorf("%s: VM unusable after the limit: %v", test.code, err)
+			}
+		}
+	}
+}
+
+func TestLimitsWithin(t *testing.T) {
+	vm := limitedVM(false, Limits{Steps: 10000, Cells: 10000, Depth: 50})
+	result, err := vm.Eval(`f: fn [n] [either n > 1 [add f n - 2 f n - 1] [n]] f 10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.ToString(result); got != "55" {
+		t.Errorf("got %s, want 55", got)
+	}
+}
+
+// The step count doesn't depend on how the code is run, so replicas stop at
+// the same point.
+func TestLimitsDeterministic(t *testing.T) {
+	code := `f: fn [n] [either n > 1 [add f n - 2 f n - 1] [n]] f 12`
+	var steps [2]int
+	for i, compile := range []bool{false, true} {
+		for n := 100; ; n += 100 {
+			vm := limitedVM(compile, Limits{Steps: n})
+			if _, err := vm.Eval(code); err == nil {
+				steps[i] = n
+				break
+			}
+		}
+	}
+	if steps[0] != steps[1] {
+		t.Errorf("steps walked %d, compiled %d", steps[0], steps[1])
+	}
+}
+
+func TestLimitsRollback(t *testing.T) {
+	for _, compile := range []bool{false, true} {
+		vm := limitedVM(compile, Limits{Steps: 10000})
+		if _, err := vm.Eval(`x: 1 b: [1 2] o: make-object [a: 1]`); err != nil {
+			t.Fatal(err)
+		}
+		hash := vm.Hash()
+		top := vm.top
+		if _, err := vm.Eval(`x: 2 append b 3 o/a: 2 y: 5 forever []`); err == nil {
+			t.Fatal("no limit error")
+		}
+		if vm.Hash() != hash {
+			t.Errorf("compiled %v: state changed by a failed evaluation", compile)
+		}
+		if vm.top > top+1000 {
+			t.Errorf("compiled %v: heap not rolled back, top %d, was %d", compile, vm.top, top)
+		}
+		result, err := vm.Eval(`reduce [x b o/a]`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := vm.ToString(result); got != "[1 [1 2 ] 1 ]" {
+			t.Errorf("compiled %v: got %s after rollback", compile, got)
+		}
+	}
+}
+
+func TestLimitsCall(t *testing.T) {
+	vm := limitedVM(false, Limits{})
+	if _, err := vm.Eval(`spin: fn [] [forever []]`); err != nil {
+		t.Fatal(err)
+	}
+	spin := vm.Dictionary.Find(vm, vm.GetSymbolID("spin"))
+	vm.Limits = Limits{Steps: 1000}
+	_, err := vm.Call(Proc(Value(vm.read(ptr(spin.val(vm))))))
+	var e *ScriptError
+	if !errors.As(err, &e) || e.Code != ErrLimit {
+		t.Errorf("got %v, want limit error", err)
+	}
+}
@@ -0,0 +1,158 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// L I T E R A L S
+//
+// none, duration and decimal values don't refer to strings. A decimal does not
+// fit into a value, so it points to a cell holding the float bits. Issue, file
+// and url values point to a text cell like strings do, a host:port keeps the
+// port in the bits above the text cell.
+
+// None is the value of none, as opposed to 0 which is unset.
+var None = makeValue(0, NoneType)
+
+// DECIMAL
+//-------------------------
+//      PTR       | KIND |
+//-------------------------
+
+func (vm *VM) AllocDecimal(f float64) Value {
+	return makeValue(int(vm.alloc(cell(math.Float64bits(f)))), DecimalType)
+}
+
+// Decimal returns the float value of a decimal.
+func (v Value) Decimal(vm *VM) float64 {
+	return math.Float64frombits(uint64(vm.read(ptr(v.Val()))))
+}
+
+func decimalToString(vm *VM, value Value) string {
+	s := strconv.FormatFloat(value.Decimal(vm), 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eEIN") {
+		s += ".0"
+	}
+	return s
+}
+
+// DURATION
+//-------------------------
+//   NANOSECONDS  | KIND |
+//-------------------------
+
+// MakeDuration makes a duration value, d must not be longer than maxInt
+// nanoseconds, about 417 days.
+func MakeDuration(d time.Duration) Value { return makeValue(int(d), DurationType) }
+
+// Duration returns the duration of a duration value.
+func (v Value) Duration() time.Duration { return time.Duration(v.Val()) }
+
+func durationToString(vm *VM, value Value) string {
+	return value.Duration().String()
+}
+
+func noneToString(vm *VM, value Value) string {
+	return "none"
+}
+
+func boolToString(vm *VM, value Value) string {
+	if value.Bool().Val() {
+		return "true"
+	}
+	return "false"
+}
+
+// ISSUE, FILE, URL
+//-------------------------
+//     TEXT       | KIND |
+//-------------------------
+
+func (vm *VM) allocStringKind(s string, kind int) Value {
+	return makeValue(int(vm.allocText(s)), kind)
+}
+
+func (vm *VM) AllocIssue(s string) Value { return vm.allocStringKind(s, IssueType) }
+func (vm *VM) AllocFile(s string) Value  { return vm.allocStringKind(s, FileType) }
+func (vm *VM) AllocUrl(s string) Value   { return vm.allocStringKind(s, UrlType) }
+
+// Text returns the text of a string from its index, issue, file or url. The
+// text may have been shortened through another series since the index was
+// taken, past the tail the text is empty.
+func (v Value) Text(vm *VM) string {
+	text := vm.readText(v.text())
+	if index := v.Val() >> textBits; index > 0 {
+		runes := []rune(text)
+		if index > len(runes) {
+			index = len(runes)
+		}
+		return string(runes[index:])
+	}
+	return text
+}
+
+func issueToString(vm *VM, value Value) string { return "#" + value.Text(vm) }
+func fileToString(vm *VM, value Value) string  { return "%" + value.Text(vm) }
+func urlToString(vm *VM, value Value) string   { return value.Text(vm) }
+
+// HOST:PORT
+//---------------------------------
+//  PORT  |   TEXT     | KIND |
+//---------------------------------
+
+const hostBits = 32
+
+func (vm *VM) AllocHostPort(host string, port int) Value {
+	return makeValue(port<<hostBits|int(vm.allocText(host)), HostPortType)
+}
+
+func (v Value) hostText() ptr { return ptr(v.Val() & (1<<hostBits - 1)) }
+
+// Host returns the host of a host:port.
+func (v Value) Host(vm *VM) string { return vm.readText(v.hostText()) }
+
+// Port returns the port of a host:port.
+func (v Value) Port() int { return v.Val() >> hostBits }
+
+func hostPortToString(vm *VM, value Value) string {
+	return value.Host(vm) + ":" + strconv.Itoa(value.Port())
+}
+
+// escape writes s as a double-quoted string, see parser.string for the escapes.
+func escape(s string) string {
+	var result strings.Builder
+	result.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '^':
+			result.WriteByte('^')
+			result.WriteByte(c)
+		case '\n':
+			result.WriteString("^/")
+		case '\t':
+			result.WriteString("^-")
+		default:
+			result.WriteByte(c)
+		}
+	}
+	result.WriteByte('"')
+	return result.String()
+}
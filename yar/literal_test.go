@@ -0,0 +1,115 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLiterals(t *testing.T) {
+	vm := NewVM(1000, 100)
+	for _, test := range []struct {
+		source string
+		kind   int
+		result string
+	}{
+		{`42`, IntegerType, "42"},
+		{`-5`, IntegerType, "-5"},
+		{`+7`, IntegerType, "7"},
+		{`1.5`, DecimalType, "1.5"},
+		{`-0.25`, DecimalType, "-0.25"},
+		{`2.0`, DecimalType, "2.0"},
+		{`1e3`, DecimalType, "1000.0"},
+		{`"plain"`, StringType, `"plain"`},
+		{`"a^"b^/c^-d^^"`, StringType, `"a^"b^/c^-d^^"`},
+		{"{multi\nline {nested} ^}}", StringType, `"multi^/line {nested} }"`},
+		{`#issue-42`, IssueType, "#issue-42"},
+		{`%scripts/deploy.y`, FileType, "%scripts/deploy.y"},
+		{`https://anticrm.com/path?q=1`, UrlType, "https://anticrm.com/path?q=1"},
+		{`localhost:63001`, HostPortType, "localhost:63001"},
+		{`10.0.0.1:8080`, HostPortType, "10.0.0.1:8080"},
+		{`30s`, DurationType, "30s"},
+		{`-10000h`, DurationType, "-10000h0m0s"},
+		{`500ms`, DurationType, "500ms"},
+		{`1h30m`, DurationType, "1h30m0s"},
+		{`-2m`, DurationType, "-2m0s"},
+		{`true`, BooleanType, "true"},
+		{`false`, BooleanType, "false"},
+		{`none`, NoneType, "none"},
+		{`/local`, RefinementType, "/local"},
+	} {
+		value := vm.MustParse(test.source).First(vm).Value(vm)
+		if value.Kind() != test.kind {
+			t.Errorf("%s: got %s, want %s", test.source, typeName(value.Kind()), typeName(test.kind))
+			continue
+		}
+		s := vm.ToString(value)
+		if s != test.result {
+			t.Errorf("%s: got %s, want %s", test.source, s, test.result)
+		}
+		again := vm.MustParse(s).First(vm).Value(vm)
+		if again.Kind() != value.Kind() || vm.ToString(again) != s {
+			t.Errorf("%s: round trip gives %s", test.source, vm.ToString(again))
+		}
+	}
+}
+
+func TestLiteralValues(t *testing.T) {
+	vm := NewVM(1000, 100)
+	code := vm.MustParse(`-5 2.5 "^-x" localhost:63001 90s ; a comment [1 2]
+		#42 ; another`)
+	var values []Value
+	for i := code.First(vm); i != 0; i = i.Next(vm) {
+		values = append(values, i.Value(vm))
+	}
+	if len(values) != 6 {
+		t.Fatalf("got %d values, want 6", len(values))
+	}
+	if values[0].Val() != -5 {
+		t.Errorf("integer = %d", values[0].Val())
+	}
+	if values[1].Decimal(vm) != 2.5 {
+		t.Errorf("decimal = %v", values[1].Decimal(vm))
+	}
+	if values[2].String().String(vm) != "\tx" {
+		t.Errorf("string = %q", values[2].String().String(vm))
+	}
+	if values[3].Host(vm) != "localhost" || values[3].Port() != 63001 {
+		t.Errorf("host:port = %s %d", values[3].Host(vm), values[3].Port())
+	}
+	if values[4].Duration() != 90*time.Second {
+		t.Errorf("duration = %v", values[4].Duration())
+	}
+	if values[5].Text(vm) != "42" {
+		t.Errorf("issue = %s", values[5].Text(vm))
+	}
+}
+
+func TestLiteralsSurviveGC(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`x: [1.5 localhost:80 %file "s"] garbage: [2.5 #issue]`)
+	vm.Eval(`garbage: none`)
+	before := vm.Hash()
+	vm.GC()
+	if result, _ := vm.Eval(`x`); vm.ToString(result) != `[1.5 localhost:80 %file "s" ]` {
+		t.Errorf("after gc x = %s", vm.ToString(result))
+	}
+	if vm.Hash() != before {
+		t.Error("gc changed the hash")
+	}
+}
@@ -0,0 +1,359 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"math"
+	"strings"
+)
+
+// M A T H
+//
+// Numbers are integers and decimals, an operation on an integer and a decimal
+// gives a decimal. Integers hold 56 bits, results out of range and division by
+// zero raise math errors instead of wrapping.
+//
+// Binary words may be written infix with the operator words in infixOps:
+// 1 + 2 * 3 is evaluated left to right like (1 + 2) * 3, the operand to the
+// right of an operator is evaluated without infix, so f 1 + 2 passes 3 to f.
+
+type binaryOp func(vm *VM, x Value, y Value) Value
+
+func (vm *VM) toDecimal(value Value) float64 {
+	if value.Kind() == IntegerType {
+		return float64(value.Val())
+	}
+	return value.Decimal(vm)
+}
+
+func isNumber(kind int) bool { return kind == IntegerType || kind == DecimalType }
+
+func (vm *VM) checkNumbers(native string, x Value, y Value) Value {
+	if !isNumber(x.Kind()) {
+		return vm.typeError(native, "number!", x)
+	}
+	if !isNumber(y.Kind()) {
+		return vm.typeError(native, "number!", y)
+	}
+	return 0
+}
+
+func (vm *VM) intResult(native string, r int) Value {
+	if r > maxInt || r < -maxInt {
+		return vm.fail(ErrMath, native+": integer overflow", 0)
+	}
+	return MakeInt(r).Value()
+}
+
+func (vm *VM) decimalResult(native string, r float64) Value {
+	if math.IsInf(r, 0) || math.IsNaN(r) {
+		return vm.fail(ErrMath, native+": decimal overflow", 0)
+	}
+	return vm.AllocDecimal(r)
+}
+
+// arith applies an operation to integers or decimals, intOp is used when
+// both are integers.
+func (vm *VM) arith(native string, x Value, y Value, intOp func(a, b int) int, decOp func(a, b float64) float64) Value {
+	if err := vm.checkNumbers(native, x, y); err != 0 {
+		return err
+	}
+	if x.Kind() == IntegerType && y.Kind() == IntegerType {
+		return vm.intResult(native, intOp(x.Val(), y.Val()))
+	}
+	return vm.decimalResult(native, decOp(vm.toDecimal(x), vm.toDecimal(y)))
+}
+
+func addOp(vm *VM, x Value, y Value) Value {
+	if x.Kind() == IntegerType && y.Kind() == IntegerType {
+		return vm.intResult("add", x.Val()+y.Val())
+	}
+	return vm.arith("add", x, y, func(a, b int) int { return a + b }, func(a, b float64) float64 { return a + b })
+}
+
+func subOp(vm *VM, x Value, y Value) Value {
+	if x.Kind() == IntegerType && y.Kind() == IntegerType {
+		return vm.intResult("sub", x.Val()-y.Val())
+	}
+	return vm.arith("sub", x, y, func(a, b int) int { return a - b }, func(a, b float64) float64 { return a - b })
+}
+
+func mulOp(vm *VM, x Value, y Value) Value {
+	if err := vm.checkNumbers("mul", x, y); err != 0 {
+		return err
+	}
+	if x.Kind() == IntegerType && y.Kind() == IntegerType {
+		a, b := x.Val(), y.Val()
+		r := a * b
+		if a != 0 && r/a != b {
+			return vm.fail(ErrMath, "mul: integer overflow", 0)
+		}
+		return vm.intResult("mul", r)
+	}
+	return vm.decimalResult("mul", vm.toDecimal(x)*vm.toDecimal(y))
+}
+
+// divOp divides integers exactly, the result is a decimal when there is a
+// remainder.
+func divOp(vm *VM, x Value, y Value) Value {
+	if err := vm.checkNumbers("div", x, y); err != 0 {
+		return err
+	}
+	if vm.toDecimal(y) == 0 {
+		return vm.fail(ErrMath, "div: division by zero", 0)
+	}
+	if x.Kind() == IntegerType && y.Kind() == IntegerType && x.Val()%y.Val() == 0 {
+		return MakeInt(x.Val() / y.Val()).Value()
+	}
+	return vm.decimalResult("div", vm.toDecimal(x)/vm.toDecimal(y))
+}
+
+func modOp(vm *VM, x Value, y Value) Value {
+	if err := vm.checkNumbers("mod", x, y); err != 0 {
+		return err
+	}
+	if vm.toDecimal(y) == 0 {
+		return vm.fail(ErrMath, "mod: division by zero", 0)
+	}
+	if x.Kind() == IntegerType && y.Kind() == IntegerType {
+		return MakeInt(x.Val() % y.Val()).Value()
+	}
+	return vm.decimalResult("mod", math.Mod(vm.toDecimal(x), vm.toDecimal(y)))
+}
+
+// compare orders numbers, strings and durations.
+func (vm *VM) compare(native string, x Value, y Value) (int, Value) {
+	switch {
+	case x.Kind() == IntegerType && y.Kind() == IntegerType, x.Kind() == DurationType && y.Kind() == DurationType:
+		a, b := x.Val(), y.Val()
+		switch {
+		case a < b:
+			return -1, 0
+		case a > b:
+			return 1, 0
+		}
+		return 0, 0
+	case isNumber(x.Kind()) && isNumber(y.Kind()):
+		a, b := vm.toDecimal(x), vm.toDecimal(y)
+		switch {
+		case a < b:
+			return -1, 0
+		case a > b:
+			return 1, 0
+		}
+		return 0, 0
+	case x.Kind() == StringType && y.Kind() == StringType:
+		return strings.Compare(x.Text(vm), y.Text(vm)), 0
+	}
+	if isNumber(x.Kind()) || x.Kind() == StringType || x.Kind() == DurationType {
+		return 0, vm.typeError(native, typeName(x.Kind()), y)
+	}
+	return 0, vm.typeError(native, "number!", x)
+}
+
+func comparison(native string, test func(c int) bool) binaryOp {
+	return func(vm *VM, x Value, y Value) Value {
+		if x.Kind() == IntegerType && y.Kind() == IntegerType {
+			return MakeBool(test(x.Val() - y.Val())).Value()
+		}
+		c, err := vm.compare(native, x, y)
+		if err != 0 {
+			return err
+		}
+		return MakeBool(test(c)).Value()
+	}
+}
+
+var (
+	ltOp = comparison("lt", func(c int) bool { return c < 0 })
+	leOp = comparison("le", func(c int) bool { return c <= 0 })
+	gtOp = comparison("gt", func(c int) bool { return c > 0 })
+	geOp = comparison("ge", func(c int) bool { return c >= 0 })
+)
+
+// eqOp compares any values, numbers compare by value across integers and
+// decimals.
+func eqOp(vm *VM, x Value, y Value) Value {
+	if isNumber(x.Kind()) && isNumber(y.Kind()) {
+		return MakeBool(vm.toDecimal(x) == vm.toDecimal(y)).Value()
+	}
+	return MakeBool(vm.equal(x, y)).Value()
+}
+
+func neOp(vm *VM, x Value, y Value) Value {
+	return MakeBool(!eqOp(vm, x, y).Bool().Val()).Value()
+}
+
+// logic applies an operation to two logic values, or bitwise to integers.
+func logic(native string, op func(a, b int) int) binaryOp {
+	return func(vm *VM, x Value, y Value) Value {
+		switch {
+		case x.Kind() == BooleanType && y.Kind() == BooleanType:
+			return MakeBool(op(x.Val(), y.Val()) != 0).Value()
+		case x.Kind() == IntegerType && y.Kind() == IntegerType:
+			return MakeInt(op(x.Val(), y.Val())).Value()
+		case x.Kind() == BooleanType || x.Kind() == IntegerType:
+			return vm.typeError(native, typeName(x.Kind()), y)
+		}
+		return vm.typeError(native, "logic!", x)
+	}
+}
+
+var (
+	andOp = logic("and", func(a, b int) int { return a & b })
+	orOp  = logic("or", func(a, b int) int { return a | b })
+	xorOp = logic("xor", func(a, b int) int { return a ^ b })
+)
+
+// prefix makes the prefix native of a binary operation.
+func prefix(op binaryOp) procFunc {
+	return func(vm *VM) Value {
+		x, err := vm.nextAny()
+		if err != 0 {
+			return err
+		}
+		y, err := vm.nextAny()
+		if err != 0 {
+			return err
+		}
+		return op(vm, x, y)
+	}
+}
+
+func (vm *VM) nextNumber(native string) (Value, Value) {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return 0, err
+	}
+	if !isNumber(value.Kind()) {
+		return 0, vm.typeError(native, "number!", value)
+	}
+	return value, 0
+}
+
+func neg(vm *VM) Value {
+	x, err := vm.nextNumber("neg")
+	if err != 0 {
+		return err
+	}
+	if x.Kind() == IntegerType {
+		return MakeInt(-x.Val()).Value()
+	}
+	return vm.AllocDecimal(-x.Decimal(vm))
+}
+
+func abs(vm *VM) Value {
+	x, err := vm.nextNumber("abs")
+	if err != 0 {
+		return err
+	}
+	if x.Kind() == IntegerType {
+		if x.Val() < 0 {
+			return MakeInt(-x.Val()).Value()
+		}
+		return x
+	}
+	return vm.AllocDecimal(math.Abs(x.Decimal(vm)))
+}
+
+func minMax(native string, first bool) procFunc {
+	return func(vm *VM) Value {
+		x, err := vm.nextAny()
+		if err != 0 {
+			return err
+		}
+		y, err := vm.nextAny()
+		if err != 0 {
+			return err
+		}
+		c, err := vm.compare(native, x, y)
+		if err != 0 {
+			return err
+		}
+		if c <= 0 == first {
+			return x
+		}
+		return y
+	}
+}
+
+func not(vm *VM) Value {
+	x, err := vm.nextArg("not", BooleanType)
+	if err != 0 {
+		return err
+	}
+	return MakeBool(!x.Bool().Val()).Value()
+}
+
+// infixOps are the operator words and their operations.
+var infixOps = map[string]binaryOp{
+	"+":  addOp,
+	"-":  subOp,
+	"*":  mulOp,
+	"/":  divOp,
+	"=":  eqOp,
+	"<>": neOp,
+	"<":  ltOp,
+	">":  gtOp,
+	"<=": leOp,
+	">=": geOp,
+}
+
+// initInfix makes the table of operations indexed by the operator symbols.
+func (vm *VM) initInfix() {
+	vm.infix = nil
+	for name, op := range infixOps {
+		sym := vm.GetSymbolID(name)
+		for uint(len(vm.infix)) <= sym {
+			vm.infix = append(vm.infix, nil)
+		}
+		vm.infix[sym] = op
+	}
+}
+
+// infixAt returns the operation of the operator word at entry, if it is one.
+func (vm *VM) infixAt(entry pBlockEntry) binaryOp {
+	value := Value(vm.read(blockEntry(vm.read(ptr(entry))).pval()))
+	if value.Kind() != WordType {
+		return nil
+	}
+	if sym := value.Word().Sym(); sym < uint(len(vm.infix)) {
+		return vm.infix[sym]
+	}
+	return nil
+}
+
+func mathPackage(pkg *Pkg) {
+	pkg.AddFunc("add", prefix(addOp))
+	pkg.AddFunc("sub", prefix(subOp))
+	pkg.AddFunc("mul", prefix(mulOp))
+	pkg.AddFunc("div", prefix(divOp))
+	pkg.AddFunc("mod", prefix(modOp))
+	pkg.AddFunc("neg", neg)
+	pkg.AddFunc("abs", abs)
+	pkg.AddFunc("min", minMax("min", true))
+	pkg.AddFunc("max", minMax("max", false))
+	pkg.AddFunc("eq", prefix(eqOp))
+	pkg.AddFunc("ne", prefix(neOp))
+	pkg.AddFunc("lt", prefix(ltOp))
+	pkg.AddFunc("le", prefix(leOp))
+	pkg.AddFunc("gt", prefix(gtOp))
+	pkg.AddFunc("ge", prefix(geOp))
+	pkg.AddFunc("and", prefix(andOp))
+	pkg.AddFunc("or", prefix(orOp))
+	pkg.AddFunc("xor", prefix(xorOp))
+	pkg.AddFunc("not", not)
+}
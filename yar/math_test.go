@@ -0,0 +1,109 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMath(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`sq: fn [x] [x * x]`)
+
+	for _, test := range []struct {
+		code   string
+		result string
+	}{
+		{`add 1 2`, "3"},
+		{`add 1 0.5`, "1.5"},
+		{`sub 1.5 1.5`, "0.0"},
+		{`mul 6 7`, "42"},
+		{`div 6 3`, "2"},
+		{`div 7 2`, "3.5"},
+		{`mod 7 3`, "1"},
+		{`mod 7.5 2`, "1.5"},
+		{`neg 5`, "-5"},
+		{`abs -2.5`, "2.5"},
+		{`min 3 2.5`, "2.5"},
+		{`max 3 2.5`, "3"},
+		{`max "a" "b"`, `"b"`},
+		{`eq 1 1.0`, "true"},
+		{`eq "a" "a"`, "true"},
+		{`eq [1 2] [1 2]`, "true"},
+		{`[1 [a "b"]] = [1.0 [a "b"]]`, "true"},
+		{`eq [1 2] [1 2 3]`, "false"},
+		{`ne [1 2] [2 1]`, "true"},
+		{`eq skip [0 1 2] 1 [1 2]`, "true"},
+		{`ne 'a 'b`, "true"},
+		{`lt 1 2`, "true"},
+		{`le 2 2`, "true"},
+		{`gt 1.5 2`, "false"},
+		{`ge 1s 2s`, "false"},
+		{`and true false`, "false"},
+		{`or true false`, "true"},
+		{`xor true true`, "false"},
+		{`and 12 10`, "8"},
+		{`not false`, "true"},
+		{`1 + 2 * 3`, "9"},
+		{`10 - 2 - 3`, "5"},
+		{`7 / 2`, "3.5"},
+		{`x: 2 + 3 x`, "5"},
+		{`sq 2 + 1`, "9"},
+		{`add 1 + 1 2`, "4"},
+		{`1 < 2`, "true"},
+		{`2 <= 1`, "false"},
+		{`1 = 1`, "true"},
+		{`1 <> 1`, "false"},
+		{`either 3 > 2 ["yes"] ["no"]`, `"yes"`},
+	} {
+		result, err := vm.Eval(test.code)
+		if err != nil {
+			t.Errorf("%s: %v", test.code, err)
+			continue
+		}
+		if got := vm.ToString(result); got != test.result {
+			t.Errorf("%s: got %s, want %s", test.code, got, test.result)
+		}
+	}
+}
+
+func TestMathErrors(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	for _, test := range []struct {
+		code    string
+		code2   int
+		message string
+	}{
+		{`div 1 0`, ErrMath, "div: division by zero"},
+		{`1 / 0.0`, ErrMath, "div: division by zero"},
+		{`mod 1 0`, ErrMath, "mod: division by zero"},
+		{`mul 36028797018963967 2`, ErrMath, "mul: integer overflow"},
+		{`add 36028797018963967 1`, ErrMath, "add: integer overflow"},
+		{`mul 1e300 1e300`, ErrMath, "mul: decimal overflow"},
+		{`lt 1 "a"`, ErrType, "lt expected integer! argument, got string!"},
+		{`and true 1`, ErrType, "and expected logic! argument, got integer!"},
+		{`1 +`, ErrType, "missing value after +"},
+	} {
+		_, err := vm.Eval(test.code)
+		e, ok := err.(*ScriptError)
+		if !ok || e.Code != test.code2 || !strings.Contains(e.Message, test.message) {
+			t.Errorf("%s: got %v, want %s", test.code, err, test.message)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+// M E M O R Y
+//
+// Cells live in fixed size pages. A page referenced by more than one VM is
+// shared and never written again: whoever wants to write to it copies the page
+// first. Clone marks every page of the primary VM as shared, so taking a view
+// costs one copy of the page table and the apply loop pays for the pages it
+// actually touches afterwards.
+
+const (
+	pageBits = 10
+	pageSize = 1 << pageBits
+	pageMask = pageSize - 1
+)
+
+type page [pageSize]cell
+
+// maxHeap is the number of addressable cells, pointers are 24 bits wide in
+// the obj layout.
+const maxHeap = 1 << 24
+
+// heapReserve cells are left for reporting heap exhaustion as an error.
+const heapReserve = 4096
+
+type memory struct {
+	pages []*page
+	owned []bool
+}
+
+func (m *memory) read(p ptr) cell {
+	if n := uint(p >> pageBits); n < uint(len(m.pages)) {
+		return m.pages[n][p&pageMask]
+	}
+	return 0
+}
+
+func (m *memory) write(p ptr, c cell) {
+	n := int(p >> pageBits)
+	for n >= len(m.pages) {
+		m.pages = append(m.pages, new(page))
+		m.owned = append(m.owned, true)
+	}
+	if !m.owned[n] {
+		private := *m.pages[n]
+		m.pages[n] = &private
+		m.owned[n] = true
+	}
+	m.pages[n][p&pageMask] = c
+}
+
+// share returns a copy of the page table, after the call no page is owned by
+// either side.
+func (m *memory) share() memory {
+	for i := range m.owned {
+		m.owned[i] = false
+	}
+	return m.fork()
+}
+
+// fork returns a copy of the page table of memory that does not own any of its
+// pages, it doesn't modify m.
+func (m *memory) fork() memory {
+	return memory{
+		pages: append([]*page(nil), m.pages...),
+		owned: make([]bool, len(m.pages)),
+	}
+}
+
+func (m *memory) cells(top ptr) []cell {
+	result := make([]cell, top+1)
+	for i := range result {
+		result[i] = m.read(ptr(i))
+	}
+	return result
+}
+
+func memoryOf(cells []cell) memory {
+	var m memory
+	for i, c := range cells {
+		if c != 0 {
+			m.write(ptr(i), c)
+		}
+	}
+	return m
+}
@@ -0,0 +1,283 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Modules are objects made by `module spec body`. The spec is evaluated like
+// the block of make-object: its name field names the module and its exports
+// field lists the words copied from the module to the global dictionary. The
+// body is bound to the module object, the words it sets stay private unless
+// they are exported.
+//
+//	module [name: 'deploy exports: [deploy-image]] [
+//		registry: "registry.local:5000"
+//		deploy-image: fn [image] [cluster/docker-service join registry image 80]
+//	]
+//
+// Named modules are registered in objects of the VM next to the dictionary,
+// saved, collected and hashed with it, so scripts can't replace them. Their
+// words live in memory, so a rolled back transaction forgets the modules it
+// defined. import 'deploy returns
+// the module above, reading deploy.y the first time, and import %lib/deploy.y
+// reads the file unless it was imported already or the module it declares is
+// loaded. A file holds a single module expression, or the body of a module
+// named after the file. Files are looked up in ModulePath, a VM without one
+// reads no files so replicas of a cluster don't depend on their disks.
+
+func module(vm *VM) Value {
+	spec, err := vm.nextArg("module", BlockType)
+	if err != 0 {
+		return err
+	}
+	body, err := vm.nextArg("module", BlockType)
+	if err != 0 {
+		return err
+	}
+	name, exports, err := vm.moduleSpec(spec.Block())
+	if err != 0 {
+		return err
+	}
+	return vm.defineModule(body.Block(), name, exports)
+}
+
+func _import(vm *VM) Value {
+	target, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	switch kind := target.Kind(); {
+	case isWord(kind):
+		name := vm.InverseSymbols[target.Word().Sym()]
+		if m := vm.loadedModule(name); m != 0 {
+			return m
+		}
+		return vm.importFile(name+".y", name)
+	case kind == FileType:
+		file := target.Text(vm)
+		return vm.importFile(file, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+	}
+	return vm.typeError("import", "word! or file!", target)
+}
+
+// moduleSpec evaluates the spec of a module and returns its name, "" when it
+// has none, and the block of its exports, 0 when it has none.
+func (vm *VM) moduleSpec(spec Block) (string, Block, Value) {
+	header := vm.AllocDict()
+	vm.bindObject(spec, header)
+	vm.call(spec)
+	if vm.raised != 0 {
+		return "", 0, vm.raised
+	}
+
+	var name string
+	switch value := vm.field(header, "name"); {
+	case value == 0:
+	case isWord(value.Kind()):
+		name = vm.InverseSymbols[value.Word().Sym()]
+	case value.Kind() == StringType:
+		name = value.String().String(vm)
+	default:
+		return "", 0, vm.typeError("module", "word! name", value)
+	}
+
+	exports := vm.field(header, "exports")
+	if exports != 0 && exports.Kind() != BlockType {
+		return "", 0, vm.typeError("module", "block! exports", exports)
+	}
+	return name, exports.Block(), 0
+}
+
+// defineModule evaluates the body of a module in its own object, exports the
+// words listed by exports and registers the module under its name.
+func (vm *VM) defineModule(body Block, name string, exports Block) Value {
+	object := vm.AllocDict()
+	vm.declare(body, object)
+	vm.bindObject(body, object)
+	vm.call(body)
+	if vm.raised != 0 {
+		return vm.raised
+	}
+
+	if exports != 0 {
+		for i := exports.First(vm); i != 0; i = i.Next(vm) {
+			w := i.Value(vm)
+			if !isWord(w.Kind()) {
+				return vm.typeError("module", "word! export", w)
+			}
+			sv := object.Find(vm, w.Word().Sym())
+			if sv == 0 {
+				return vm.fail(ErrModule, "module "+name+" does not define "+vm.InverseSymbols[w.Word().Sym()], 0)
+			}
+			vm.Dictionary.Put(vm, w.Word().Sym(), Value(vm.read(ptr(sv.val(vm)))))
+		}
+	}
+
+	if name != "" {
+		vm.modules.Put(vm, vm.GetSymbolID(name), object.Value())
+	}
+	return object.Value()
+}
+
+// importFile loads a module from a file, name is the name of the module when
+// the file declares none.
+func (vm *VM) importFile(file string, name string) Value {
+	path, ok := vm.findModule(file)
+	if !ok {
+		return vm.fail(ErrModule, "module not found: "+file, 0)
+	}
+	if abs, e := filepath.Abs(path); e == nil {
+		path = abs
+	}
+	if m := vm.registered(vm.moduleFiles, path); m != 0 {
+		return m
+	}
+	source, e := ioutil.ReadFile(path)
+	if e != nil {
+		return vm.fail(ErrModule, e.Error(), 0)
+	}
+	code, e := vm.Parse(string(source))
+	if e != nil {
+		return vm.raise(vm.syntaxError(e.(*SyntaxError)))
+	}
+	vm.bindGlobals(code)
+
+	body, exports := code, Block(0)
+	if spec, b, ok := vm.moduleHeader(code); ok {
+		n, x, err := vm.moduleSpec(spec)
+		if err != 0 {
+			return err
+		}
+		if n != "" {
+			name = n
+		}
+		body, exports = b, x
+	}
+
+	if m := vm.loadedModule(name); m != 0 {
+		vm.moduleFiles.Put(vm, vm.GetSymbolID(path), m)
+		return m
+	}
+	for i, loading := range vm.loading {
+		if loading == name {
+			cycle := append(vm.loading[i:len(vm.loading):len(vm.loading)], name)
+			return vm.fail(ErrModule, "import cycle: "+strings.Join(cycle, " -> "), 0)
+		}
+	}
+	vm.loading = append(vm.loading, name)
+	defer func() { vm.loading = vm.loading[:len(vm.loading)-1] }()
+	m := vm.defineModule(body, name, exports)
+	if m.Kind() == MapType {
+		vm.moduleFiles.Put(vm, vm.GetSymbolID(path), m)
+	}
+	return m
+}
+
+// findModule returns the path of a module file, relative files are searched
+// in the directories of ModulePath in order.
+func (vm *VM) findModule(file string) (string, bool) {
+	if len(vm.ModulePath) == 0 {
+		return "", false
+	}
+	if filepath.IsAbs(file) {
+		return file, isFile(file)
+	}
+	for _, dir := range vm.ModulePath {
+		if path := filepath.Join(dir, file); isFile(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// moduleHeader returns the spec and the body of code holding a single module
+// expression.
+func (vm *VM) moduleHeader(code Block) (Block, Block, bool) {
+	first := code.First(vm)
+	if first == 0 {
+		return 0, 0, false
+	}
+	w := first.Value(vm)
+	if w.Kind() != WordType || vm.InverseSymbols[w.Word().Sym()] != "module" {
+		return 0, 0, false
+	}
+	second := first.Next(vm)
+	if second == 0 || second.Value(vm).Kind() != BlockType {
+		return 0, 0, false
+	}
+	third := second.Next(vm)
+	if third == 0 || third.Value(vm).Kind() != BlockType || third.Next(vm) != 0 {
+		return 0, 0, false
+	}
+	return second.Value(vm).Block(), third.Value(vm).Block(), true
+}
+
+// bindGlobals binds loaded code to the globals it uses. Unlike bind it
+// creates no globals for the words the code sets, they go to its module.
+func (vm *VM) bindGlobals(code Block) {
+	bind(vm, code, func(sym sym, create bool) Binding {
+		sv := vm.Dictionary.Find(vm, sym)
+		if sv == 0 {
+			return 0
+		}
+		return makeMapBinding(ptr(sv))
+	})
+}
+
+// declare puts the words a block sets into an object, so the words used
+// before they are set bind to the object as well.
+func (vm *VM) declare(block Block, object dict) {
+	bind(vm, block, func(sym sym, create bool) Binding {
+		if create && object.Find(vm, sym) == 0 {
+			object.Put(vm, sym, 0)
+		}
+		return 0
+	})
+}
+
+// registered returns the module of the key in a registry, or 0 when there is
+// none.
+func (vm *VM) registered(registry dict, key string) Value {
+	m := vm.field(registry, key)
+	if m.Kind() != MapType {
+		return 0
+	}
+	return m
+}
+
+// loadedModule returns the module of the name, or 0 when it isn't loaded.
+func (vm *VM) loadedModule(name string) Value {
+	return vm.registered(vm.modules, name)
+}
+
+// field returns the value of a word of an object, or 0 when it has none.
+func (vm *VM) field(object dict, name string) Value {
+	sv := object.Find(vm, vm.GetSymbolID(name))
+	if sv == 0 {
+		return 0
+	}
+	return Value(vm.read(ptr(sv.val(vm))))
+}
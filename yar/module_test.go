@@ -0,0 +1,182 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func moduleVM(t *testing.T, files map[string]string) *VM {
+	dir := t.TempDir()
+	for name, source := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.ModulePath = []string{dir}
+	return vm
+}
+
+func evalString(t *testing.T, vm *VM, code string) string {
+	t.Helper()
+	result, err := vm.Eval(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vm.ToString(result)
+}
+
+func TestModule(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	code := `
+		module [name: 'deploy exports: [deploy-image]] [
+			registry: "registry.local/"
+			deploy-image: fn [image] [tag image]
+			tag: fn [image] [join registry image]
+		]
+		deploy-image "redis"`
+	if got := evalString(t, vm, code); got != `"registry.local/redis"` {
+		t.Errorf("got %s", got)
+	}
+	if got := evalString(t, vm, `m: import 'deploy m/registry`); got != `"registry.local/"` {
+		t.Errorf("got %s from the module", got)
+	}
+	for _, name := range []string{"registry", "tag", "name", "exports"} {
+		if vm.Dictionary.Find(vm, vm.GetSymbolID(name)) != 0 {
+			t.Errorf("private word %s is global", name)
+		}
+	}
+	if _, err := vm.Eval(`registry`); err == nil || !strings.Contains(err.Error(), "word has no value: registry") {
+		t.Errorf("got %v using a private word", err)
+	}
+	if _, err := vm.Eval(`module [exports: [missing]] [x: 1]`); err == nil || !strings.Contains(err.Error(), "does not define missing") {
+		t.Errorf("got %v exporting a missing word", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	vm := moduleVM(t, map[string]string{
+		"deploy.y": `module [name: 'deploy exports: [deploy-image]] [
+			count: 0
+			deploy-image: fn [image] [join "deployed " image]
+		]
+		`,
+		"util.y": `
+			loads: 1
+			double: fn [x] [add x x]
+		`,
+	})
+	code := `
+		import 'deploy
+		import %deploy.y
+		deploy-image "redis"`
+	if got := evalString(t, vm, code); got != `"deployed redis"` {
+		t.Errorf("got %s", got)
+	}
+
+	if got := evalString(t, vm, `u: import %util.y u/double 21`); got != "42" {
+		t.Errorf("got %s from a file module", got)
+	}
+	if got := evalString(t, vm, `u/loads: 2 u: import 'util u/loads`); got != "2" {
+		t.Errorf("module loaded %s times", got)
+	}
+	if _, err := vm.Eval(`double 1`); err == nil {
+		t.Error("file module without exports exports its words")
+	}
+}
+
+func TestImportCache(t *testing.T) {
+	vm := moduleVM(t, map[string]string{
+		"util.y": `loads: 1`,
+	})
+	if got := evalString(t, vm, `u: import %util.y u/loads: 2 modules: none`); got != "none" {
+		t.Fatalf("got %s", got)
+	}
+	// an imported file is not read again, a change to it doesn't show
+	if err := ioutil.WriteFile(filepath.Join(vm.ModulePath[0], "util.y"), []byte(`loads: [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []string{`u: import %util.y u/loads`, `u: import %./util.y u/loads`, `u: import 'util u/loads`} {
+		if got := evalString(t, vm, code); got != "2" {
+			t.Errorf("%s = %s, want 2", code, got)
+		}
+	}
+
+	// the registries are saved and collected with the VM
+	vm.GC()
+	loaded, err := LoadVM(vm.Save(), 100, vm.Library)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := evalString(t, loaded, `u: import 'util u/loads`); got != "2" {
+		t.Errorf("got %s from a loaded VM", got)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	vm := moduleVM(t, map[string]string{
+		"a.y":      `module [name: 'a] [b: import 'b]`,
+		"b.y":      `module [name: 'b] [a: import 'a]`,
+		"broken.y": `x: [1 2`,
+	})
+	_, err := vm.Eval(`import 'a`)
+	if err == nil || !strings.Contains(err.Error(), "import cycle: a -> b -> a") {
+		t.Errorf("got %v importing a cycle", err)
+	}
+	if vm.loadedModule("a") != 0 || vm.loadedModule("b") != 0 || len(vm.loading) != 0 {
+		t.Error("modules of a cycle loaded")
+	}
+
+	_, err = vm.Eval(`import 'missing`)
+	if err == nil || err.(*ScriptError).Code != ErrModule {
+		t.Errorf("got %v importing a missing module", err)
+	}
+	_, err = vm.Eval(`import %broken.y`)
+	if err == nil || err.(*ScriptError).Code != ErrSyntax {
+		t.Errorf("got %v importing a broken module", err)
+	}
+
+	vm.ModulePath = nil
+	if _, err := vm.Eval(`import %a.y`); err == nil {
+		t.Error("file read without a module path")
+	}
+}
+
+func TestImportRollback(t *testing.T) {
+	vm := moduleVM(t, map[string]string{
+		"deploy.y": `module [name: 'deploy exports: [deploy-image]] [deploy-image: fn [image] [image]]`,
+	})
+	vm.Begin()
+	if _, err := vm.Eval(`import 'deploy`); err != nil {
+		t.Fatal(err)
+	}
+	vm.Rollback()
+	if vm.loadedModule("deploy") != 0 {
+		t.Error("module loaded by a rolled back transaction")
+	}
+	if _, err := vm.Eval(`deploy-image "redis"`); err == nil {
+		t.Error("word exported by a rolled back transaction has a value")
+	}
+	if got := evalString(t, vm, `import 'deploy deploy-image "redis"`); got != `"redis"` {
+		t.Errorf("got %s", got)
+	}
+}
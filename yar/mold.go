@@ -0,0 +1,139 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import "strings"
+
+// M O L D
+//
+// Mold renders a value as yar source. Parsing the source gives an equal value
+// for data: blocks, words, paths, strings and the other literals. Objects,
+// errors, functions and natives are molded as the code which makes them, so
+// evaluating the source gives an equal value as long as object fields hold
+// values evaluating to themselves. Values a closure captured are not molded,
+// the molded function sees them unset. A block containing itself is molded as
+// [...] where it repeats.
+
+// Mold returns the source of a value.
+func (vm *VM) Mold(value Value) string {
+	m := &molder{vm: vm, seen: make(map[ptr]bool)}
+	m.value(value)
+	return m.String()
+}
+
+// MoldString returns s as a yar string literal, for code built in Go.
+func MoldString(s string) string { return escape(s) }
+
+type molder struct {
+	strings.Builder
+	vm   *VM
+	seen map[ptr]bool
+}
+
+func (m *molder) sym(sym sym) { m.WriteString(m.vm.InverseSymbols[sym]) }
+
+func (m *molder) entries(first pBlockEntry) {
+	for i := first; i != 0; i = i.Next(m.vm) {
+		if i != first {
+			m.WriteByte(' ')
+		}
+		m.value(i.Value(m.vm))
+	}
+}
+
+func (m *molder) block(value Value) {
+	p := ptr(value.Block().firstLast())
+	if m.seen[p] {
+		m.WriteString("[...]")
+		return
+	}
+	m.seen[p] = true
+	m.WriteByte('[')
+	m.entries(value.Block().First(m.vm))
+	m.WriteByte(']')
+	delete(m.seen, p)
+}
+
+func (m *molder) fields(value Value) {
+	vm := m.vm
+	m.WriteString("make-object [")
+	d := dictFirst(vm.read(ptr(value.Dict().dictFirst())))
+	for i := d.first(); i != 0; i = i.next(vm) {
+		if i != d.first() {
+			m.WriteByte(' ')
+		}
+		sv := i.symval(vm)
+		m.sym(sv.sym(vm))
+		m.WriteString(": ")
+		m.value(Value(vm.read(ptr(sv.val(vm)))))
+	}
+	m.WriteByte(']')
+}
+
+func (m *molder) value(value Value) {
+	vm := m.vm
+	switch kind := value.Kind(); kind {
+	case BlockType:
+		m.block(value)
+	case WordType:
+		m.sym(value.Word().Sym())
+	case GetWordType:
+		m.WriteByte(':')
+		m.sym(value.Word().Sym())
+	case SetWordType:
+		m.sym(value.Word().Sym())
+		m.WriteByte(':')
+	case QuoteType:
+		m.WriteByte('\'')
+		m.sym(value.Word().Sym())
+	case RefinementType:
+		m.WriteByte('/')
+		m.sym(value.Word().Sym())
+	case PathType, GetPathType, SetPathType:
+		if kind == GetPathType {
+			m.WriteByte(':')
+		}
+		fl := firstLast(vm.read(ptr(value.Path().firstLast())))
+		for i := fl.first(); i != 0; i = i.Next(vm) {
+			if i != fl.first() {
+				m.WriteByte('/')
+			}
+			m.sym(sym(i.pval(vm)))
+		}
+		if kind == SetPathType {
+			m.WriteByte(':')
+		}
+	case MapType, ErrorType:
+		m.fields(value)
+	case NativeType:
+		m.WriteString("load-native ")
+		m.WriteString(escape(vm.procNames[value.Val()]))
+	case ProcType:
+		m.proc(Proc(value))
+	case StringType:
+		m.WriteString(escape(value.Text(vm)))
+	default:
+		m.WriteString(vm.ToString(value))
+	}
+}
+
+func (m *molder) proc(p Proc) {
+	spec, body := p.blocks(m.vm)
+	m.WriteString("fn ")
+	m.block(spec.Value())
+	m.WriteByte(' ')
+	m.block(body.Value())
+}
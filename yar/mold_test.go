@@ -0,0 +1,101 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import "testing"
+
+func TestMoldData(t *testing.T) {
+	vm := NewVM(1000, 100)
+	for _, source := range []string{
+		`[a :b c: 'd /e f/g :h/i j/k: 1 -2.5 "x^"y^/z" #1 %f https://x.io h:80 30s true false none]`,
+		`[[] [[nested] blocks]]`,
+		`add 1 2`,
+	} {
+		code := vm.MustParse(source)
+		molded := vm.Mold(code.Value())
+		if molded != "["+source+"]" {
+			t.Errorf("mold %s = %s", source, molded)
+		}
+		again := vm.MustParse(molded).First(vm).Value(vm)
+		if vm.Mold(again) != molded {
+			t.Errorf("%s does not round trip", source)
+		}
+	}
+}
+
+func TestMoldCode(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`
+		o: make-object [a: 1 b: "two" c: [x y] d: none e: 2.5]
+		sum: fn [x y z] [add x y]
+	`)
+	for _, test := range []struct {
+		code   string
+		molded string
+	}{
+		{`o`, `make-object [a: 1 b: "two" c: [x y] d: none e: 2.5]`},
+		{`:sum`, `fn [x y z] [add x y]`},
+		{`:add`, `load-native "core/add"`},
+		{`mold o/c`, `"[x y]"`},
+	} {
+		value, err := vm.Eval(test.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		molded := vm.Mold(value)
+		if molded != test.molded {
+			t.Errorf("mold %s = %s, want %s", test.code, molded, test.molded)
+			continue
+		}
+		again, err := vm.Eval(molded)
+		if err != nil {
+			t.Errorf("eval %s: %v", molded, err)
+			continue
+		}
+		if vm.Mold(again) != molded {
+			t.Errorf("%s does not round trip: %s", test.code, vm.Mold(again))
+		}
+	}
+
+	if result, _ := vm.Eval(`load mold :sum`); result.Kind() != BlockType {
+		t.Errorf("load of fn source gives %s", typeName(result.Kind()))
+	}
+	if result, _ := vm.Eval(`load "42"`); result != MakeInt(42).Value() {
+		t.Errorf("load 42 = %s", vm.ToString(result))
+	}
+	if _, err := vm.Eval(`load "[1"`); err == nil || err.(*ScriptError).Code != ErrSyntax {
+		t.Errorf("load of bad source: %v", err)
+	}
+}
+
+func TestMoldString(t *testing.T) {
+	vm := NewVM(1000, 100)
+	name := `Intel(R) "Xeon" ^ CPU`
+	code := vm.MustParse("cluster/node-info 1 " + MoldString(name))
+	if got := code.First(vm).Next(vm).Next(vm).Value(vm).String().String(vm); got != name {
+		t.Errorf("got %q, want %q", got, name)
+	}
+}
+
+func TestMoldCycle(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	b, _ := vm.Eval(`b: [1] append b b`)
+	if molded := vm.Mold(b); molded != "[1 [...]]" {
+		t.Errorf("mold = %s", molded)
+	}
+}
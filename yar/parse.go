@@ -17,136 +17,363 @@ package yar
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type codeStack []Block
+// Span is the position of a parsed value in the source. Lines and columns
+// start at 1, columns count bytes.
+type Span struct {
+	Line   int
+	Column int
+	Offset int
+	Length int
+}
+
+// SyntaxError is returned by Parse.
+type SyntaxError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
 
-func (s *codeStack) push(code Block) {
-	*s = append(*s, code)
+type openBlock struct {
+	block Block
+	start int
 }
 
-func (s *codeStack) pop() Block {
-	index := len(*s) - 1
-	element := (*s)[index]
-	*s = (*s)[:index]
-	return element
+type parser struct {
+	vm         *VM
+	s          string
+	i          int
+	lineStarts []int
+	stack      []openBlock
 }
 
 func isDigit(c byte) bool {
 	return c >= '0' && c <= '9'
 }
 
-func readIdent(s string, i *int) string {
-	var ident strings.Builder
-	for *i < len(s) && strings.IndexByte(" \n[](){}:;/", s[*i]) == -1 {
-		ident.WriteByte(s[*i])
-		*i = (*i + 1)
+func (p *parser) readIdent() string {
+	start := p.i
+	for p.i < len(p.s) && strings.IndexByte(" \t\r\n[](){}:;/\"", p.s[p.i]) == -1 {
+		p.i++
 	}
-	return ident.String()
+	return p.s[start:p.i]
 }
 
-func (vm *VM) Parse(s string) Block {
-	var stack codeStack
-	result := vm.AllocBlock()
-	i := 0
+func (p *parser) span(start int) Span {
+	line := sort.Search(len(p.lineStarts), func(i int) bool { return p.lineStarts[i] > start })
+	return Span{Line: line, Column: start - p.lineStarts[line-1] + 1, Offset: start, Length: p.i - start}
+}
+
+func (p *parser) errorAt(start int, format string, args ...interface{}) error {
+	span := p.span(start)
+	return &SyntaxError{Line: span.Line, Column: span.Column, Message: fmt.Sprintf(format, args...)}
+}
 
-	for i < len(s) {
-		switch s[i] {
+// add appends a value to the block and records its span.
+func (p *parser) add(block Block, value Value, start int) {
+	block.Add(p.vm, value)
+	last := firstLast(p.vm.read(ptr(block.firstLast()))).last()
+	p.vm.setSpan(last, p.span(start))
+}
+
+// Parse parses source into a block. Spans of the parsed values are kept by the
+// VM, so errors raised while evaluating the block refer to source lines.
+func (vm *VM) Parse(s string) (Block, error) {
+	p := &parser{vm: vm, s: s, lineStarts: []int{0}}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			p.lineStarts = append(p.lineStarts, i+1)
+		}
+	}
+
+	result := vm.AllocBlock()
+	for p.i < len(s) {
+		start := p.i
+		switch s[p.i] {
 		case ' ', '\n', '\r', '\t':
-			i++
+			p.i++
 		case ']':
-			i++
+			p.i++
+			if len(p.stack) == 0 {
+				return 0, p.errorAt(start, "unexpected ]")
+			}
+			open := p.stack[len(p.stack)-1]
+			p.stack = p.stack[:len(p.stack)-1]
 			code := result
-			result = stack.pop()
-			result.Add(vm, code.Value())
+			result = open.block
+			p.add(result, code.Value(), open.start)
 		case '[':
-			i++
-			stack.push(result)
+			p.i++
+			p.stack = append(p.stack, openBlock{block: result, start: start})
 			result = vm.AllocBlock()
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-			val := 0
-			for i < len(s) && isDigit(s[i]) {
-				val = val*10 + int(s[i]-'0')
-				i++
+		case ';':
+			for p.i < len(s) && s[p.i] != '\n' {
+				p.i++
 			}
-			result.Add(vm, MakeInt(val).Value())
-
-		case '"':
-			var builder strings.Builder
-			i++
-			for i < len(s) && s[i] != '"' {
-				builder.WriteByte(s[i])
-				i++
+		case '"', '{':
+			str, err := p.string()
+			if err != nil {
+				return 0, err
 			}
-			result.Add(vm, vm.AllocString(builder.String()).Value())
-			i++
-			break
+			p.add(result, vm.AllocString(str).Value(), start)
 
 		default:
-			kind := WordType
-			c := s[i]
-			if c == '\'' {
-				kind = QuoteType
-				i++
-			} else if c == ':' {
-				kind = GetWordType
-				i++
+			value, ok, err := p.literal()
+			if err == nil && !ok {
+				value, err = p.word()
 			}
-
-			ident := readIdent(s, &i)
-
-			if i < len(s) {
-				if s[i] == ':' {
-					kind = SetWordType
-					i++
-				} else if s[i] == '\'' {
-					kind = QuoteType
-					i++
-				} else if s[i] == '/' {
-					var path path
-
-					if kind == GetWordType {
-						path = vm.AllocGetPath()
-					} else if kind == WordType {
-						path = vm.AllocPath()
-					} else {
-						panic("path not implemented")
-					}
-
-					path.Add(vm, vm.GetSymbolID(ident))
-					i++
-					for i < len(s) {
-						ident = readIdent(s, &i)
-						path.Add(vm, vm.GetSymbolID(ident))
-						if i >= len(s) || s[i] != '/' {
-							break
-						}
-						i++
-					}
-					if i < len(s) && s[i] == ':' {
-						path = toPathAnotherKind(path, SetPathType)
-						i++
-					}
-					result.Add(vm, path.Value())
-					break
-				}
+			if err != nil {
+				return 0, err
 			}
+			p.add(result, value, start)
+		}
+	}
 
-			switch kind {
-			case WordType:
-				result.Add(vm, vm.AllocWord(vm.GetSymbolID(ident)).Value())
-			case GetWordType:
-				result.Add(vm, vm.AllocGetWord(vm.GetSymbolID(ident)).Value())
-			case SetWordType:
-				result.Add(vm, vm.AllocSetWord(vm.GetSymbolID(ident)).Value())
-			case QuoteType:
-				result.Add(vm, vm.AllocQuoteWord(vm.GetSymbolID(ident)).Value())
+	if len(p.stack) != 0 {
+		return 0, p.errorAt(p.stack[len(p.stack)-1].start, "missing ]")
+	}
+	return result, nil
+}
+
+// string parses "" and {} strings. A "" string ends with the line, {} strings
+// may span lines and contain balanced braces. Both use ^ escapes: ^/ newline,
+// ^- tab, ^^, ^", ^{ and ^}.
+func (p *parser) string() (string, error) {
+	start := p.i
+	open := p.s[p.i]
+	depth := 0
+	var result strings.Builder
+	for p.i++; p.i < len(p.s); p.i++ {
+		c := p.s[p.i]
+		switch {
+		case c == '^':
+			p.i++
+			if p.i == len(p.s) {
+				return "", p.errorAt(start, "unterminated string")
+			}
+			switch e := p.s[p.i]; e {
+			case '/':
+				result.WriteByte('\n')
+			case '-':
+				result.WriteByte('\t')
+			case '^', '"', '{', '}':
+				result.WriteByte(e)
 			default:
-				fmt.Printf("kind %v", kind)
-				panic("not implemented other words")
+				return "", p.errorAt(p.i-1, "invalid escape ^%c", e)
+			}
+			continue
+		case open == '"' && c == '"', open == '{' && c == '}' && depth == 0:
+			p.i++
+			return result.String(), nil
+		case open == '"' && c == '\n':
+			return "", p.errorAt(start, "unterminated string")
+		case open == '{' && c == '{':
+			depth++
+		case open == '{' && c == '}':
+			depth--
+		}
+		result.WriteByte(c)
+	}
+	return "", p.errorAt(start, "unterminated string")
+}
+
+var (
+	integerSyntax  = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	decimalSyntax  = regexp.MustCompile(`^[-+]?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+	durationSyntax = regexp.MustCompile(`^-?([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`)
+	hostPortSyntax = regexp.MustCompile(`^([^:/'#%]+):([0-9]+)$`)
+)
+
+// maxInt is the largest integer a value can hold.
+const maxInt = 1<<55 - 1
+
+// literal parses the token at p.i if it is a literal other than a string.
+func (p *parser) literal() (Value, bool, error) {
+	vm := p.vm
+	start := p.i
+	end := start
+	for end < len(p.s) && strings.IndexByte(" \t\r\n[](){};\"", p.s[end]) == -1 {
+		end++
+	}
+	token := p.s[start:end]
+	if token == "" {
+		return 0, false, nil
+	}
+
+	number := isDigit(token[0]) || len(token) > 1 && (token[0] == '-' || token[0] == '+') && isDigit(token[1])
+	value, ok := Value(0), true
+	switch {
+	case token[0] == '#' && len(token) > 1:
+		value = vm.AllocIssue(token[1:])
+	case token[0] == '%' && len(token) > 1:
+		value = vm.AllocFile(token[1:])
+	case strings.Contains(token, "://"):
+		value = vm.AllocUrl(token)
+	case token == "true":
+		value = MakeBool(true).Value()
+	case token == "false":
+		value = MakeBool(false).Value()
+	case token == "none":
+		value = None
+	case number && integerSyntax.MatchString(token):
+		i, err := strconv.ParseInt(token, 10, 64)
+		if err != nil || i > maxInt || i < -maxInt {
+			return 0, false, p.errorAt(start, "integer out of range: %s", token)
+		}
+		value = MakeInt(int(i)).Value()
+	case number && decimalSyntax.MatchString(token):
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return 0, false, p.errorAt(start, "decimal out of range: %s", token)
+		}
+		value = vm.AllocDecimal(f)
+	case number && durationSyntax.MatchString(token):
+		d, err := time.ParseDuration(token)
+		if err != nil {
+			return 0, false, p.errorAt(start, "invalid duration: %s", token)
+		}
+		if d > maxInt || d < -maxInt {
+			return 0, false, p.errorAt(start, "duration out of range: %s", token)
+		}
+		value = MakeDuration(d)
+	case hostPortSyntax.MatchString(token):
+		m := hostPortSyntax.FindStringSubmatch(token)
+		port, err := strconv.Atoi(m[2])
+		if err != nil || port > 65535 {
+			return 0, false, p.errorAt(start, "invalid port: %s", token)
+		}
+		value = vm.AllocHostPort(m[1], port)
+	case number:
+		return 0, false, p.errorAt(start, "invalid number: %s", token)
+	default:
+		ok = false
+	}
+	if ok {
+		p.i = end
+	}
+	return value, ok, nil
+}
+
+// word parses words, get/set/lit-words, refinements and paths.
+func (p *parser) word() (Value, error) {
+	vm := p.vm
+	start := p.i
+
+	// the operator word /
+	if p.s[p.i] == '/' && (p.i+1 == len(p.s) || strings.IndexByte(" \t\r\n[]", p.s[p.i+1]) != -1) {
+		p.i++
+		return vm.AllocWord(vm.GetSymbolID("/")).Value(), nil
+	}
+
+	kind := WordType
+	switch p.s[p.i] {
+	case '/':
+		kind = RefinementType
+		p.i++
+	case '\'':
+		kind = QuoteType
+		p.i++
+	case ':':
+		kind = GetWordType
+		p.i++
+	}
+
+	ident := p.readIdent()
+	if ident == "" {
+		if p.i < len(p.s) && p.i == start {
+			p.i++
+			return 0, p.errorAt(start, "unexpected %q", p.s[start])
+		}
+		return 0, p.errorAt(start, "missing word after %c", p.s[start])
+	}
+
+	if p.i < len(p.s) {
+		switch p.s[p.i] {
+		case ':':
+			if kind != WordType {
+				return 0, p.errorAt(start, "unexpected : after %s", p.s[start:p.i])
 			}
+			kind = SetWordType
+			p.i++
+		case '/':
+			return p.path(start, kind, ident)
 		}
 	}
-	return result
+
+	switch kind {
+	case GetWordType:
+		return vm.AllocGetWord(vm.GetSymbolID(ident)).Value(), nil
+	case SetWordType:
+		return vm.AllocSetWord(vm.GetSymbolID(ident)).Value(), nil
+	case QuoteType:
+		return vm.AllocQuoteWord(vm.GetSymbolID(ident)).Value(), nil
+	case RefinementType:
+		return vm.AllocRefinement(vm.GetSymbolID(ident)).Value(), nil
+	default:
+		return vm.AllocWord(vm.GetSymbolID(ident)).Value(), nil
+	}
+}
+
+func (p *parser) path(start int, kind int, ident string) (Value, error) {
+	vm := p.vm
+
+	var path path
+	switch kind {
+	case GetWordType:
+		path = vm.AllocGetPath()
+	case WordType:
+		path = vm.AllocPath()
+	default:
+		return 0, p.errorAt(start, "%s can't start a path", typeName(kind))
+	}
+
+	path.Add(vm, vm.GetSymbolID(ident))
+	for p.i < len(p.s) && p.s[p.i] == '/' {
+		p.i++
+		ident = p.readIdent()
+		if ident == "" {
+			return 0, p.errorAt(start, "empty segment in path %s", p.s[start:p.i])
+		}
+		path.Add(vm, vm.GetSymbolID(ident))
+	}
+
+	if p.i < len(p.s) && p.s[p.i] == ':' {
+		if kind == GetWordType {
+			return 0, p.errorAt(start, "get-path can't be set: %s", p.s[start:p.i+1])
+		}
+		path = toPathAnotherKind(path, SetPathType)
+		p.i++
+	}
+	return path.Value(), nil
+}
+
+// MustParse is like Parse but panics if the source can't be parsed. It is
+// meant for code embedded in Go sources.
+func (vm *VM) MustParse(s string) Block {
+	code, err := vm.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
+
+func (vm *VM) setSpan(entry pBlockEntry, span Span) {
+	vm.ownMaps()
+	vm.spans[entry] = span
+}
+
+// spanAt returns the span of the value at entry, if it was parsed.
+func (vm *VM) spanAt(entry pBlockEntry) (Span, bool) {
+	span, ok := vm.spans[entry]
+	return span, ok
 }
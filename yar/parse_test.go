@@ -19,6 +19,99 @@ import "testing"
 
 func TestParse(t *testing.T) {
 	vm := NewVM(1000, 100)
-	vm.Parse("add 1 2")
+	if _, err := vm.Parse("add 1 2"); err != nil {
+		t.Fatal(err)
+	}
 	vm.Dump()
 }
+
+func TestParseErrors(t *testing.T) {
+	vm := NewVM(1000, 100)
+	for _, test := range []struct {
+		source  string
+		line    int
+		column  int
+		message string
+	}{
+		{`add 1 ]`, 1, 7, "unexpected ]"},
+		{"x: [1 2\n  [3]", 1, 4, "missing ]"},
+		{"print \"hello\nworld", 1, 7, "unterminated string"},
+		{"o/a\n  o//b", 2, 3, "empty segment in path o/"},
+		{`o/a/`, 1, 1, "empty segment in path o/a/"},
+		{`'o/a`, 1, 1, "lit-word! can't start a path"},
+		{`/o/a`, 1, 1, "refinement! can't start a path"},
+		{`:o/a:`, 1, 1, "get-path can't be set: :o/a:"},
+		{`x (1)`, 1, 3, `unexpected '('`},
+		{"\t: x", 1, 2, "missing word after :"},
+		{"1\n 12abc", 2, 2, "invalid number: 12abc"},
+		{`99999999999999999999`, 1, 1, "integer out of range: 99999999999999999999"},
+		{`localhost:99999`, 1, 1, "invalid port: localhost:99999"},
+		{`1000000h`, 1, 1, "duration out of range: 1000000h"},
+		{`-1000000h`, 1, 1, "duration out of range: -1000000h"},
+		{`"a^xb"`, 1, 3, "invalid escape ^x"},
+		{"x: {a {b}\n", 1, 4, "unterminated string"},
+	} {
+		_, err := vm.Parse(test.source)
+		e, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%q: expected syntax error, got %v", test.source, err)
+			continue
+		}
+		if e.Line != test.line || e.Column != test.column || e.Message != test.message {
+			t.Errorf("%q: got %v, want line %d, column %d: %s", test.source, e, test.line, test.column, test.message)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	vm := NewVM(1000, 100)
+	code := vm.MustParse("print 1\n  o/a: [x\n \"y\"]")
+	var got []Span
+	for i := code.First(vm); i != 0; i = i.Next(vm) {
+		span, _ := vm.spanAt(i)
+		got = append(got, span)
+	}
+	want := []Span{{1, 1, 0, 5}, {1, 7, 6, 1}, {2, 3, 10, 4}, {2, 8, 15, 8}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d spans, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("span %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	_, err := vm.Eval("x: 1\nprint x\n  add x missing")
+	e := err.(*ScriptError)
+	if e.Line != 3 || e.Column != 9 {
+		t.Errorf("error at line %d, column %d, want 3, 9", e.Line, e.Column)
+	}
+	if result, _ := vm.Eval("e: try [\n  add 1 missing] e/line"); result != MakeInt(2).Value() {
+		t.Errorf("e/line = %s, want 2", vm.ToString(result))
+	}
+
+	_, err = vm.Eval("x: [\n  1 \"2]")
+	e = err.(*ScriptError)
+	if e.Code != ErrSyntax || e.Line != 2 || e.Column != 5 {
+		t.Errorf("syntax error %d at line %d, column %d, want %d at 2, 5", e.Code, e.Line, e.Column, ErrSyntax)
+	}
+
+	vm.GC()
+	_, err = vm.Eval("\n\nmissing")
+	if e := err.(*ScriptError); e.Line != 3 {
+		t.Errorf("error after gc at line %d, want 3", e.Line)
+	}
+}
+
+func TestParseRefinement(t *testing.T) {
+	vm := NewVM(1000, 100)
+	code := vm.MustParse("[a /local b]")
+	value := code.First(vm).Value(vm).Block().First(vm).Next(vm).Value(vm)
+	if value.Kind() != RefinementType || vm.ToString(value) != "/local" {
+		t.Errorf("got %s, want /local refinement", vm.ToString(value))
+	}
+}
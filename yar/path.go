@@ -16,7 +16,6 @@
 package yar
 
 import (
-	"fmt"
 	"strings"
 )
 
@@ -61,76 +60,92 @@ func pathBind(vm *VM, value Value, factory bindFactory) {
 	sym := sym(first.pval(vm))
 	bindings := factory(sym, false)
 	if bindings != 0 {
-		vm.write(ptr(p.bindings()), cell(bindings))
+		vm.writeBinding(ptr(p.bindings()), bindings)
 	}
 }
 
-func getPathExec(vm *VM, val Value) Value {
+// resolvePath walks the path down to the cell holding the value of its last
+// step, the cell is 0 for a single word path. The walk stops at a function,
+// the rest of the path are its refinements.
+func resolvePath(vm *VM, val Value) (Value, ptr, pBlockEntry, Value) {
 	p := val.Path()
+	fl := firstLast(vm.read(ptr(p.firstLast())))
+	first := fl.first()
 	bindings := Binding(vm.read(ptr(p.bindings())))
 	if bindings == 0 {
-		// fmt.Printf("%016x, %d, %s\n", val, p.sym(), vm.InverseSymbols[w.Sym()])
-		panic("getpath not bound")
+		bindings = vm.lateBind(sym(first.pval(vm)), p.bindings())
+	}
+	if bindings == 0 {
+		return 0, 0, 0, vm.fail(ErrNotBound, "path not bound: "+pathToString(vm, p)[1:], val)
 	}
 	bindingKind := bindings.Kind()
-	bound := vm.getBound[bindingKind](bindings).Dict()
-	// fmt.Printf("bound %s\n", vm.toString(bound.Value()))
+	bound := vm.getBound[bindingKind](bindings)
 
-	fl := firstLast(vm.read(ptr(p.firstLast())))
-	first := fl.first()
 	i := first.Next(vm)
 
-	for i != 0 {
+	var valptr ptr
+	for i != 0 && bound.Kind() != ProcType && bound.Kind() != NativeType {
 		sym := sym(i.pval(vm))
-		// fmt.Printf("looking for sym: %s\n", vm.InverseSymbols[sym])
-		psv := bound.Find(vm, sym)
-		sv := symval(vm.read(ptr(psv)))
-		// fmt.Printf("BOUND: %016x\n", psv)
-		bound = dict(vm.read(sv.val()))
+		if kind := bound.Kind(); kind != MapType && kind != ErrorType {
+			return 0, 0, 0, vm.fail(ErrType, "can't take "+vm.InverseSymbols[sym]+" of "+typeName(kind)+" in path "+pathToString(vm, p)[1:], val)
+		}
+		psv := bound.Dict().Find(vm, sym)
+		if psv == 0 {
+			return 0, 0, 0, vm.fail(ErrNoField, "no field "+vm.InverseSymbols[sym]+" in path "+pathToString(vm, p)[1:], val)
+		}
+		valptr = symval(vm.read(ptr(psv))).val()
+		bound = Value(vm.read(valptr))
 		i = i.Next(vm)
 	}
 
-	// if val.Kind() == GetWordType {
-	// 	fmt.Printf(" // %s\n", vm.toString(bound))
-	// }
-	return Value(bound)
+	return bound, valptr, i, 0
+}
+
+func refinementsError(vm *VM, val Value) Value {
+	return vm.fail(ErrType, "refinements need a function call: "+pathToString(vm, val.Path())[1:], val)
+}
+
+func getPathExec(vm *VM, val Value) Value {
+	bound, _, refinements, err := resolvePath(vm, val)
+	if err != 0 {
+		return err
+	}
+	if refinements != 0 {
+		return refinementsError(vm, val)
+	}
+	return bound
 }
 
 func pathExec(vm *VM, val Value) Value {
-	bound := getPathExec(vm, val)
+	bound, _, refinements, err := resolvePath(vm, val)
+	if err != 0 {
+		return err
+	}
+	if refinements != 0 {
+		if bound.Kind() == NativeType {
+			return vm.callNative(bound, refinements)
+		}
+		return vm.callProc(Proc(bound), refinements)
+	}
 	return vm.execFunc[bound.Kind()](vm, bound)
-	// return getPathExec(vm, val)
 }
 
 func setPathExec(vm *VM, val Value) Value {
-	p := val.Path()
-	bindings := Binding(vm.read(ptr(p.bindings())))
-	if bindings == 0 {
-		// fmt.Printf("%016x, %d, %s\n", val, p.sym(), vm.InverseSymbols[w.Sym()])
-		panic("getpath not bound")
+	_, valptr, refinements, err := resolvePath(vm, val)
+	if err != 0 {
+		return err
 	}
-	bindingKind := bindings.Kind()
-	bound := vm.getBound[bindingKind](bindings).Dict()
-	// fmt.Printf("bound %s\n", vm.toString(bound.Value()))
-
-	fl := firstLast(vm.read(ptr(p.firstLast())))
-	first := fl.first()
-	i := first.Next(vm)
-
-	var valptr ptr
-	for i != 0 {
-		sym := sym(i.pval(vm))
-		// fmt.Printf("looking for sym: %s\n", vm.InverseSymbols[sym])
-		psv := bound.Find(vm, sym)
-		sv := symval(vm.read(ptr(psv)))
-		// fmt.Printf("BOUND: %016x\n", psv)
-		valptr = sv.val()
-		bound = dict(vm.read(valptr))
-		i = i.Next(vm)
+	if refinements != 0 {
+		return refinementsError(vm, val)
+	}
+	if valptr == 0 {
+		return vm.fail(ErrNotBound, "set-path needs a field: "+pathToString(vm, val.Path())[1:], val)
 	}
 
 	toWrite := vm.Next()
-	fmt.Printf("to write %016x\n", toWrite)
+	if vm.raised != 0 {
+		return vm.raised
+	}
 	vm.write(valptr, cell(toWrite))
 
 	return toWrite
@@ -0,0 +1,332 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"time"
+)
+
+// P R O F I L E R
+//
+// The profiler is a hook keeping a tree of the calls made, each node holds
+// the instructions evaluated and the time spent in it while no other function
+// or native was called. Instructions are counted one by one; the clock is read
+// at calls and returns and every Rate instructions, the time since the last
+// read goes to the node being evaluated. Natives evaluate their arguments
+// themselves, so calls made by the arguments are nested in the native. The
+// tree is exported in the pprof format, `go tool pprof` shows it like a Go
+// profile.
+
+// Profiler is a hook profiling evaluation. It may be kept set across
+// evaluations, Stop must be called when each of them ends.
+type Profiler struct {
+	// Rate is the number of instructions between two reads of the clock.
+	Rate int
+
+	root    *profileNode
+	node    *profileNode
+	start   time.Time
+	last    time.Time
+	running bool
+	count   int
+}
+
+type profileNode struct {
+	name         string
+	parent       *profileNode
+	children     map[string]*profileNode
+	frames       int // len(vm.Frames()) in the node
+	instructions int64
+	nanos        int64
+}
+
+const defaultProfileRate = 100
+
+// topLevel names the code evaluated outside of calls.
+const topLevel = "(top level)"
+
+func NewProfiler() *Profiler {
+	root := &profileNode{name: topLevel, children: make(map[string]*profileNode)}
+	return &Profiler{Rate: defaultProfileRate, root: root, node: root, start: time.Now()}
+}
+
+// Stop charges the time since the last read of the clock, the profiler then
+// doesn't count time until the next evaluation starts.
+func (p *Profiler) Stop() {
+	if p.running {
+		p.tick()
+		p.running = false
+	}
+	p.node = p.root
+}
+
+func (p *Profiler) tick() {
+	now := time.Now()
+	if p.running {
+		p.node.nanos += int64(now.Sub(p.last))
+	}
+	p.last, p.running, p.count = now, true, 0
+}
+
+// sync drops the nodes of frames unwound by a panic.
+func (p *Profiler) sync(frames int) {
+	for p.node.frames > frames {
+		p.node = p.node.parent
+	}
+}
+
+func (p *Profiler) Next(vm *VM, pos Position) {
+	if !p.running {
+		p.tick()
+	}
+	p.sync(len(vm.frames))
+	p.node.instructions++
+	if p.count++; p.count >= p.Rate {
+		p.tick()
+	}
+}
+
+func (p *Profiler) Call(vm *VM, frame *Frame) {
+	p.tick()
+	p.sync(len(vm.frames) - 1)
+	child, ok := p.node.children[frame.Name]
+	if !ok {
+		child = &profileNode{name: frame.Name, parent: p.node, children: make(map[string]*profileNode), frames: len(vm.frames)}
+		p.node.children[frame.Name] = child
+	}
+	p.node = child
+}
+
+func (p *Profiler) Return(vm *VM, frame *Frame, result Value) {
+	p.tick()
+	p.sync(len(vm.frames))
+	if p.node != p.root {
+		p.node = p.node.parent
+	}
+}
+
+// ProfileEntry is the profile of a function or native. Flat values are
+// counted while it was evaluated itself, cumulative ones also include what it
+// called.
+type ProfileEntry struct {
+	Name            string
+	Instructions    int64
+	CumInstructions int64
+	Wall            time.Duration
+	CumWall         time.Duration
+}
+
+// Top returns the profile of each function and native, the ones evaluating
+// the most instructions first.
+func (p *Profiler) Top() []ProfileEntry {
+	entries := make(map[string]*ProfileEntry)
+	p.samples(func(stack []*profileNode) {
+		leaf := stack[0]
+		seen := make(map[string]bool)
+		for i, node := range stack {
+			if seen[node.name] {
+				continue
+			}
+			seen[node.name] = true
+			e := entries[node.name]
+			if e == nil {
+				e = &ProfileEntry{Name: node.name}
+				entries[node.name] = e
+			}
+			if i == 0 {
+				e.Instructions += leaf.instructions
+				e.Wall += time.Duration(leaf.nanos)
+			}
+			e.CumInstructions += leaf.instructions
+			e.CumWall += time.Duration(leaf.nanos)
+		}
+	})
+	result := make([]ProfileEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Instructions != result[j].Instructions {
+			return result[i].Instructions > result[j].Instructions
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// samples calls f with the stack, leaf first, of every node which has values.
+func (p *Profiler) samples(f func(stack []*profileNode)) {
+	var walk func(node *profileNode, stack []*profileNode)
+	walk = func(node *profileNode, stack []*profileNode) {
+		stack = append([]*profileNode{node}, stack...)
+		if node.instructions != 0 || node.nanos != 0 {
+			f(stack)
+		}
+		names := make([]string, 0, len(node.children))
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			walk(node.children[name], stack)
+		}
+	}
+	walk(p.root, nil)
+}
+
+// WriteTo writes the profile in the gzipped protobuf format of pprof.
+func (p *Profiler) WriteTo(w io.Writer) (int64, error) {
+	b := &profileBuilder{strings: map[string]int64{"": 0}, stringTable: []string{""}, functions: make(map[string]uint64)}
+	instructions, count := b.string("instructions"), b.string("count")
+	b.message(1, func(m *protobuf) { m.int64(1, instructions); m.int64(2, count) })
+	b.message(1, func(m *protobuf) { m.int64(1, b.string("wall")); m.int64(2, b.string("nanoseconds")) })
+	p.samples(func(stack []*profileNode) {
+		locations := make([]uint64, len(stack))
+		for i, node := range stack {
+			locations[i] = b.function(node.name)
+		}
+		leaf := stack[0]
+		b.message(2, func(m *protobuf) {
+			m.packedUint64(1, locations)
+			m.packedInt64(2, []int64{leaf.instructions, leaf.nanos})
+		})
+	})
+	for i, name := range b.names {
+		id := uint64(i + 1)
+		b.message(4, func(m *protobuf) {
+			m.uint64(1, id)
+			m.message(4, func(line *protobuf) { line.uint64(1, id) })
+		})
+		nameID := b.string(name)
+		b.message(5, func(m *protobuf) {
+			m.uint64(1, id)
+			m.int64(2, nameID)
+			m.int64(3, nameID)
+		})
+	}
+	for _, s := range b.stringTable {
+		b.bytes(6, []byte(s))
+	}
+	b.int64(9, p.start.UnixNano())
+	b.int64(10, int64(time.Since(p.start)))
+	b.message(11, func(m *protobuf) { m.int64(1, instructions); m.int64(2, count) })
+	b.int64(12, 1)
+
+	counter := &countingWriter{w: w}
+	zw := gzip.NewWriter(counter)
+	if _, err := zw.Write(b.data); err != nil {
+		return counter.n, err
+	}
+	err := zw.Close()
+	return counter.n, err
+}
+
+type profileBuilder struct {
+	protobuf
+	strings     map[string]int64
+	stringTable []string
+	functions   map[string]uint64
+	names       []string
+}
+
+// string returns the index of s in the string table. Strings added after the
+// table is written are lost, so names are added with the functions first.
+func (b *profileBuilder) string(s string) int64 {
+	if i, ok := b.strings[s]; ok {
+		return i
+	}
+	i := int64(len(b.stringTable))
+	b.strings[s] = i
+	b.stringTable = append(b.stringTable, s)
+	return i
+}
+
+// function returns the id of the function and of its location, they are the
+// same.
+func (b *profileBuilder) function(name string) uint64 {
+	if id, ok := b.functions[name]; ok {
+		return id
+	}
+	b.string(name)
+	b.names = append(b.names, name)
+	id := uint64(len(b.names))
+	b.functions[name] = id
+	return id
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// protobuf encodes the few wire types a profile needs.
+type protobuf struct {
+	data []byte
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protobuf) key(tag int, wire int) { b.varint(uint64(tag)<<3 | uint64(wire)) }
+
+func (b *protobuf) uint64(tag int, x uint64) {
+	b.key(tag, 0)
+	b.varint(x)
+}
+
+func (b *protobuf) int64(tag int, x int64) { b.uint64(tag, uint64(x)) }
+
+func (b *protobuf) bytes(tag int, s []byte) {
+	b.key(tag, 2)
+	b.varint(uint64(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *protobuf) message(tag int, f func(m *protobuf)) {
+	var m protobuf
+	f(&m)
+	b.bytes(tag, m.data)
+}
+
+func (b *protobuf) packedUint64(tag int, x []uint64) {
+	var m protobuf
+	for _, v := range x {
+		m.varint(v)
+	}
+	b.bytes(tag, m.data)
+}
+
+func (b *protobuf) packedInt64(tag int, x []int64) {
+	var m protobuf
+	for _, v := range x {
+		m.varint(uint64(v))
+	}
+	b.bytes(tag, m.data)
+}
@@ -0,0 +1,141 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+func profile(t *testing.T, vm *VM, p *Profiler, code string) {
+	t.Helper()
+	vm.Hook = p
+	_, err := vm.Eval(code)
+	p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func entry(p *Profiler, name string) ProfileEntry {
+	for _, e := range p.Top() {
+		if e.Name == name {
+			return e
+		}
+	}
+	return ProfileEntry{}
+}
+
+func TestProfiler(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	p := NewProfiler()
+	profile(t, vm, p, `sq: fn [x] [x * x] fact: fn [n] [either n > 1 [n * fact n - 1] [1]] loop 3 [sq 4] fact 5`)
+
+	// x * x is two instructions
+	if e := entry(p, "sq"); e.Instructions != 6 || e.CumInstructions != 6 {
+		t.Errorf("sq: %+v", e)
+	}
+	// loop evaluates its arguments and three times sq 4
+	if e := entry(p, "core/loop"); e.Instructions != 8 || e.CumInstructions != 14 {
+		t.Errorf("loop: %+v", e)
+	}
+	// recursive calls are counted once in cumulative values: everything but
+	// the word either of the outer call runs inside of either
+	fact, either := entry(p, "fact"), entry(p, "core/either")
+	if fact.CumInstructions != either.CumInstructions+1 {
+		t.Errorf("fact: %+v, either: %+v", fact, either)
+	}
+	top := entry(p, topLevel)
+	var total int64
+	for _, e := range p.Top() {
+		total += e.Instructions
+	}
+	if top.CumInstructions != total {
+		t.Errorf("top level cumulative %d, total %d", top.CumInstructions, total)
+	}
+	if top.CumWall == 0 {
+		t.Error("no time measured")
+	}
+}
+
+func TestProfilerPathNames(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	p := NewProfiler()
+	profile(t, vm, p, `o: make-object [f: fn [x] [x * x] g: fn [x /twice] [either twice [x + x] [x]] in: make-object [h: fn [] [1]]]
+		o/f 2 o/g/twice 1 o/g 2 o/in/h`)
+	for name, calls := range map[string]int64{"o/f": 2, "o/g": 2, "o/in/h": 1} {
+		if e := entry(p, name); e.Instructions != calls {
+			t.Errorf("%s: %+v, want %d instructions", name, e, calls)
+		}
+	}
+	if e := entry(p, "fn"); e.Name != "" {
+		t.Errorf("path calls named fn: %+v", e)
+	}
+}
+
+func TestProfilerUnwind(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	p := NewProfiler()
+	vm.Limits = Limits{Cells: 1000}
+	vm.Hook = p
+	if _, err := vm.Eval(`grow: fn [b] [forever [append b "x"]] grow []`); err == nil {
+		t.Fatal("no limit error")
+	}
+	p.Stop()
+	vm.Limits = Limits{}
+	profile(t, vm, p, `f: fn [] [1] f`)
+	if e := entry(p, "f"); e.Instructions != 1 {
+		t.Errorf("f after unwinding: %+v", e)
+	}
+	for _, e := range p.Top() {
+		if e.Name == "f" && e.CumInstructions != 1 {
+			t.Errorf("f called inside of an unwound frame: %+v", e)
+		}
+	}
+}
+
+func TestProfileFormat(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	p := NewProfiler()
+	profile(t, vm, p, `f: fn [n] [n + 1] loop 10 [f 1]`)
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a Profile starts with sample_type, field 1 of wire type 2
+	if len(data) == 0 || data[0] != 1<<3|2 {
+		t.Fatalf("not a profile: % x", data[:8])
+	}
+	for _, name := range []string{"instructions", "wall", "nanoseconds", "f", "core/loop", topLevel} {
+		if !bytes.Contains(data, []byte(name)) {
+			t.Errorf("no %s in the profile", name)
+		}
+	}
+}
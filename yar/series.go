@@ -0,0 +1,697 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"sort"
+	"strings"
+)
+
+// S E R I E S
+//
+// Blocks and strings are series, a series value is a position in the series.
+// Positions passed to pick and at count from 1 like in Rebol. Natives changing
+// a series change it in place, every value referring to the series sees the
+// change.
+
+func isSeries(kind int) bool { return kind == BlockType || kind == StringType }
+
+func (vm *VM) nextSeries(native string) (Value, Value) {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return 0, err
+	}
+	if !isSeries(value.Kind()) {
+		return 0, vm.typeError(native, "series!", value)
+	}
+	return value, 0
+}
+
+func seriesIndex(series Value) int {
+	if series.Kind() == BlockType {
+		return series.Block().Index()
+	}
+	return series.String().Index()
+}
+
+// seriesAt returns the series at the index, clamped to the head and the tail.
+func (vm *VM) seriesAt(series Value, index int) Value {
+	if index < 0 {
+		index = 0
+	}
+	if n := vm.seriesSize(series); index > n {
+		index = n
+	}
+	if series.Kind() == BlockType {
+		return series.Block().at(index).Value()
+	}
+	return series.String().at(index).Value()
+}
+
+// seriesSize returns the length of the series from its head.
+func (vm *VM) seriesSize(series Value) int {
+	if series.Kind() == BlockType {
+		n := 0
+		for i := series.Block().head(vm); i != 0; i = i.Next(vm) {
+			n++
+		}
+		return n
+	}
+	return len(vm.runes(series.String()))
+}
+
+func (vm *VM) runes(s String) []rune { return []rune(vm.readText(s.text())) }
+
+// runesAt returns the runes of a string and its index, clamped to their
+// length as another series over the text may have shortened it.
+func (vm *VM) runesAt(s String) ([]rune, int) {
+	text := vm.runes(s)
+	if index := s.Index(); index < len(text) {
+		return text, index
+	}
+	return text, len(text)
+}
+
+func (vm *VM) setRunes(s String, text []rune) { vm.writeText(s.text(), string(text)) }
+
+// form returns the text a value adds to a string.
+func (vm *VM) form(value Value) []rune { return []rune(vm.formText(value)) }
+
+// entryBefore returns the entry preceding the index, 0 at the head.
+func (b Block) entryBefore(vm *VM) pBlockEntry {
+	if b.Index() == 0 {
+		return 0
+	}
+	return b.at(b.Index() - 1).First(vm)
+}
+
+// insert puts the value at the index of the block.
+func (b Block) insert(vm *VM, value Value) {
+	prev := b.entryBefore(vm)
+	next := b.First(vm)
+	if next == 0 {
+		b.Add(vm, value)
+		return
+	}
+	entry := vm.alloc(cell(makeItem(int(vm.alloc(cell(value))), ptr(next))))
+	if prev == 0 {
+		fl := firstLast(vm.read(ptr(b.firstLast())))
+		vm.write(ptr(b.firstLast()), cell(makeFirstLast(pBlockEntry(entry), fl.last())))
+		return
+	}
+	vm.modified(prev)
+	pItem(prev).setPtr(vm, entry)
+}
+
+// remove takes the entry at the index out of the block.
+func (b Block) remove(vm *VM) {
+	entry := b.First(vm)
+	if entry == 0 {
+		return
+	}
+	prev := b.entryBefore(vm)
+	next := entry.Next(vm)
+	fl := firstLast(vm.read(ptr(b.firstLast())))
+	first, last := fl.first(), fl.last()
+	if prev == 0 {
+		first = next
+	} else {
+		vm.modified(prev)
+		pItem(prev).setPtr(vm, ptr(next))
+	}
+	if entry == last {
+		last = prev
+	}
+	vm.write(ptr(b.firstLast()), cell(makeFirstLast(first, last)))
+}
+
+// clear takes the entries from the index to the tail out of the block.
+func (b Block) clear(vm *VM) {
+	if b.First(vm) == 0 {
+		return
+	}
+	prev := b.entryBefore(vm)
+	first := firstLast(vm.read(ptr(b.firstLast()))).first()
+	if prev == 0 {
+		first = 0
+	} else {
+		vm.modified(prev)
+		pItem(prev).setPtr(vm, 0)
+	}
+	vm.write(ptr(b.firstLast()), cell(makeFirstLast(first, prev)))
+}
+
+// change replaces the value of an entry.
+func (e pBlockEntry) change(vm *VM, value Value) {
+	vm.modified(e)
+	vm.write(ptr(e), cell(makeItem(int(vm.alloc(cell(value))), ptr(e.Next(vm)))))
+}
+
+// values returns the values of a block from its index.
+func (b Block) values(vm *VM) []Value {
+	var result []Value
+	for i := b.First(vm); i != 0; i = i.Next(vm) {
+		result = append(result, i.Value(vm))
+	}
+	return result
+}
+
+func (vm *VM) blockOf(values []Value) Block {
+	result := vm.AllocBlock()
+	for _, value := range values {
+		result.Add(vm, value)
+	}
+	return result
+}
+
+func length(vm *VM) Value {
+	series, err := vm.nextSeries("length?")
+	if err != 0 {
+		return err
+	}
+	n := vm.seriesSize(series) - seriesIndex(series)
+	if n < 0 {
+		n = 0
+	}
+	return MakeInt(n).Value()
+}
+
+// pickAt returns the value at the position from the index, none out of the
+// series.
+func (vm *VM) pickAt(series Value, n int) Value {
+	if n < 0 {
+		return None
+	}
+	if series.Kind() == BlockType {
+		b := series.Block()
+		entry := b.at(b.Index() + n).First(vm)
+		if entry == 0 {
+			return None
+		}
+		return entry.Value(vm)
+	}
+	text := []rune(series.Text(vm))
+	if n >= len(text) {
+		return None
+	}
+	return vm.AllocString(string(text[n])).Value()
+}
+
+func first(vm *VM) Value {
+	series, err := vm.nextSeries("first")
+	if err != 0 {
+		return err
+	}
+	return vm.pickAt(series, 0)
+}
+
+func last(vm *VM) Value {
+	series, err := vm.nextSeries("last")
+	if err != 0 {
+		return err
+	}
+	return vm.pickAt(series, vm.seriesSize(series)-seriesIndex(series)-1)
+}
+
+func pick(vm *VM) Value {
+	series, err := vm.nextSeries("pick")
+	if err != 0 {
+		return err
+	}
+	n, err := vm.nextArg("pick", IntegerType)
+	if err != 0 {
+		return err
+	}
+	return vm.pickAt(series, n.Val()-1)
+}
+
+func at(vm *VM) Value {
+	series, err := vm.nextSeries("at")
+	if err != 0 {
+		return err
+	}
+	n, err := vm.nextArg("at", IntegerType)
+	if err != 0 {
+		return err
+	}
+	return vm.seriesAt(series, seriesIndex(series)+n.Val()-1)
+}
+
+func skip(vm *VM) Value {
+	series, err := vm.nextSeries("skip")
+	if err != 0 {
+		return err
+	}
+	n, err := vm.nextArg("skip", IntegerType)
+	if err != 0 {
+		return err
+	}
+	return vm.seriesAt(series, seriesIndex(series)+n.Val())
+}
+
+func head(vm *VM) Value {
+	series, err := vm.nextSeries("head")
+	if err != 0 {
+		return err
+	}
+	return vm.seriesAt(series, 0)
+}
+
+func tail(vm *VM) Value {
+	series, err := vm.nextSeries("tail")
+	if err != 0 {
+		return err
+	}
+	return vm.seriesAt(series, vm.seriesSize(series))
+}
+
+// insert series value puts the value at the position and returns the series
+// after it. A block is inserted as one value, a string gets the text of the
+// value.
+func insert(vm *VM) Value {
+	series, err := vm.nextSeries("insert")
+	if err != 0 {
+		return err
+	}
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	index := seriesIndex(series)
+	if series.Kind() == BlockType {
+		series.Block().insert(vm, value)
+		return series.Block().at(index + 1).Value()
+	}
+	s := series.String()
+	text, index := vm.runesAt(s)
+	add := vm.form(value)
+	vm.setRunes(s, append(text[:index], append(add, text[index:]...)...))
+	return s.at(index + len(add)).Value()
+}
+
+// remove series removes the value at the position, remove/part series n
+// removes n values.
+func remove(vm *VM) Value {
+	flags, err := vm.refinements("part")
+	if err != 0 {
+		return err
+	}
+	series, err := vm.nextSeries("remove")
+	if err != 0 {
+		return err
+	}
+	n := 1
+	if flags&1 != 0 {
+		count, err := vm.nextArg("remove", IntegerType)
+		if err != 0 {
+			return err
+		}
+		n = count.Val()
+	}
+	if series.Kind() == BlockType {
+		for i := 0; i < n; i++ {
+			series.Block().remove(vm)
+		}
+		return series
+	}
+	s := series.String()
+	text, index := vm.runesAt(s)
+	end := index + n
+	if end > len(text) {
+		end = len(text)
+	}
+	if index < end {
+		vm.setRunes(s, append(text[:index], text[end:]...))
+	}
+	return series
+}
+
+// clear series removes the values from the position to the tail.
+func _clear(vm *VM) Value {
+	series, err := vm.nextSeries("clear")
+	if err != 0 {
+		return err
+	}
+	if series.Kind() == BlockType {
+		series.Block().clear(vm)
+		return series
+	}
+	s := series.String()
+	if text, index := vm.runesAt(s); index < len(text) {
+		vm.setRunes(s, text[:index])
+	}
+	return series
+}
+
+// change series value replaces the value at the position and returns the
+// series after it.
+func change(vm *VM) Value {
+	series, err := vm.nextSeries("change")
+	if err != 0 {
+		return err
+	}
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	index := seriesIndex(series)
+	if series.Kind() == BlockType {
+		b := series.Block()
+		if entry := b.First(vm); entry != 0 {
+			entry.change(vm, value)
+		} else {
+			b.Add(vm, value)
+		}
+		return b.at(index + 1).Value()
+	}
+	s := series.String()
+	text, index := vm.runesAt(s)
+	add := vm.form(value)
+	end := index + len(add)
+	if end > len(text) {
+		end = len(text)
+	}
+	vm.setRunes(s, append(text[:index], append(add, text[end:]...)...))
+	return s.at(index + len(add)).Value()
+}
+
+// copy series copies the series from its position, copy/part series n copies
+// n values. Blocks are copied shallow.
+func _copy(vm *VM) Value {
+	flags, err := vm.refinements("part")
+	if err != 0 {
+		return err
+	}
+	series, err := vm.nextSeries("copy")
+	if err != 0 {
+		return err
+	}
+	n := -1
+	if flags&1 != 0 {
+		count, err := vm.nextArg("copy", IntegerType)
+		if err != 0 {
+			return err
+		}
+		n = count.Val()
+	}
+	if series.Kind() == BlockType {
+		result := vm.AllocBlock()
+		for i := series.Block().First(vm); i != 0 && n != 0; i = i.Next(vm) {
+			result.Add(vm, i.Value(vm))
+			n--
+		}
+		return result.Value()
+	}
+	text := []rune(series.Text(vm))
+	if n >= 0 && n < len(text) {
+		text = text[:n]
+	}
+	return vm.AllocString(string(text)).Value()
+}
+
+// findIn returns the offset of the value from the position of the series.
+func (vm *VM) findIn(series Value, value Value) int {
+	if series.Kind() == BlockType {
+		n := 0
+		for i := series.Block().First(vm); i != 0; i = i.Next(vm) {
+			if x := i.Value(vm); vm.equal(x, value) || isNumber(x.Kind()) && isNumber(value.Kind()) && vm.toDecimal(x) == vm.toDecimal(value) {
+				return n
+			}
+			n++
+		}
+		return -1
+	}
+	text := series.Text(vm)
+	i := strings.Index(text, string(vm.form(value)))
+	if i < 0 {
+		return -1
+	}
+	return len([]rune(text[:i]))
+}
+
+// find series value returns the series at the value, or none.
+func find(vm *VM) Value {
+	series, err := vm.nextSeries("find")
+	if err != 0 {
+		return err
+	}
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	n := vm.findIn(series, value)
+	if n < 0 {
+		return None
+	}
+	return vm.seriesAt(series, seriesIndex(series)+n)
+}
+
+// select series value returns the value following the value, or none.
+func _select(vm *VM) Value {
+	series, err := vm.nextSeries("select")
+	if err != 0 {
+		return err
+	}
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	n := vm.findIn(series, value)
+	if n < 0 {
+		return None
+	}
+	if series.Kind() == StringType {
+		n += len(vm.form(value)) - 1
+	}
+	return vm.pickAt(series, n+1)
+}
+
+// rewrite replaces the values of a block from its position.
+func (b Block) rewrite(vm *VM, values []Value) {
+	i := b.First(vm)
+	for _, value := range values {
+		i.change(vm, value)
+		i = i.Next(vm)
+	}
+}
+
+func reverse(vm *VM) Value {
+	series, err := vm.nextSeries("reverse")
+	if err != 0 {
+		return err
+	}
+	if series.Kind() == BlockType {
+		values := series.Block().values(vm)
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+		series.Block().rewrite(vm, values)
+		return series
+	}
+	s := series.String()
+	text, index := vm.runesAt(s)
+	for i, j := index, len(text)-1; i < j; i, j = i+1, j-1 {
+		text[i], text[j] = text[j], text[i]
+	}
+	vm.setRunes(s, text)
+	return series
+}
+
+// sort orders a block of numbers, strings or durations, or the characters of
+// a string.
+func _sort(vm *VM) Value {
+	series, err := vm.nextSeries("sort")
+	if err != 0 {
+		return err
+	}
+	if series.Kind() == StringType {
+		s := series.String()
+		text, index := vm.runesAt(s)
+		part := text[index:]
+		sort.Slice(part, func(i, j int) bool { return part[i] < part[j] })
+		vm.setRunes(s, text)
+		return series
+	}
+	values := series.Block().values(vm)
+	var failed Value
+	sort.SliceStable(values, func(i, j int) bool {
+		c, err := vm.compare("sort", values[i], values[j])
+		if err != 0 && failed == 0 {
+			failed = err
+		}
+		return c < 0
+	})
+	if failed != 0 {
+		return failed
+	}
+	series.Block().rewrite(vm, values)
+	return series
+}
+
+// collect [body] returns a block of the values passed to keep in the body.
+func collect(vm *VM) Value {
+	body, err := vm.nextArg("collect", BlockType)
+	if err != 0 {
+		return err
+	}
+	result := vm.AllocBlock()
+	n := len(vm.collecting)
+	vm.collecting = append(vm.collecting, result)
+	defer func() { vm.collecting = vm.collecting[:n] }()
+	vm.call(body.Block())
+	if vm.raised != 0 {
+		return vm.raised
+	}
+	return result.Value()
+}
+
+func keep(vm *VM) Value {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	if len(vm.collecting) == 0 {
+		return vm.fail(ErrUser, "keep outside of collect", 0)
+	}
+	vm.collecting[len(vm.collecting)-1].Add(vm, value)
+	return value
+}
+
+// eachValue evaluates the body for the values of a series with the word set
+// to the value, f gets the results and may raise an error. break and continue
+// work like in foreach.
+func (vm *VM) eachValue(native string, f func(value Value, result Value) Value) Value {
+	w, err := vm.nextWord(native)
+	if err != 0 {
+		return err
+	}
+	series, err := vm.nextSeries(native)
+	if err != 0 {
+		return err
+	}
+	c, err := vm.nextArg(native, BlockType)
+	if err != 0 {
+		return err
+	}
+	code := c.Block()
+
+	binding, release := vm.loopBinding(w, code)
+	defer release()
+	for i, n := 0, vm.seriesSize(series)-seriesIndex(series); i < n; i++ {
+		value := vm.pickAt(series, i)
+		vm.setBound[binding.Kind()](binding, value)
+		result, done, continued := vm.loopStep(code)
+		if vm.raised != 0 {
+			return vm.raised
+		}
+		if done {
+			break
+		}
+		if continued {
+			continue
+		}
+		if err := f(value, result); err != 0 {
+			return err
+		}
+	}
+	return 0
+}
+
+// map-each word series [body] returns a block of the results of the body.
+func mapEach(vm *VM) Value {
+	result := vm.AllocBlock()
+	err := vm.eachValue("map-each", func(value Value, r Value) Value {
+		result.Add(vm, r)
+		return 0
+	})
+	if err != 0 {
+		return err
+	}
+	return result.Value()
+}
+
+// filter word series [body] returns a block of the values the body is true
+// for.
+func filter(vm *VM) Value {
+	result := vm.AllocBlock()
+	err := vm.eachValue("filter", func(value Value, r Value) Value {
+		if r.Kind() != BooleanType {
+			return vm.typeError("filter", "logic!", r)
+		}
+		if r.Bool().Val() {
+			result.Add(vm, value)
+		}
+		return 0
+	})
+	if err != 0 {
+		return err
+	}
+	return result.Value()
+}
+
+// reduce evaluates the expressions of the block into a new block.
+func (vm *VM) reduce(block Block) (Block, Value) {
+	result := vm.AllocBlock()
+	pc := vm.pc
+	vm.pc = block.First(vm)
+	for vm.pc != 0 {
+		value := vm.Next()
+		if vm.raised != 0 {
+			vm.pc = pc
+			return 0, vm.raised
+		}
+		result.Add(vm, value)
+	}
+	vm.pc = pc
+	return result, 0
+}
+
+func reduce(vm *VM) Value {
+	b, err := vm.nextArg("reduce", BlockType)
+	if err != 0 {
+		return err
+	}
+	result, err := vm.reduce(b.Block())
+	if err != 0 {
+		return err
+	}
+	return result.Value()
+}
+
+func seriesPackage(pkg *Pkg) {
+	pkg.AddFunc("length?", length)
+	pkg.AddFunc("first", first)
+	pkg.AddFunc("last", last)
+	pkg.AddFunc("pick", pick)
+	pkg.AddFunc("at", at)
+	pkg.AddFunc("skip", skip)
+	pkg.AddFunc("head", head)
+	pkg.AddFunc("tail", tail)
+	pkg.AddFunc("insert", insert)
+	pkg.AddFunc("remove", remove)
+	pkg.AddFunc("clear", _clear)
+	pkg.AddFunc("change", change)
+	pkg.AddFunc("copy", _copy)
+	pkg.AddFunc("find", find)
+	pkg.AddFunc("select", _select)
+	pkg.AddFunc("reverse", reverse)
+	pkg.AddFunc("sort", _sort)
+	pkg.AddFunc("collect", collect)
+	pkg.AddFunc("keep", keep)
+	pkg.AddLoopFunc("map-each", mapEach)
+	pkg.AddLoopFunc("filter", filter)
+	pkg.AddFunc("reduce", reduce)
+}
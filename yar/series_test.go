@@ -0,0 +1,154 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSeries(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+
+	for _, test := range []struct {
+		code   string
+		result string
+	}{
+		{`length? [1 2 3]`, "3"},
+		{`length? "héllo"`, "5"},
+		{`length? next: skip [1 2 3] 1`, "2"},
+		{`first [1 2]`, "1"},
+		{`last [1 2]`, "2"},
+		{`first []`, "none"},
+		{`first "abc"`, `"a"`},
+		{`pick [1 2 3] 2`, "2"},
+		{`pick [1 2 3] 4`, "none"},
+		{`pick "héllo" 2`, `"é"`},
+		{`at [1 2 3] 2`, "[2 3 ]"},
+		{`at "abc" 3`, `"c"`},
+		{`skip [1 2 3] 5`, "[]"},
+		{`head skip [1 2 3] 2`, "[1 2 3 ]"},
+		{`tail [1 2 3]`, "[]"},
+		{`b: [1 3] insert next: at b 2 2 b`, "[1 2 3 ]"},
+		{`b: [2] insert b 1 b`, "[1 2 ]"},
+		{`insert tail b: [1] 2`, "[]"},
+		{`s: "hllo" insert at s 2 "e" s`, `"hello"`},
+		{`b: [1 2 3] remove b b`, "[2 3 ]"},
+		{`b: [1 2 3] remove at b 3 b`, "[1 2 ]"},
+		{`b: [1 2 3 4] remove/part at b 2 2 b`, "[1 4 ]"},
+		{`b: [1 2] remove at b 2 append b 3 b`, "[1 3 ]"},
+		{`s: "abc" remove/part s 2 s`, `"c"`},
+		{`b: [1 2 3] change at b 2 5 b`, "[1 5 3 ]"},
+		{`s: "abc" change s "x" s`, `"xbc"`},
+		{`b: [1 2 3] clear at b 2 b`, "[1 ]"},
+		{`b: [1 2] clear b append b 3 b`, "[3 ]"},
+		{`s: "hello" clear at s 3 s`, `"he"`},
+		{`copy [1 2 3]`, "[1 2 3 ]"},
+		{`copy/part at [1 2 3] 2 1`, "[2 ]"},
+		{`copy/part "hello" 4`, `"hell"`},
+		{`find [1 2 3] 2`, "[2 3 ]"},
+		{`find [1 2 3] 4`, "none"},
+		{`find "hello" "ll"`, `"llo"`},
+		{`select [a 1 b 2] 'b`, "2"},
+		{`select "a=b" "="`, `"b"`},
+		{`reverse [1 2 3]`, "[3 2 1 ]"},
+		{`s: "abc" reverse at s 2 s`, `"acb"`},
+		{`sort [3 1 2]`, "[1 2 3 ]"},
+		{`sort ["b" "c" "a"]`, `["a" "b" "c" ]`},
+		{`sort "cab"`, `"abc"`},
+		{`collect [keep 1 foreach x [2 3] [keep x]]`, "[1 2 3 ]"},
+		{`map-each x [1 2 3] [x * 2]`, "[2 4 6 ]"},
+		{`map-each c "ab" [append copy c "!"]`, `["a!" "b!" ]`},
+		{`filter x [1 5 2 7] [x > 3]`, "[5 7 ]"},
+		{`map-each x [1 2 3 4] [if x = 2 [continue] if x = 4 [break] x]`, "[1 3 ]"},
+		{`reduce [1 + 1 "a" add 2 2]`, `[2 "a" 4 ]`},
+		{`workers: ["w1" "w2" "w3" "w4"] copy/part workers 3`, `["w1" "w2" "w3" ]`},
+		{`s: "host" append s ":" append s 80 s`, `"host:80"`},
+		{`f: fn [b] [map-each x b [x + 1]] f [1 2]`, "[2 3 ]"},
+	} {
+		result, err := vm.Eval(test.code)
+		if err != nil {
+			t.Errorf("%s: %v", test.code, err)
+			continue
+		}
+		if got := vm.ToString(result); got != test.result {
+			t.Errorf("%s: got %s, want %s", test.code, got, test.result)
+		}
+	}
+}
+
+func TestSeriesErrors(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	for _, test := range []struct {
+		code    string
+		message string
+	}{
+		{`first 1`, "first expected series! argument, got integer!"},
+		{`copy/only [1]`, "copy has no refinement /only"},
+		{`first/part [1] 1`, "first has no refinement /part"},
+		{`sort [1 "a"]`, "sort expected"},
+		{`keep 1`, "keep outside of collect"},
+		{`filter x [1] [x]`, "filter expected logic! argument"},
+	} {
+		_, err := vm.Eval(test.code)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: got %v, want %s", test.code, err, test.message)
+		}
+	}
+	if result, err := vm.Eval(`collect [keep 1]`); err != nil || vm.ToString(result) != "[1 ]" {
+		t.Errorf("collect after error: %v %v", vm.ToString(result), err)
+	}
+}
+
+func TestSeriesPastTail(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	// another series over the same block or text shortens it under t
+	for _, code := range []string{
+		`s: "hello  " t: skip s 6 trim s`,
+		`s: "ab" t: skip s 2 remove s`,
+		`s: "abc" t: skip s 2 clear s`,
+		`b: [1 2] t: skip b 2 remove b`,
+		`b: [1 2 3] t: skip b 2 clear b`,
+	} {
+		result, err := vm.Eval(code + ` reduce [length? t first t copy t t]`)
+		if err != nil {
+			t.Errorf("%s: %v", code, err)
+			continue
+		}
+		want := `[0 none "" ""]`
+		if strings.HasPrefix(code, "b:") {
+			want = `[0 none [] []]`
+		}
+		if got := vm.Mold(result); got != want {
+			t.Errorf("%s: got %s, want %s", code, got, want)
+		}
+	}
+}
+
+func TestSeriesSurviveGC(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`b: at [1 2 3] 2 s: at "abc" 2`)
+	vm.GC()
+	for code, want := range map[string]string{`b`: "[2 3 ]", `head b`: "[1 2 3 ]", `s`: `"bc"`} {
+		if result, err := vm.Eval(code); err != nil || vm.ToString(result) != want {
+			t.Errorf("%s after gc: got %s %v, want %s", code, vm.ToString(result), err, want)
+		}
+	}
+}
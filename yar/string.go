@@ -15,20 +15,306 @@
 
 package yar
 
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// STRING
+//-------------------------
+//  INDEX |  TEXT  | KIND |
+//-------------------------
+//
+// TEXT
+//-------------------------
+//    BYTES    |   DATA   |
+//-------------------------
+//
+// Like a block a string value is a position in the series, the index counts
+// characters. The text cell is shared by all values of a string, DATA points to
+// contiguous cells holding the UTF-8 bytes, 8 per cell. A changed string gets
+// new DATA and the text cell is rewritten, so strings are saved with the heap,
+// collected by GC and can't be changed in the frozen part of a view.
+
 type String Value
 
+const textBits = 32
+
 func (v Value) String() String { return String(v) }
 
-func (s String) Value() Value         { return Value(s) }
-func (s String) String(vm *VM) string { return vm.strings[uint(s.Value().Val())] }
+func (s String) Value() Value { return Value(s) }
+func (s String) text() ptr    { return s.Value().text() }
+func (s String) Index() int   { return s.Value().Val() >> textBits }
+
+// text returns the text cell of a string, issue, file or url.
+func (v Value) text() ptr { return ptr(v.Val() & (1<<textBits - 1)) }
+
+// at returns the string at another index of the same series.
+func (s String) at(index int) String {
+	return String(makeValue(index<<textBits|int(s.text()), StringType))
+}
+
+// String returns the text from the index of the string.
+func (s String) String(vm *VM) string { return s.Value().Text(vm) }
 
 func (vm *VM) AllocString(str string) String {
-	vm.nextString++
-	id := vm.nextString
-	vm.strings[id] = str
-	return String(makeValue(int(id), StringType))
+	return String(makeValue(int(vm.allocText(str)), StringType))
 }
 
 func stringToString(vm *VM, b Value) string {
-	return "\"" + vm.strings[uint(b.Val())] + "\""
+	return escape(b.Text(vm))
+}
+
+func textCells(bytes int) int { return (bytes + 7) / 8 }
+
+// allocData stores the bytes of s in contiguous cells.
+func (vm *VM) allocData(s string) ptr {
+	var data ptr
+	for i := 0; i < len(s); i += 8 {
+		var c cell
+		for j := 0; j < 8 && i+j < len(s); j++ {
+			c |= cell(s[i+j]) << (8 * j)
+		}
+		p := vm.alloc(c)
+		if data == 0 {
+			data = p
+		}
+	}
+	return data
+}
+
+func (vm *VM) allocText(s string) ptr {
+	return vm.alloc(cell(makeItem(len(s), vm.allocData(s))))
+}
+
+func (vm *VM) readText(text ptr) string {
+	t := item(vm.read(text))
+	n, data := t.val(), t.ptr()
+	result := make([]byte, n)
+	for i := 0; i < n; i += 8 {
+		c := vm.read(data + ptr(i/8))
+		for j := 0; j < 8 && i+j < n; j++ {
+			result[i+j] = byte(c >> (8 * j))
+		}
+	}
+	return string(result)
+}
+
+func (vm *VM) writeText(text ptr, s string) {
+	vm.write(text, cell(makeItem(len(s), vm.allocData(s))))
+}
+
+// formText returns a value as text for people: strings and the like without
+// quotes, words as their names, blocks as their values separated by spaces,
+// other values molded.
+func (vm *VM) formText(value Value) string {
+	switch value.Kind() {
+	case StringType, IssueType, FileType, UrlType:
+		return value.Text(vm)
+	case WordType, GetWordType, SetWordType, QuoteType:
+		return vm.InverseSymbols[value.Word().Sym()]
+	case BlockType:
+		var parts []string
+		for i := value.Block().First(vm); i != 0; i = i.Next(vm) {
+			parts = append(parts, vm.formText(i.Value(vm)))
+		}
+		return strings.Join(parts, " ")
+	}
+	return vm.Mold(value)
+}
+
+func (vm *VM) nextString(native string) (String, Value) {
+	value, err := vm.nextArg(native, StringType)
+	if err != 0 {
+		return 0, err
+	}
+	return value.String(), 0
+}
+
+// join value rest joins the value and the rest, a block rest is reduced first.
+// The result is a block when the value is a block, a string otherwise.
+func (vm *VM) join(value Value, rest []Value) Value {
+	if value.Kind() == BlockType {
+		result := vm.AllocBlock()
+		for i := value.Block().First(vm); i != 0; i = i.Next(vm) {
+			result.Add(vm, i.Value(vm))
+		}
+		for _, v := range rest {
+			result.Add(vm, v)
+		}
+		return result.Value()
+	}
+	var result strings.Builder
+	result.WriteString(vm.formText(value))
+	for _, v := range rest {
+		result.WriteString(vm.formText(v))
+	}
+	return vm.AllocString(result.String()).Value()
+}
+
+func join(vm *VM) Value {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	rest, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	if rest.Kind() != BlockType {
+		return vm.join(value, []Value{rest})
+	}
+	reduced, err := vm.reduce(rest.Block())
+	if err != 0 {
+		return err
+	}
+	return vm.join(value, reduced.values(vm))
+}
+
+// rejoin [block] reduces the block and joins its values.
+func rejoin(vm *VM) Value {
+	b, err := vm.nextArg("rejoin", BlockType)
+	if err != 0 {
+		return err
+	}
+	reduced, err := vm.reduce(b.Block())
+	if err != 0 {
+		return err
+	}
+	values := reduced.values(vm)
+	if len(values) == 0 {
+		return vm.AllocString("").Value()
+	}
+	return vm.join(values[0], values[1:])
+}
+
+func form(vm *VM) Value {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	return vm.AllocString(vm.formText(value)).Value()
+}
+
+// split string delimiter returns a block of the parts of the string.
+func split(vm *VM) Value {
+	s, err := vm.nextString("split")
+	if err != 0 {
+		return err
+	}
+	d, err := vm.nextString("split")
+	if err != 0 {
+		return err
+	}
+	result := vm.AllocBlock()
+	for _, part := range strings.Split(s.String(vm), d.String(vm)) {
+		result.Add(vm, vm.AllocString(part).Value())
+	}
+	return result.Value()
+}
+
+// changeText replaces the text of a string from its index with f of it.
+func (vm *VM) changeText(s String, f func(text string) string) {
+	text, index := vm.runesAt(s)
+	vm.writeText(s.text(), string(text[:index])+f(string(text[index:])))
+}
+
+// trim, uppercase and lowercase change the string and return it.
+func textChanger(native string, f func(text string) string) procFunc {
+	return func(vm *VM) Value {
+		s, err := vm.nextString(native)
+		if err != 0 {
+			return err
+		}
+		vm.changeText(s, f)
+		return s.Value()
+	}
+}
+
+// replace series search replacement replaces the first occurrence of search,
+// replace/all replaces all of them. In a block search is a value.
+func replace(vm *VM) Value {
+	flags, err := vm.refinements("all")
+	if err != 0 {
+		return err
+	}
+	series, err := vm.nextSeries("replace")
+	if err != 0 {
+		return err
+	}
+	search, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	replacement, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	all := flags&1 != 0
+
+	if series.Kind() == BlockType {
+		for i := series.Block().First(vm); i != 0; i = i.Next(vm) {
+			if vm.equal(i.Value(vm), search) {
+				i.change(vm, replacement)
+				if !all {
+					break
+				}
+			}
+		}
+		return series
+	}
+	n := 1
+	if all {
+		n = -1
+	}
+	old, new := vm.formText(search), vm.formText(replacement)
+	vm.changeText(series.String(), func(text string) string { return strings.Replace(text, old, new, n) })
+	return series
+}
+
+func startsWith(vm *VM) Value {
+	s, err := vm.nextString("starts-with?")
+	if err != 0 {
+		return err
+	}
+	prefix, err := vm.nextString("starts-with?")
+	if err != 0 {
+		return err
+	}
+	return MakeBool(strings.HasPrefix(s.String(vm), prefix.String(vm))).Value()
+}
+
+func toInteger(vm *VM) Value {
+	value, err := vm.nextAny()
+	if err != 0 {
+		return err
+	}
+	switch value.Kind() {
+	case IntegerType:
+		return value
+	case DecimalType:
+		return vm.intResult("to-integer", int(value.Decimal(vm)))
+	case StringType:
+		i, e := strconv.Atoi(strings.TrimSpace(value.Text(vm)))
+		if e != nil {
+			return vm.fail(ErrType, "to-integer can't convert "+vm.Mold(value), 0)
+		}
+		return vm.intResult("to-integer", i)
+	}
+	return vm.typeError("to-integer", "number! or string!", value)
+}
+
+func stringPackage(pkg *Pkg) {
+	pkg.AddFunc("join", join)
+	pkg.AddFunc("rejoin", rejoin)
+	pkg.AddFunc("form", form)
+	pkg.AddFunc("split", split)
+	pkg.AddFunc("trim", textChanger("trim", func(text string) string { return strings.TrimFunc(text, unicode.IsSpace) }))
+	pkg.AddFunc("uppercase", textChanger("uppercase", strings.ToUpper))
+	pkg.AddFunc("lowercase", textChanger("lowercase", strings.ToLower))
+	pkg.AddFunc("replace", replace)
+	pkg.AddFunc("starts-with?", startsWith)
+	pkg.AddFunc("to-integer", toInteger)
+	pkg.AddFunc("to-string", form)
 }
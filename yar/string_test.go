@@ -0,0 +1,132 @@
+//
+// Copyright © 2020 Anticrm Platform Contributors.
+//
+// Licensed under the Eclipse Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License. You may
+// obtain a copy of the License at https://www.eclipse.org/legal/epl-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package yar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringNatives(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`tcp: make-object [host: "localhost" port: 80]`)
+
+	for _, test := range []struct {
+		code   string
+		result string
+	}{
+		{`join tcp/host [":" tcp/port]`, `"localhost:80"`},
+		{`join "anticrm/scrn:" 42`, `"anticrm/scrn:42"`},
+		{`join [1] [2 + 1 4]`, "[1 3 4 ]"},
+		{`rejoin ["a" 1 + 1 'b]`, `"a2b"`},
+		{`rejoin []`, `""`},
+		{`form [1 "a" [b]]`, `"1 a b"`},
+		{`form 1.5`, `"1.5"`},
+		{`split "a,b,,c" ","`, `["a" "b" "" "c" ]`},
+		{`trim "  x y  "`, `"x y"`},
+		{`s: "ab  " trim at s 2 s`, `"ab"`},
+		{`uppercase "héllo"`, `"HÉLLO"`},
+		{`lowercase "ABC"`, `"abc"`},
+		{`replace "a-b-c" "-" "+"`, `"a+b-c"`},
+		{`replace/all "a-b-c" "-" "+"`, `"a+b+c"`},
+		{`replace/all [1 2 1] 1 0`, "[0 2 0 ]"},
+		{`starts-with? "anticrm/scrn" "anticrm"`, "true"},
+		{`starts-with? "a" "b"`, "false"},
+		{`to-integer " 42 "`, "42"},
+		{`to-integer 2.9`, "2"},
+		{`to-string 42`, `"42"`},
+		{`to-string #issue`, `"issue"`},
+		{`s: "abc" t: s append s "d" t`, `"abcd"`},
+	} {
+		result, err := vm.Eval(test.code)
+		if err != nil {
+			t.Errorf("%s: %v", test.code, err)
+			continue
+		}
+		if got := vm.ToString(result); got != test.result {
+			t.Errorf("%s: got %s, want %s", test.code, got, test.result)
+		}
+	}
+
+	for code, message := range map[string]string{
+		`to-integer "x"`: `to-integer can't convert "x"`,
+		`split 1 ","`:    "split expected string! argument",
+		`to-integer []`:  "to-integer expected number! or string!",
+	} {
+		if _, err := vm.Eval(code); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: got %v, want %s", code, err, message)
+		}
+	}
+}
+
+func TestStringPastTail(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	// clear s leaves t, over the same text, past its tail
+	for code, want := range map[string]string{
+		`insert t "x"`:      `"ax"`,
+		`change t "x"`:      `"ax"`,
+		`remove t`:          `"a"`,
+		`remove/part t 2`:   `"a"`,
+		`clear t`:           `"a"`,
+		`reverse t`:         `"a"`,
+		`sort t`:            `"a"`,
+		`trim t`:            `"a"`,
+		`uppercase t`:       `"a"`,
+		`lowercase t`:       `"a"`,
+		`replace t "a" "b"`: `"a"`,
+		`append t "x"`:      `"ax"`,
+	} {
+		result, err := vm.Eval(`s: "abcd" t: skip s 3 clear at s 2 ` + code + ` reduce [s t]`)
+		if err != nil {
+			t.Errorf("%s: %v", code, err)
+			continue
+		}
+		if got := vm.Mold(result); got != "["+want+` ""]` {
+			t.Errorf("%s: got %s, want [%s \"\"]", code, got, want)
+		}
+	}
+}
+
+func TestStringsSaved(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`s: "héllo, world" append s "!" h: localhost:8080 f: %file.txt`)
+
+	loaded, err := LoadVM(vm.Save(), 100, vm.Library)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[string]string{`s`: `"héllo, world!"`, `h`: "localhost:8080", `f`: "%file.txt"} {
+		if result, err := loaded.Eval(code); err != nil || loaded.ToString(result) != want {
+			t.Errorf("%s after load: got %s %v, want %s", code, loaded.ToString(result), err, want)
+		}
+	}
+}
+
+func TestStringReadOnly(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.Eval(`s: "abc"`)
+	view := vm.Clone()
+	if _, err := view.Eval(`append s "d"`); err == nil || err.(*ScriptError).Code != ErrReadOnly {
+		t.Errorf("append to a string of a view: %v, want read only error", err)
+	}
+	if result, err := view.Eval(`append copy s "d"`); err != nil || result.Text(view) != "abcd" {
+		t.Errorf("append to a copy in a view: %v %v", view.ToString(result), err)
+	}
+}
@@ -24,22 +24,30 @@ type ptr uint
 type cell int64
 
 const (
-	BlockType   = iota
-	WordType    = iota
-	GetWordType = iota
-	SetWordType = iota
-	QuoteType   = iota
-	MapType     = iota
-	IntegerType = iota
-	BooleanType = iota
-	NativeType  = iota
-	ProcType    = iota
-	PathType    = iota
-	GetPathType = iota
-	StringType  = iota
-	ErrorType   = iota
-	SetPathType = iota
-	LastType    = iota
+	BlockType      = iota
+	WordType       = iota
+	GetWordType    = iota
+	SetWordType    = iota
+	QuoteType      = iota
+	MapType        = iota
+	IntegerType    = iota
+	BooleanType    = iota
+	NativeType     = iota
+	ProcType       = iota
+	PathType       = iota
+	GetPathType    = iota
+	StringType     = iota
+	ErrorType      = iota
+	SetPathType    = iota
+	RefinementType = iota
+	DecimalType    = iota
+	NoneType       = iota
+	IssueType      = iota
+	FileType       = iota
+	UrlType        = iota
+	HostPortType   = iota
+	DurationType   = iota
+	LastType       = iota
 )
 
 // There are 4 types of cell layouts in the VM: value, obj, item, and ptrval
@@ -135,18 +143,6 @@ func intToString(vm *VM, b Value) string {
 	return strconv.Itoa(b.Val())
 }
 
-type Error Value
-
-func MakeError(value int) Error {
-	return Error(makeValue(value, ErrorType))
-}
-func (e Error) Value() Value { return Value(e) }
-func (v Value) Error() Error { return Error(v) }
-
-func errorToString(vm *VM, b Value) string {
-	return fmt.Sprintf("Error, code: %d", b.Val())
-}
-
 type boolean Value
 
 func MakeBool(value bool) boolean {
@@ -169,11 +165,63 @@ func (v Value) native() native { return native(v) }
 func (n native) Value() Value  { return Value(n) }
 
 func nativeExec(vm *VM, value Value) Value {
+	if vm.refs != 0 {
+		return vm.unusedRefinements()
+	}
 	i := value.Val()
+	if vm.Hook != nil {
+		return vm.hookNative(i)
+	}
 	f := vm.proc[i]
 	return f(vm)
 }
 
+// callNative calls a native with refinements. The native takes them with
+// vm.refinements before evaluating its arguments, refinements left when it
+// returns or calls another native are an error.
+func (vm *VM) callNative(value Value, refinements pBlockEntry) Value {
+	vm.refs, vm.refsAt, vm.refsFrom = refinements, vm.at, refinements
+	var result Value
+	if vm.Hook != nil {
+		result = vm.hookNative(value.Val())
+	} else {
+		result = vm.proc[value.Val()](vm)
+	}
+	if vm.refs != 0 {
+		return vm.unusedRefinements()
+	}
+	return result
+}
+
+func (vm *VM) unusedRefinements() Value {
+	r := vm.refs
+	vm.refs = 0
+	vm.at = vm.refsAt
+	return vm.fail(ErrNoField, fmt.Sprintf("%s has no refinement /%s", vm.callName(vm.refsAt, vm.refsFrom), vm.InverseSymbols[sym(r.pval(vm))]), vm.refsAt.Value(vm))
+}
+
+// refinements returns the refinements a native was called with as bits in
+// the order of names.
+func (vm *VM) refinements(names ...string) (uint, Value) {
+	var flags uint
+	for r := vm.refs; r != 0; r = r.Next(vm) {
+		name := vm.InverseSymbols[sym(r.pval(vm))]
+		found := false
+		for i, n := range names {
+			if n == name {
+				flags |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			vm.refs = r
+			return 0, vm.unusedRefinements()
+		}
+	}
+	vm.refs = 0
+	return flags, 0
+}
+
 ///
 
 ///
@@ -184,19 +232,10 @@ func makeProc(stackSize int, code ptr) Value {
 	return Value(makeObj(stackSize, code, ProcType))
 }
 
-func (p Proc) StackSize() int     { return obj(p).val() }
-func (p Proc) First() pBlockEntry { return pBlockEntry(obj(p).ptr()) }
+func (p Proc) StackSize() int { return obj(p).val() }
 
 func procExec(vm *VM, value Value) Value {
-	p := Proc(value)
-	stackSize := p.StackSize()
-	code := p.First()
-	for i := 0; i < stackSize; i++ {
-		vm.push(vm.Next())
-	}
-	result := vm.Exec(code)
-	vm.sp -= uint(stackSize)
-	return result
+	return vm.callProc(Proc(value), 0)
 }
 
 ///
@@ -225,6 +264,14 @@ var (
 		identity,
 		identity,
 		setPathExec,
+		identity, // refinement
+		identity, // decimal
+		identity, // none
+		identity, // issue
+		identity, // file
+		identity, // url
+		identity, // host:port
+		identity, // duration
 	}
 
 	bindFunc = []func(vm *VM, value Value, factory bindFactory){
@@ -243,5 +290,13 @@ var (
 		bindNothing,
 		bindNothing,
 		pathBind, // set-path
+		bindNothing,
+		bindNothing,
+		bindNothing,
+		bindNothing,
+		bindNothing,
+		bindNothing,
+		bindNothing,
+		bindNothing,
 	}
 )
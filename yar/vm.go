@@ -27,6 +27,7 @@ const (
 	MapBinding   = iota
 	StackBinding = iota
 	WordBinding  = iota
+	EnvBinding   = iota
 	LastBinding  = iota
 )
 
@@ -42,33 +43,95 @@ func MakeWordBinding(value int) Binding {
 	return Binding(makeImm(value, WordBinding))
 }
 
+// ENV BINDING
+//-------------------------
+//  DEPTH | INDEX  | KIND |
+//-------------------------
+//
+// An env binding refers to a slot of a heap frame, depth counts the frames to
+// walk up from the current one.
+
+const envIndexBits = 16
+
+func makeEnvBinding(depth int, index int) Binding {
+	return Binding(makeImm(depth<<envIndexBits|index, EnvBinding))
+}
+
+func (b Binding) depth() int { return b.Val() >> envIndexBits }
+func (b Binding) index() int { return b.Val() & (1<<envIndexBits - 1) }
+
+// envSlot returns the cell of the slot an env binding refers to.
+func (vm *VM) envSlot(binding Binding) ptr {
+	env := vm.env
+	for i := binding.depth(); i > 0; i-- {
+		env = item(vm.read(env)).ptr()
+	}
+	return env + 1 + ptr(binding.index())
+}
+
 type sym = uint
 type procFunc func(vm *VM) Value
 
 type VM struct {
 	pc             pBlockEntry
-	mem            []cell
+	mem            memory
 	stack          []Value
 	top            uint
 	sp             uint
-	result         Value
+	raised         Value
+	returned       Value
+	refs           pBlockEntry
+	refsAt         pBlockEntry
+	refsFrom       pBlockEntry
+	collecting     []Block
+	at             pBlockEntry
 	bindStack      []Value
 	bp             uint
+	env            ptr
 	readOnly       bool
+	frozen         ptr
+	sharedMaps     bool
+	exhausted      bool
+	gc             gcState
 	Dictionary     dict
+	modules        dict // modules by name, see module.go
+	moduleFiles    dict // modules by the path of their file
 	proc           []procFunc
 	procNames      []string
 	symbols        map[string]sym
 	nextSymbol     uint
 	InverseSymbols map[sym]string
-	strings        map[uint]string
-	nextString     uint
+	spans          map[pBlockEntry]Span
+	specs          map[ptr]*fnSpec
 	Library        Library
 	Services       map[string]interface{}
 
+	// ModulePath lists the directories import reads files from, see module.go.
+	ModulePath []string
+	loading    []string
+
+	// Compile runs blocks through compiled code.
+	Compile         bool
+	compiled        map[pBlockEntry][]expr
+	compiledEntries map[pBlockEntry]struct{}
+	recent          []recent
+	gen             int
+	feed            []code
+	writes          uint // cells written, compiled code caches globals between writes
+
+	// Limits bound top-level evaluations, see limits.go.
+	Limits  Limits
+	budget  budget
+	journal *journal
+
+	// Hook observes evaluation, see hook.go.
+	Hook   Hook
+	frames []*Frame
+
 	toStringFunc [LastType]func(vm *VM, value Value) string
 	bindFunc     []func(vm *VM, value Value, factory bindFactory)
 	execFunc     []func(vm *VM, value Value) Value
+	infix        []binaryOp
 	getBound     [LastBinding]func(bindings Binding) Value
 	setBound     [LastBinding]func(bindings Binding, value Value)
 }
@@ -79,20 +142,35 @@ func notImplemented(vm *VM, value Value) string {
 
 func NewVM(memSize int, stackSize int) *VM {
 	vm := &VM{
-		mem:            make([]cell, memSize),
+		gc:             newGCState(memSize),
 		top:            0,
 		stack:          make([]Value, stackSize),
 		sp:             0,
 		bindStack:      make([]Value, 25),
 		bp:             0,
-		nextString:     0,
-		strings:        make(map[uint]string),
+		spans:          make(map[pBlockEntry]Span),
+		specs:          make(map[ptr]*fnSpec),
 		nextSymbol:     0,
 		symbols:        make(map[string]uint),
 		InverseSymbols: make(map[sym]string),
 		Services:       make(map[string]interface{}),
 	}
 
+	vm.initToString()
+	vm.Dictionary = vm.AllocDict()
+	vm.modules, vm.moduleFiles = vm.AllocDict(), vm.AllocDict()
+	vm.initBindings()
+	vm.initInfix()
+
+	loadNative := vm.addNative(loadNative)
+	sym := sym(vm.GetSymbolID("load-native"))
+	vm.Dictionary.Put(vm, sym, loadNative)
+	vm.procNames = append(vm.procNames, bootLoadNative)
+
+	return vm
+}
+
+func (vm *VM) initToString() {
 	for i := 0; i < LastType; i++ {
 		vm.toStringFunc[i] = notImplemented
 	}
@@ -102,16 +180,27 @@ func NewVM(memSize int, stackSize int) *VM {
 	vm.toStringFunc[IntegerType] = intToString
 	vm.toStringFunc[StringType] = stringToString
 	vm.toStringFunc[ErrorType] = errorToString
-
-	vm.Dictionary = vm.AllocDict()
-	vm.initBindings()
-
-	loadNative := vm.addNative(loadNative)
-	sym := sym(vm.GetSymbolID("load-native"))
-	vm.Dictionary.Put(vm, sym, loadNative)
-	vm.procNames = append(vm.procNames, "boot/load-native")
-
-	return vm
+	vm.toStringFunc[RefinementType] = refinementToString
+	vm.toStringFunc[BooleanType] = boolToString
+	vm.toStringFunc[DecimalType] = decimalToString
+	vm.toStringFunc[NoneType] = noneToString
+	vm.toStringFunc[IssueType] = issueToString
+	vm.toStringFunc[FileType] = fileToString
+	vm.toStringFunc[UrlType] = urlToString
+	vm.toStringFunc[HostPortType] = hostPortToString
+	vm.toStringFunc[DurationType] = durationToString
+}
+
+// bound returns the value a binding refers to, inlining the bindings of
+// globals and of function arguments evaluation mostly goes through.
+func (vm *VM) bound(binding Binding) Value {
+	switch binding.Kind() {
+	case MapBinding:
+		return Value(vm.read(symval(vm.read(ptr(binding.Val()))).val()))
+	case StackBinding:
+		return vm.stack[int(vm.sp)+binding.Val()]
+	}
+	return vm.getBound[binding.Kind()](binding)
 }
 
 func (vm *VM) initBindings() {
@@ -138,44 +227,137 @@ func (vm *VM) initBindings() {
 		return Value(vm.stack[int(vm.sp)+offset])
 	}
 
+	vm.setBound[StackBinding] = func(binding Binding, value Value) {
+		vm.stack[int(vm.sp)+binding.Val()] = value
+	}
+
+	vm.setBound[WordBinding] = func(binding Binding, value Value) {
+		vm.bindStack[binding.Val()] = value
+	}
+
 	vm.getBound[WordBinding] = func(binding Binding) Value {
 		offset := binding.Val()
 		return Value(vm.bindStack[offset])
 	}
 
-}
+	vm.getBound[EnvBinding] = func(binding Binding) Value {
+		return Value(vm.read(vm.envSlot(binding)))
+	}
 
-func (vm *VM) Clone() *VM {
-	vm.readOnly = true
-	return vm
+	vm.setBound[EnvBinding] = func(binding Binding, value Value) {
+		vm.write(vm.envSlot(binding), cell(value))
+	}
 }
 
+// Clone returns a read-only view of the VM. Cells that existed at the moment
+// of cloning can't be written, new cells may still be allocated so the view
+// is able to parse and evaluate code. Memory pages and symbols are
+// shared with the VM and copied by whichever side writes to them first, so
+// the VM keeps running while the view is in use. Clone must be called from the
+// goroutine that owns the VM, views are used through Fork.
+func (vm *VM) Clone() *VM {
+	clone := *vm
+	clone.mem = vm.mem.share()
+	clone.stack = append([]Value(nil), vm.stack...)
+	clone.bindStack = append([]Value(nil), vm.bindStack...)
+	clone.proc = vm.proc[:len(vm.proc):len(vm.proc)]
+	clone.procNames = vm.procNames[:len(vm.procNames):len(vm.procNames)]
+	clone.specs = make(map[ptr]*fnSpec)
+	clone.resetCode()
+	clone.budget, clone.journal = budget{}, nil
+	clone.Hook, clone.frames = nil, nil
+	clone.loading = nil
+	clone.readOnly = true
+	clone.frozen = ptr(vm.top)
+	clone.sharedMaps = true
+	vm.sharedMaps = true
+	clone.initBindings()
+	return &clone
+}
+
+// Fork returns a VM to evaluate code against a read-only view with the given
+// stack. Any number of forks of the same view may run concurrently, forking a
+// VM which is not a view clones it first.
 func (vm *VM) Fork(stack []Value, sp uint) *VM {
+	if !vm.readOnly {
+		vm = vm.Clone()
+	}
 	fork := *vm
+	fork.mem = vm.mem.fork()
 	fork.stack = stack
 	fork.sp = sp
+	fork.bindStack = make([]Value, len(vm.bindStack))
+	fork.specs = make(map[ptr]*fnSpec)
+	fork.resetCode()
+	fork.budget, fork.journal = budget{}, nil
+	fork.Hook, fork.frames = nil, nil
+	fork.loading = nil
 	fork.initBindings()
 	return &fork
 }
 
+func (vm *VM) ownMaps() {
+	if !vm.sharedMaps {
+		return
+	}
+	symbols := make(map[string]sym, len(vm.symbols))
+	for k, v := range vm.symbols {
+		symbols[k] = v
+	}
+	inverse := make(map[sym]string, len(vm.InverseSymbols))
+	for k, v := range vm.InverseSymbols {
+		inverse[k] = v
+	}
+	vm.symbols = symbols
+	vm.InverseSymbols = inverse
+	spans := make(map[pBlockEntry]Span, len(vm.spans))
+	for k, v := range vm.spans {
+		spans[k] = v
+	}
+	vm.spans = spans
+	vm.sharedMaps = false
+}
+
 func (vm *VM) alloc(cell cell) ptr {
-	if vm.readOnly {
-		panic("alloc in read only mode")
+	if vm.top >= maxHeap-heapReserve || vm.budget.cells && vm.top >= vm.budget.maxTop {
+		if vm.budget.cells && vm.top >= vm.budget.maxTop {
+			vm.allocExceeded()
+		}
+		if vm.top >= maxHeap {
+			panic("heap exhausted")
+		}
+		if !vm.exhausted {
+			vm.exhausted = true
+			throw(ErrInternal, "heap exhausted")
+		}
 	}
 	vm.top++
-	vm.mem[vm.top] = cell
+	vm.mem.write(ptr(vm.top), cell)
 	return ptr(vm.top)
 }
 
-func (vm *VM) read(ptr ptr) cell { return vm.mem[ptr] }
+func (vm *VM) read(ptr ptr) cell { return vm.mem.read(ptr) }
 func (vm *VM) write(ptr ptr, cell cell) {
-	if vm.readOnly {
-		panic("write in read only mode")
+	if vm.readOnly && ptr <= vm.frozen {
+		throw(ErrReadOnly, "write in read only mode")
+	}
+	if ptr == 0 {
+		throw(ErrInternal, "null pointer assignment")
 	}
+	vm.journalWrite(ptr)
+	vm.writes++
+	vm.mem.write(ptr, cell)
+}
+
+// writeBinding stores a word binding. Code is rebound while it runs, so this
+// is allowed on frozen cells of a view, the write lands in a private page.
+func (vm *VM) writeBinding(ptr ptr, binding Binding) {
 	if ptr == 0 {
-		panic("null pointer assignment")
+		throw(ErrInternal, "null pointer assignment")
 	}
-	vm.mem[ptr] = cell
+	vm.journalWrite(ptr)
+	vm.writes++
+	vm.mem.write(ptr, cell(binding))
 }
 
 func (vm *VM) push(value Value) {
@@ -190,13 +372,14 @@ func (vm *VM) pop() Value {
 
 func (vm *VM) Dump() {
 	for i := 0; i <= int(vm.top); i++ {
-		fmt.Printf("%016x\n", vm.mem[i])
+		fmt.Printf("%016x\n", vm.read(ptr(i)))
 	}
 }
 
 func (vm *VM) GetSymbolID(sym string) uint {
 	id, ok := vm.symbols[sym]
 	if !ok {
+		vm.ownMaps()
 		vm.nextSymbol++
 		id = vm.nextSymbol
 		vm.symbols[sym] = id
@@ -205,9 +388,19 @@ func (vm *VM) GetSymbolID(sym string) uint {
 	return id
 }
 
+const bootLoadNative = "boot/load-native"
+
 func loadNative(vm *VM) Value {
-	name := vm.Next().String().String(vm)
-	f := vm.Library.getFunction(name)
+	arg, err := vm.nextArg("load-native", StringType)
+	if err != 0 {
+		return err
+	}
+	name := arg.String().String(vm)
+	f, e := vm.Library.findFunction(name)
+	if e != nil {
+		return vm.fail(ErrNoFunction, e.Error(), arg)
+	}
+	vm.procNames = append(vm.procNames, name)
 	return vm.addNative(f)
 }
 
@@ -224,13 +417,38 @@ func (vm *VM) ToString(value Value) string {
 
 // B I N D I N G S
 
+// bind binds the words of the block and of the blocks it holds. The set-words
+// of the spec and the body of a module expression are left to the module, see
+// defineModule, so they don't leak into the enclosing context.
 func bind(vm *VM, block Block, factory bindFactory) {
+	moduleSym, inModule := vm.symbols["module"], 0
 	for i := block.First(vm); i != 0; i = i.Next(vm) {
 		value := i.Value(vm)
+		switch kind := value.Kind(); {
+		case inModule > 0 && kind == BlockType:
+			inModule--
+			vm.bindFunc[kind](vm, value, usesOnly(factory))
+			continue
+		case kind == WordType && value.Word().Sym() == moduleSym:
+			inModule = 2
+		default:
+			inModule = 0
+		}
 		vm.bindFunc[value.Kind()](vm, value, factory)
 	}
 }
 
+// usesOnly wraps a factory to bind the words of a block but not its
+// set-words.
+func usesOnly(factory bindFactory) bindFactory {
+	return func(sym sym, create bool) Binding {
+		if create {
+			return 0
+		}
+		return factory(sym, false)
+	}
+}
+
 func (vm *VM) bind(block Block) {
 	bind(vm, block, func(sym sym, create bool) Binding {
 		symValPtr := vm.Dictionary.Find(vm, sym)
@@ -251,40 +469,116 @@ func (vm *VM) bind(block Block) {
 }
 
 func (vm *VM) call(block Block) Value {
-	pc := vm.pc
-	vm.pc = block.First(vm)
+	if err := vm.enter(); err != 0 {
+		return err
+	}
 	var result Value
-	for vm.pc != 0 && result.Kind() != ErrorType {
-		result = vm.Next()
+	if vm.Compile && vm.Hook == nil {
+		result = vm.run(block.First(vm))
+	} else {
+		result = vm.Exec(block.First(vm))
 	}
-	vm.pc = pc
+	vm.leave()
 	return result
 }
 
+// Exec evaluates code starting at the entry, evaluation stops when an error
+// is raised.
 func (vm *VM) Exec(first pBlockEntry) Value {
 	pc := vm.pc
 	vm.pc = first
 	var result Value
-	for vm.pc != 0 {
+	for vm.pc != 0 && vm.raised == 0 {
 		result = vm.Next()
 	}
 	vm.pc = pc
+	if vm.raised != 0 {
+		return vm.raised
+	}
 	return result
 }
 
+// BindAndExec binds the block to the dictionary and evaluates it. A raised
+// error is returned as the result, the VM is ready for the next evaluation.
 func (vm *VM) BindAndExec(block Block) Value {
-	// block := Block(vm.read(ptr(code)))
-	vm.bind(block)
-	return vm.call(block)
+	result, _ := vm.bindAndExec(block)
+	return result
+}
+
+func (vm *VM) bindAndExec(block Block) (Value, bool) {
+	return vm.limited(func() (Value, bool) {
+		return vm.catchAll(func() Value {
+			vm.bind(block)
+			return vm.call(block)
+		})
+	})
+}
+
+// ScriptError is returned by Eval when evaluation raises an error. Line and
+// Column are 0 when the position is unknown.
+type ScriptError struct {
+	Value   Value
+	Code    int
+	Message string
+	Line    int
+	Column  int
+}
+
+func (e *ScriptError) Error() string { return e.Message }
+
+// Eval parses, binds and evaluates source. If an error is raised it is
+// returned as *ScriptError, the VM stays usable.
+func (vm *VM) Eval(source string) (Value, error) {
+	vm.at = 0
+	code, err := vm.parseSafe(source)
+	if err != 0 {
+		return err, vm.scriptError(err)
+	}
+	result, raised := vm.bindAndExec(code)
+	if raised {
+		return result, vm.scriptError(result)
+	}
+	return result, nil
+}
+
+func (vm *VM) scriptError(err Value) error {
+	e := err.Error()
+	return &ScriptError{
+		Value:   err,
+		Code:    e.Code(vm),
+		Message: vm.ToString(err),
+		Line:    e.field(vm, "line").Val(),
+		Column:  e.field(vm, "column").Val(),
+	}
+}
+
+// parseSafe parses source, syntax errors and panics are returned as errors.
+func (vm *VM) parseSafe(source string) (code Block, err Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = vm.MakeError(ErrInternal, fmt.Sprint(r), 0).Value()
+		}
+	}()
+	code, e := vm.Parse(source)
+	if e != nil {
+		return 0, vm.syntaxError(e.(*SyntaxError)).Value()
+	}
+	return code, 0
 }
 
 func (vm *VM) nextNoInfix() Value {
+	if err := vm.step(); err != 0 {
+		return err
+	}
+	if vm.Hook != nil {
+		vm.hookNext()
+	}
+	vm.at = vm.pc
 	entry := blockEntry(vm.read(ptr(vm.pc)))
 	value := Value(vm.read(entry.pval()))
 	vm.pc = entry.next()
 	kind := value.Kind()
 	result := vm.execFunc[kind](vm, value)
-	vm.result = result
 	return result
 }
 
@@ -292,17 +586,68 @@ func (vm *VM) ReadNext() Value {
 	entry := blockEntry(vm.read(ptr(vm.pc)))
 	value := Value(vm.read(entry.pval()))
 	vm.pc = entry.next()
-	vm.result = value
 	return value
 }
 
+// Next evaluates the next expression, operators following a value apply to
+// it and the value after them.
 func (vm *VM) Next() Value {
-	return vm.nextNoInfix()
+	if len(vm.feed) != 0 {
+		return vm.feedNext()
+	}
+	if err := vm.step(); err != 0 {
+		return err
+	}
+	if vm.Hook != nil {
+		vm.hookNext()
+	}
+	vm.at = vm.pc
+	entry := blockEntry(vm.read(ptr(vm.pc)))
+	value := Value(vm.read(entry.pval()))
+	vm.pc = entry.next()
+	result := vm.execFunc[value.Kind()](vm, value)
+	if vm.pc == 0 || vm.infixAt(vm.pc) == nil {
+		return result
+	}
+	return vm.nextInfix(result)
+}
+
+// infixTail applies the operators following an evaluated value to it.
+func (vm *VM) infixTail(result Value) Value {
+	if vm.pc == 0 || vm.infixAt(vm.pc) == nil {
+		return result
+	}
+	return vm.nextInfix(result)
+}
+
+func (vm *VM) nextInfix(result Value) Value {
+	for vm.pc != 0 && vm.raised == 0 {
+		op := vm.infixAt(vm.pc)
+		if op == nil {
+			break
+		}
+		at := vm.pc
+		vm.pc = blockEntry(vm.read(ptr(vm.pc))).next()
+		if vm.pc == 0 {
+			vm.at = at
+			return vm.fail(ErrType, "missing value after "+vm.ToString(at.Value(vm)), 0)
+		}
+		right := vm.nextNoInfix()
+		if vm.raised != 0 {
+			return vm.raised
+		}
+		vm.at = at
+		result = op(vm, result, right)
+	}
+	return result
 }
 
 type Pkg struct {
-	name string
-	fn   map[string]procFunc
+	name  string
+	fn    map[string]procFunc
+	names []string
+	arity map[string]int
+	loops map[string]bool
 }
 
 type Library struct {
@@ -314,21 +659,81 @@ func (l *Library) Add(pkg *Pkg) {
 }
 
 func (l *Library) getFunction(name string) procFunc {
-	s := strings.Split(name, "/")
+	f, err := l.findFunction(name)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (l *Library) findFunction(name string) (procFunc, error) {
+	s := strings.SplitN(name, "/", 2)
+	if len(s) == 2 {
+		for _, p := range l.packages {
+			if p.name == s[0] {
+				if f, ok := p.fn[s[1]]; ok {
+					return f, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("function not found: %s", name)
+}
+
+// arity returns the number of arguments of a native added by AddGoFunc.
+func (l *Library) arity(name string) (int, bool) {
+	if p, short := l.native(name); p != nil {
+		n, ok := p.arity[short]
+		return n, ok
+	}
+	return 0, false
+}
+
+// loop tells if a native was added by AddLoopFunc.
+func (l *Library) loop(name string) bool {
+	p, short := l.native(name)
+	return p != nil && p.loops[short]
+}
+
+// native returns the package of a native by its full name and its name in
+// the package, nil when there is no such package.
+func (l *Library) native(name string) (*Pkg, string) {
+	s := strings.SplitN(name, "/", 2)
+	if len(s) == 2 {
+		if p := l.pkg(s[0]); p != nil {
+			return p, s[1]
+		}
+	}
+	return nil, ""
+}
+
+func (l *Library) pkg(name string) *Pkg {
 	for _, p := range l.packages {
-		if p.name == s[0] {
-			return p.fn[s[1]]
+		if p.name == name {
+			return p
 		}
 	}
-	panic("function not found")
+	return nil
 }
 
 func NewPackage(name string) *Pkg {
-	return &Pkg{name: name, fn: make(map[string]procFunc)}
+	return &Pkg{name: name, fn: make(map[string]procFunc), arity: make(map[string]int), loops: make(map[string]bool)}
 }
 
 func (p *Pkg) AddFunc(name string, fn procFunc) {
+	if _, ok := p.fn[name]; !ok {
+		p.names = append(p.names, name)
+	}
 	p.fn[name] = fn
+	delete(p.arity, name)
+	delete(p.loops, name)
+}
+
+// AddLoopFunc adds a native taking a word it sets for a block, like foreach.
+// The word becomes a local of the functions calling the native.
+func (p *Pkg) AddLoopFunc(name string, fn procFunc) {
+	p.AddFunc(name, fn)
+	p.loops[name] = true
 }
 
 // func (vm *VM) addNativeFunc(name string, f procFunc) {
@@ -337,8 +742,8 @@ func (p *Pkg) AddFunc(name string, fn procFunc) {
 // }
 
 func (vm *VM) LoadPackage(pkg *Pkg, dict dict) {
-	for name, fn := range pkg.fn {
-		native := vm.addNative(fn)
+	for _, name := range pkg.names {
+		native := vm.addNative(pkg.fn[name])
 		sym := sym(vm.GetSymbolID(name))
 		dict.Put(vm, sym, native)
 		vm.procNames = append(vm.procNames, pkg.name+"/"+name)
@@ -359,17 +764,29 @@ func (vm *VM) Show() {
 }
 
 type SerialVM struct {
-	Top        uint
-	Dictionary dict
-	Mem        []cell
-	Symbols    map[string]sym
-	ProcNames  []string
+	Top         uint
+	MemSize     int
+	Dictionary  dict
+	Modules     dict
+	ModuleFiles dict
+	Mem         []cell
+	Symbols     map[string]sym
+	ProcNames   []string
 }
 
 func (vm *VM) Save() []byte {
 	var result bytes.Buffer
 
-	svm := &SerialVM{Top: vm.top, Dictionary: vm.Dictionary, Mem: vm.mem, Symbols: vm.symbols, ProcNames: vm.procNames}
+	svm := &SerialVM{
+		Top:         vm.top,
+		MemSize:     vm.gc.initial,
+		Dictionary:  vm.Dictionary,
+		Modules:     vm.modules,
+		ModuleFiles: vm.moduleFiles,
+		Mem:         vm.mem.cells(ptr(vm.top)),
+		Symbols:     vm.symbols,
+		ProcNames:   vm.procNames,
+	}
 
 	enc := gob.NewEncoder(&result)
 	err := enc.Encode(svm)
@@ -380,32 +797,66 @@ func (vm *VM) Save() []byte {
 	return result.Bytes()
 }
 
-func LoadVM(data []byte, stackSize int, lib Library) *VM {
+func LoadVM(data []byte, stackSize int, lib Library) (*VM, error) {
 	reader := bytes.NewReader(data)
 	var svm SerialVM
 
 	dec := gob.NewDecoder(reader)
 	err := dec.Decode(&svm)
 	if err != nil {
-		log.Fatal("decode error 1:", err)
+		return nil, fmt.Errorf("decode vm: %w", err)
 	}
 
-	vm := &VM{top: svm.Top, mem: svm.Mem, Dictionary: svm.Dictionary, symbols: svm.Symbols, procNames: svm.ProcNames}
+	vm := &VM{
+		top:         svm.Top,
+		mem:         memoryOf(svm.Mem),
+		gc:          newGCState(svm.MemSize),
+		Dictionary:  svm.Dictionary,
+		modules:     svm.Modules,
+		moduleFiles: svm.ModuleFiles,
+		symbols:     svm.Symbols,
+		procNames:   svm.ProcNames,
+		Library:     lib,
+		bindStack:   make([]Value, 25),
+		Services:    make(map[string]interface{}),
+	}
+
+	if vm.symbols == nil {
+		vm.symbols = make(map[string]sym)
+	}
+	vm.spans = make(map[pBlockEntry]Span)
+	vm.specs = make(map[ptr]*fnSpec)
 
 	vm.InverseSymbols = make(map[sym]string)
 	for k, v := range vm.symbols {
 		vm.InverseSymbols[v] = k
+		if v > vm.nextSymbol {
+			vm.nextSymbol = v
+		}
 	}
-	vm.nextSymbol = uint(len(vm.symbols))
 
 	for _, n := range vm.procNames {
-		vm.proc = append(vm.proc, lib.getFunction(n))
+		if n == bootLoadNative {
+			vm.proc = append(vm.proc, loadNative)
+			continue
+		}
+		f, err := lib.findFunction(n)
+		if err != nil {
+			return nil, err
+		}
+		vm.proc = append(vm.proc, f)
 	}
 
 	vm.stack = make([]Value, stackSize)
+	vm.initToString()
 	vm.initBindings()
+	vm.initInfix()
+	if vm.modules == 0 {
+		// saved before modules were registered outside the dictionary
+		vm.modules, vm.moduleFiles = vm.AllocDict(), vm.AllocDict()
+	}
 
-	return vm
+	return vm, nil
 }
 
 // pc             pBlockEntry
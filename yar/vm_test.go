@@ -17,13 +17,14 @@ package yar
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 )
 
 func TestBind(t *testing.T) {
 	vm := NewVM(1000, 100)
 	vm.Dictionary.Put(vm, vm.GetSymbolID("native"), vm.addNative(func(vm *VM) Value { return 42 }))
-	code := vm.Parse("native [x y]")
+	code := vm.MustParse("native [x y]")
 	t.Logf("%s", vm.ToString(code.Value()))
 	vm.Dump()
 	vm.bind(code)
@@ -35,7 +36,7 @@ func TestBind(t *testing.T) {
 func TestAdd(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("add 1 2")
+	code := vm.MustParse("add 1 2")
 	vm.bind(code)
 	result := vm.call(code)
 	t.Logf("result: %016x", result)
@@ -44,7 +45,7 @@ func TestAdd(t *testing.T) {
 func TestAddAdd(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("add add 1 2 3")
+	code := vm.MustParse("add add 1 2 3")
 	vm.bind(code)
 	result := vm.call(code)
 	t.Logf("result: %016x", result)
@@ -53,7 +54,7 @@ func TestAddAdd(t *testing.T) {
 func TestFn(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("x: fn [n] [add n 10] x 5")
+	code := vm.MustParse("x: fn [n] [add n 10] x 5")
 	vm.bind(code)
 	t.Logf("%s", vm.ToString(code.Value()))
 	result := vm.call(code)
@@ -63,7 +64,7 @@ func TestFn(t *testing.T) {
 func TestSum(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("sum: fn [n] [either gt n 1 [add n sum sub n 1] [n]] sum 100")
+	code := vm.MustParse("sum: fn [n] [either gt n 1 [add n sum sub n 1] [n]] sum 100")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -71,7 +72,7 @@ func TestSum(t *testing.T) {
 func TestGetWord(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("sum: fn [n] [add n n] x: 5 :x")
+	code := vm.MustParse("sum: fn [n] [add n n] x: 5 :x")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -86,7 +87,7 @@ func TestFork(t *testing.T) {
 	// 	fork := clone.Fork(stack, uint(len(stack)))
 	// 	return fork.Exec(fn.First())
 	// })
-	// code := vm.Parse("sum: fn [x y] [add x y] fork :sum")
+	// code := vm.MustParse("sum: fn [x y] [add x y] fork :sum")
 	// result := vm.BindAndExec(code)
 	// t.Logf("result: %016x", result)
 }
@@ -94,7 +95,7 @@ func TestFork(t *testing.T) {
 func TestMakeObject(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("o: make-object [a: 1 b: 2 c: add 5 5] o/c")
+	code := vm.MustParse("o: make-object [a: 1 b: 2 c: add 5 5] o/c")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -102,7 +103,7 @@ func TestMakeObject(t *testing.T) {
 func TestPath(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("o: make-object [a: 42 b: 2] o/a")
+	code := vm.MustParse("o: make-object [a: 42 b: 2] o/a")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -110,7 +111,7 @@ func TestPath(t *testing.T) {
 func TestPath2(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("o: make-object [a: 42 b: make-object [c: 55]] o/b/c")
+	code := vm.MustParse("o: make-object [a: 42 b: make-object [c: 55]] o/b/c")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -118,7 +119,7 @@ func TestPath2(t *testing.T) {
 func TestStrings(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("o: [\"a\" \"b\"]")
+	code := vm.MustParse("o: [\"a\" \"b\"]")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -126,7 +127,7 @@ func TestStrings(t *testing.T) {
 func TestForeach(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("foreach val [\"a\" \"b\"] [print val]")
+	code := vm.MustParse("foreach val [\"a\" \"b\"] [print val]")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -134,7 +135,7 @@ func TestForeach(t *testing.T) {
 func TestAppend(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("print append [\"a\" \"b\"] \"c\"")
+	code := vm.MustParse("print append [\"a\" \"b\"] \"c\"")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -142,7 +143,7 @@ func TestAppend(t *testing.T) {
 func TestError(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("unknown 5")
+	code := vm.MustParse("unknown 5")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -150,7 +151,7 @@ func TestError(t *testing.T) {
 func TestIn(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("x: make-object [a: 41 b: 2] get in x 'a")
+	code := vm.MustParse("x: make-object [a: 41 b: 2] get in x 'a")
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
@@ -158,29 +159,108 @@ func TestIn(t *testing.T) {
 func TestSetPath(t *testing.T) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("x: make-object [a: 41 b: 2] x/a: 256 print x/a")
+	code := vm.MustParse("x: make-object [a: 41 b: 2] x/a: 256 print x/a")
 	fmt.Println(vm.ToString(code.Value()))
 	result := vm.BindAndExec(code)
 	t.Logf("result: %016x", result)
 }
 
 func TestSave(t *testing.T) {
-	// vm := NewVM(1000, 100)
-	// BootVM(vm)
-	// code := vm.Parse("sum: fn [n] [add n n] sum 5")
-	// data := vm.Save()
-	// lib := &pkg{lib: coreLibrary}
-	// vm2 := LoadVM(data, 100, lib)
-	// //BootVM(vm2)
-	// fmt.Printf("%+v\n\n", vm)
-	// fmt.Printf("%+v\n", vm2)
-	// result := vm2.BindAndExec(code)
-	// t.Logf("result: %016x", result)
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse("sum: fn [n] [add n n] name: \"rack\""))
+	data := vm.Save()
+
+	vm2, err := LoadVM(data, 100, vm.Library)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := vm2.BindAndExec(vm2.MustParse("sum 5"))
+	if result != MakeInt(10).Value() {
+		t.Errorf("sum 5 = %s, want 10", vm2.ToString(result))
+	}
+	name := vm2.BindAndExec(vm2.MustParse("name"))
+	if name.Kind() != StringType || name.String().String(vm2) != "rack" {
+		t.Errorf("name = %s, want \"rack\"", vm2.ToString(name))
+	}
+}
+
+func TestLoadUnknownNative(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	if _, err := LoadVM(vm.Save(), 100, Library{}); err == nil {
+		t.Error("expected error for missing core package")
+	}
 }
 
 func BenchmarkFib(t *testing.B) {
 	vm := NewVM(1000, 100)
 	BootVM(vm)
-	code := vm.Parse("fib: fn [n] [either gt n 1 [add fib sub n 2 fib sub n 1] [n]] fib 40")
+	code := vm.MustParse("fib: fn [n] [either gt n 1 [add fib sub n 2 fib sub n 1] [n]] fib 40")
 	vm.BindAndExec(code)
 }
+
+func TestClone(t *testing.T) {
+	vm := NewVM(1000, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse("o: make-object [a: 1] b: []"))
+
+	clone := vm.Clone()
+	result := clone.BindAndExec(clone.MustParse("add o/a 41"))
+	if result != MakeInt(42).Value() {
+		t.Errorf("add o/a 41 = %s, want 42", clone.ToString(result))
+	}
+
+	vm.BindAndExec(vm.MustParse("o/a: 2"))
+	if a := clone.BindAndExec(clone.MustParse("o/a")); a != MakeInt(1).Value() {
+		t.Errorf("clone sees o/a = %s after primary write, want 1", clone.ToString(a))
+	}
+
+	result = clone.BindAndExec(clone.MustParse("append b 1"))
+	if result.Kind() != ErrorType || result.Error().Code(clone) != ErrReadOnly {
+		t.Errorf("append to cloned block = %s, want read only error", clone.ToString(result))
+	}
+}
+
+func TestConcurrentViews(t *testing.T) {
+	vm := NewVM(100000, 100)
+	BootVM(vm)
+	vm.BindAndExec(vm.MustParse("counter: 0 items: [] last: fn [b] [foreach x b [x]]"))
+
+	step := vm.MustParse("counter: add counter 1 append items counter")
+	vm.bind(step)
+
+	var wg sync.WaitGroup
+	errors := make(chan string, 100)
+	for round := 1; round <= 10; round++ {
+		for i := 0; i < 10; i++ {
+			vm.call(step)
+		}
+		view := vm.Clone()
+		want := MakeInt(round * 10).Value()
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 5; k++ {
+					fork := view.Fork(make([]Value, 100), 0)
+					if v := fork.BindAndExec(fork.MustParse("counter")); v != want {
+						errors <- fmt.Sprintf("counter = %s, want %s", fork.ToString(v), fork.ToString(want))
+					}
+					if v := fork.BindAndExec(fork.MustParse("last items")); v != want {
+						errors <- fmt.Sprintf("last items = %s, want %s", fork.ToString(v), fork.ToString(want))
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errors)
+	for e := range errors {
+		t.Error(e)
+	}
+
+	if v := vm.BindAndExec(vm.MustParse("counter")); v != MakeInt(100).Value() {
+		t.Errorf("primary counter = %s, want 100", vm.ToString(v))
+	}
+}
@@ -16,7 +16,6 @@
 package yar
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 )
@@ -33,7 +32,11 @@ type pWord = pItem
 // type pBindings = ptr
 type bindFactory func(sym sym, create bool) Binding
 
-func (v Value) Word() Word  { return Word(v) }
+func (v Value) Word() Word { return Word(v) }
+
+func isWord(kind int) bool {
+	return kind == WordType || kind == GetWordType || kind == SetWordType || kind == QuoteType
+}
 func (w Word) Value() Value { return Value(w) }
 
 func _makeWord(sym sym, bindings pBinding, kind int) Word {
@@ -60,6 +63,12 @@ func (vm *VM) AllocQuoteWord(sym sym) Word {
 	return _makeWord(sym, bindings, QuoteType)
 }
 
+// AllocRefinement makes a refinement like /local. Refinements are never
+// bound, so no binding cell is allocated.
+func (vm *VM) AllocRefinement(sym sym) Word {
+	return _makeWord(sym, 0, RefinementType)
+}
+
 func (w Word) Sym() sym           { return sym(obj(w).ptr()) }
 func (w Word) bindings() pBinding { return pBinding(obj(w).val()) }
 
@@ -68,7 +77,7 @@ func wordBind(vm *VM, value Value, factory bindFactory) {
 	sym := w.Sym()
 	bindings := factory(sym, false)
 	if bindings != 0 {
-		vm.write(ptr(w.bindings()), cell(bindings))
+		vm.writeBinding(ptr(w.bindings()), bindings)
 	}
 }
 
@@ -76,11 +85,16 @@ func setWordBind(vm *VM, value Value, factory bindFactory) {
 	w := value.Word()
 	sym := w.Sym()
 	bindings := factory(sym, true)
-	vm.write(ptr(w.bindings()), cell(bindings))
+	if bindings != 0 {
+		vm.writeBinding(ptr(w.bindings()), bindings)
+	}
 }
 
 func wordExec(vm *VM, val Value) Value {
 	bound := getWordExec(vm, val)
+	if plain[bound.Kind()] {
+		return bound
+	}
 	return vm.execFunc[bound.Kind()](vm, bound)
 }
 
@@ -88,26 +102,59 @@ func getWordExec(vm *VM, val Value) Value {
 	w := Word(val)
 	bindings := Binding(vm.read(ptr(w.bindings())))
 	if bindings == 0 {
-		fmt.Printf("%016x, %d, %s\n", val, w.Sym(), vm.InverseSymbols[w.Sym()])
-		return MakeError(1).Value()
+		bindings = vm.lateBind(w.Sym(), w.bindings())
 	}
-	bindingKind := bindings.Kind()
-	bound := vm.getBound[bindingKind](bindings)
-	return bound
+	if bindings == 0 {
+		return vm.fail(ErrNoValue, "word has no value: "+vm.InverseSymbols[w.Sym()], val)
+	}
+	return vm.bound(bindings)
+}
+
+// lateBind binds a word left unbound when its block was bound to a global
+// defined since, such as one exported by import. It returns 0 when there is
+// still no such global.
+func (vm *VM) lateBind(sym sym, cell pBinding) Binding {
+	sv := vm.Dictionary.Find(vm, sym)
+	if sv == 0 {
+		return 0
+	}
+	binding := makeMapBinding(ptr(sv))
+	if vm.getBound[MapBinding](binding) == 0 {
+		return 0
+	}
+	vm.writeBinding(ptr(cell), binding)
+	return binding
+}
+
+// hasValue tells if evaluating the word would not fail for a missing value.
+func (vm *VM) hasValue(w Word) bool {
+	binding := Binding(vm.read(ptr(w.bindings())))
+	if binding == 0 {
+		sv := vm.Dictionary.Find(vm, w.Sym())
+		return sv != 0 && Value(vm.read(ptr(sv.val(vm)))) != 0
+	}
+	return true
 }
 
 func setWordExec(vm *VM, val Value) Value {
 	w := Word(val)
 	bindings := Binding(vm.read(ptr(w.bindings())))
 	if bindings == 0 {
-		panic("setword not bound")
+		return vm.fail(ErrNotBound, "set-word not bound: "+vm.InverseSymbols[w.Sym()], val)
 	}
 	result := vm.Next()
+	if vm.raised != 0 {
+		return vm.raised
+	}
 	bindingKind := bindings.Kind()
 	vm.setBound[bindingKind](bindings, result)
 	return result
 }
 
+func refinementToString(vm *VM, value Value) string {
+	return "/" + vm.InverseSymbols[value.Word().Sym()]
+}
+
 func wordToString(vm *VM, value Value) string {
 	var result strings.Builder
 	w := Word(value)